@@ -4,7 +4,6 @@ go 1.24.4
 
 require (
 	github.com/tidwall/gjson v1.18.0
+	github.com/tidwall/match v1.1.1
 	github.com/tidwall/pretty v1.2.0
 )
-
-require github.com/tidwall/match v1.1.1 // indirect
@@ -2,13 +2,34 @@
 package sjson
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding"
+	"encoding/base64"
 	jsongo "encoding/json"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/url"
+	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/match"
+	"github.com/tidwall/pretty"
 )
 
 type errorType struct {
@@ -19,6 +40,27 @@ func (err *errorType) Error() string {
 	return err.msg
 }
 
+// PathError is returned when a path is malformed. Functions that parse
+// paths, such as Set, Delete, SplitPath, and Plan, return a *PathError,
+// which allows for telling a problem with the path apart from a problem
+// with the json.
+type PathError struct {
+	Path string // the malformed path
+	Pos  int    // rune index into the path where parsing failed
+	Msg  string // description of the problem
+}
+
+func (err *PathError) Error() string {
+	return "invalid path '" + err.Path + "' at position " +
+		strconv.Itoa(err.Pos) + ": " + err.Msg
+}
+
+// newPathError returns a PathError for the byte index i of the path.
+func newPathError(path string, i int, msg string) *PathError {
+	return &PathError{Path: path, Pos: utf8.RuneCountInString(path[:i]),
+		Msg: msg}
+}
+
 // Options represents additional options for the Set and Delete functions.
 type Options struct {
 	// Optimistic is a hint that the value likely exists which
@@ -32,9 +74,195 @@ type Options struct {
 	// created under the hood.
 	// The Optimistic flag must be set to true and the input must be a
 	// byte slice in order to use this field.
+	// Replacing an existing value with a raw value of the same size only
+	// writes the new value, without moving the rest of the json.
 	ReplaceInPlace bool
+	// ForceObjectKeys treats every path component as an object key, even
+	// when it's numeric. This is the same as prefixing every component with
+	// the ':' character. For example, the path "2021.revenue" will create
+	// {"2021":{"revenue":...}} rather than an array.
+	// A ':' prefix is still allowed and has no additional effect, so
+	// "2021.revenue" and ":2021.revenue" are the same path with this option.
+	// Existing array elements may still be replaced by their index, but an
+	// array can't be extended, because "-1" and numbers are object keys.
+	ForceObjectKeys bool
+	// NormalizeWhitespace minifies the entire json after the edit, rather
+	// than only the region being edited. By default sjson leaves the bytes
+	// outside of the edit untouched, which keeps diffs of the output
+	// minimal. With this option the output is compact, at the cost of
+	// rewriting every line of a formatted document.
+	NormalizeWhitespace bool
+	// NoExponent writes every float in plain decimal notation, such as
+	// 1000000 rather than 1e+06. Float values are always written this way,
+	// including the elements of slices and maps, but the floats inside of
+	// structs and json.Number values follow the encoding/json rules, which
+	// use exponents for very large and very small values. Enabling this
+	// option rewrites those as well.
+	NoExponent bool
+	// IntegerFloats writes numbers that have no fractional part as integers,
+	// such as 37 rather than 37.0 or 3.7e1. Go float values are always
+	// written this way, so this affects json.Number values and the numbers
+	// inside of encoded structs. Raw values and the existing json are not
+	// affected.
+	IntegerFloats bool
+	// FloatPrecision is the number of digits after the decimal point for
+	// float values, such as 2 for writing 1.0/3.0 as 0.33 and 12.5 as
+	// 12.50. It's not a number of significant digits, which would write
+	// large values with exponents. Zero uses the fewest digits that
+	// represent the value exactly. This affects the Go float values,
+	// including the elements of slices and maps, but not the floats inside
+	// of encoded structs. Use SetFloatPrecision to round a value to an
+	// integer.
+	FloatPrecision int
+	// FloatBitSize is the size of the floating point type that float
+	// values are formatted for, which is either 32 or 64, the default.
+	// With 32, a float is written with the fewest digits that represent it
+	// as a float32, such as 0.1 rather than 0.10000000149011612 for
+	// float32(0.1). A value that is too large for a float32 is handled the
+	// same as an infinite value, as specified by InvalidFloat.
+	FloatBitSize int
+	// TimeLayout is the layout used to write time.Time values, such as
+	// time.RFC3339. The default is time.RFC3339Nano, which is the same as
+	// encoding/json. Use UnixTimeLayout to write the time as a number of
+	// seconds since the Unix epoch.
+	TimeLayout string
+	// SkipPrefixBytes is the number of leading bytes that are not part of
+	// the json document, such as a "#!" line or a comment banner. These
+	// bytes are copied to the output untouched. A negative value skips
+	// everything before the first '{' or '[' character.
+	SkipPrefixBytes int
+	// PreserveType returns an error when the json type of the new value
+	// differs from the type of the existing value, such as replacing a
+	// number with a string. The types are object, array, string, number,
+	// boolean and null. Paths that don't exist yet are not checked.
+	PreserveType bool
+	// RequireSingleTarget returns an error when the path resolves to more
+	// than one value, such as a '#' wildcard over an array with many
+	// elements or a '#(...)#' query with many matches. Wildcards and
+	// queries are still allowed when they resolve to exactly one value.
+	RequireSingleTarget bool
+	// MaxStringLen is the maximum length, in bytes, of a string value. A
+	// longer string returns an error. The limit applies to the string
+	// before it's escaped for json. Zero means unlimited.
+	MaxStringLen int
+	// ValidateInput checks that the input json is well-formed before
+	// editing, returning ErrInvalidInput when it's not. An empty input is
+	// allowed. Without this option the input isn't validated, and editing
+	// invalid json may return unexpected results.
+	ValidateInput bool
+	// CaseInsensitiveKeys matches the path components to object keys while
+	// ignoring case, so that "name" edits an existing "Name" key rather
+	// than adding a new one. When an object has more than one key that
+	// matches, a key with the exact casing of the path wins, otherwise the
+	// first one in the object wins. New keys use the casing of the path.
+	CaseInsensitiveKeys bool
+	// CreateOnFilterMiss creates the element for a '#(key=value)' query
+	// that doesn't match any element of the array. The new element is an
+	// object with the query key and value, plus the rest of the path, and
+	// is appended to the array, which is created if needed. Only equality
+	// queries using '=' or '==' can be created, other queries return an
+	// error. When the query matches an element, the rest of the path is
+	// created inside of that element.
+	CreateOnFilterMiss bool
+	// InvalidFloat specifies how NaN and infinite float values are written.
+	// The default returns an error, like encoding/json.
+	InvalidFloat InvalidFloatMode
+	// EditFirstDuplicate edits the first occurrence of a key that appears
+	// more than once in an object. By default the last occurrence is edited,
+	// because json decoders normally keep the last value of a duplicate key.
+	// This also applies to Delete, which removes only the chosen occurrence.
+	EditFirstDuplicate bool
+	// NumberEncoder, when set, is called for every number value that is
+	// written, including elements of slices. This includes the Go integer
+	// and float types, and json.Number. It must return a valid json number.
+	// Raw values and the existing json are not affected.
+	NumberEncoder func(v interface{}) (string, error)
+	// Timeout aborts an edit with ErrTimeout when expanding '#' wildcards
+	// takes longer than the duration. The time is checked periodically
+	// while iterating over array elements. Zero means no timeout.
+	Timeout time.Duration
+	// MatchIndent reformats a written object or array value to match the
+	// indentation of the surrounding json, using the line of the edited key
+	// as the base indentation. When the json has no line breaks the value is
+	// made compact. By default the value is written exactly as is. This does
+	// not apply to values written by '#' wildcards.
+	MatchIndent bool
+	// DeleteArrayReplacement is a raw json value, such as null or a
+	// sentinel, that replaces a deleted array element. The following
+	// elements keep their indexes. By default the element is removed. This
+	// does not apply to elements deleted by '#' wildcards or queries.
+	DeleteArrayReplacement string
+	// MaxResultDepth returns an error when a written value would be nested
+	// deeper than the depth, where the root object or array is at depth 1.
+	// The depth of a written value is the number of path components plus
+	// the nesting depth of the value itself. Zero means unlimited.
+	MaxResultDepth int
+	// PercentDecodePath percent-decodes each path component that contains
+	// a '%', such as "a%2Eb" for the key "a.b". Decoding happens first, and
+	// the decoded component is then treated as a literal object key, so
+	// characters such as '.', '*', ':', and '\' have no special meaning.
+	// Components without a '%' are used as-is.
+	PercentDecodePath bool
+	// PreserveOrder inserts a new object key before the first existing key
+	// that sorts after it, rather than at the end of the object. This keeps
+	// the keys of a sorted object sorted, and otherwise gives new keys a
+	// stable position, which makes for smaller diffs. Existing keys are
+	// never moved.
+	PreserveOrder bool
+	// PadValue is a raw json value, such as 0, "", or {}, that fills the
+	// missing elements when setting an index past the end of an array. The
+	// default is null. An error is returned if the value isn't valid json.
+	PadValue jsongo.RawMessage
+	// EscapeUnicode writes every non-ASCII character of a new string value
+	// or object key as a \uXXXX escape sequence, using a surrogate pair for
+	// characters outside of the Basic Multilingual Plane. This produces
+	// ASCII-only output for consumers that require it. Raw values and the
+	// existing json are not affected.
+	EscapeUnicode bool
+	// KeepFormatting writes new object keys and array elements in the
+	// style of a pretty-printed document. Each new key or element is
+	// placed on its own line, using the indentation detected from the
+	// document, and new objects and arrays are indented to match. A
+	// document without line breaks is left compact.
+	KeepFormatting bool
+	// Validate returns ErrInvalidOutput, rather than a malformed result,
+	// when an edit would produce invalid json, such as when SetRaw is given
+	// a value that isn't valid json. Only the written value and its
+	// immediate surroundings are checked, not the whole document, so use
+	// ValidateInput to also check the input.
+	Validate bool
+	// SortKeys sorts the keys of an object when a new key is added to it,
+	// so that the objects that sjson edits have sorted keys. The whitespace
+	// in front of each key moves with the key. Other objects, including the
+	// rest of the document and raw values, are not sorted.
+	SortKeys bool
+	// AppendUnique skips appending a value with the "-1" key when the array
+	// already has an equal element, leaving the json unchanged. Values are
+	// compared using their Canonical form, so objects are equal when they
+	// have the same keys and values in any order, and numbers are equal
+	// when they have the same value in any notation, such as 1 and 1.0.
+	// Strings, booleans, and null are equal when they are the same value.
+	AppendUnique bool
+	// NoArrayGrowth returns an error when setting an array index that is
+	// past the last element, rather than growing the array and padding it.
+	// This includes new arrays, which have no elements. The "-1" key still
+	// appends a value to an array.
+	NoArrayGrowth bool
+
+	ctx context.Context // from SetContext and friends
 }
 
+// InvalidFloatMode specifies how NaN and infinite float values are written,
+// as these have no representation in json.
+type InvalidFloatMode int
+
+const (
+	// ErrorOnInvalidFloat returns an error for NaN and infinite values.
+	ErrorOnInvalidFloat InvalidFloatMode = iota
+	// NullOnInvalidFloat writes null for NaN and infinite values.
+	NullOnInvalidFloat
+)
+
 type pathResult struct {
 	part  string // current key part
 	gpart string // gjson get part
@@ -133,31 +361,58 @@ func appendStringify(buf []byte, s string) []byte {
 	return buf
 }
 
+// appendEscapeUnicode appends s to buf, with every non-ASCII character
+// replaced by a \u escape sequence.
+func appendEscapeUnicode(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); {
+		if s[i] < utf8.RuneSelf {
+			buf = append(buf, s[i])
+			i++
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(s[i:])
+		i += n
+		r1, r2 := utf16.EncodeRune(r)
+		if r1 == utf8.RuneError {
+			r1, r2 = r, 0
+		}
+		for _, r := range [2]rune{r1, r2} {
+			if r != 0 {
+				buf = append(buf, '\\', 'u', hex[r>>12&0xF], hex[r>>8&0xF],
+					hex[r>>4&0xF], hex[r&0xF])
+			}
+		}
+	}
+	return buf
+}
+
 // appendBuild builds a json block from a json path.
 func appendBuild(buf []byte, array bool, paths []pathResult, raw string,
-	stringify bool) []byte {
+	stringify bool, st *setState) []byte {
 	if !array {
-		buf = appendStringify(buf, paths[0].part)
+		if st.opts != nil && st.opts.EscapeUnicode {
+			buf = appendEscapeUnicode(buf,
+				string(appendStringify(nil, paths[0].part)))
+		} else {
+			buf = appendStringify(buf, paths[0].part)
+		}
 		buf = append(buf, ':')
 	}
 	if len(paths) > 1 {
 		n, numeric := atoui(paths[1])
 		if numeric || (!paths[1].force && paths[1].part == "-1") {
 			buf = append(buf, '[')
-			buf = appendRepeat(buf, "null,", n)
-			buf = appendBuild(buf, true, paths[1:], raw, stringify)
+			buf = st.appendPadding(buf, n, false)
+			buf = appendBuild(buf, true, paths[1:], raw, stringify, st)
 			buf = append(buf, ']')
 		} else {
 			buf = append(buf, '{')
-			buf = appendBuild(buf, false, paths[1:], raw, stringify)
+			buf = appendBuild(buf, false, paths[1:], raw, stringify, st)
 			buf = append(buf, '}')
 		}
 	} else {
-		if stringify {
-			buf = appendStringify(buf, raw)
-		} else {
-			buf = append(buf, raw...)
-		}
+		buf = st.appendValue(buf, raw, stringify)
 	}
 	return buf
 }
@@ -210,7 +465,7 @@ loop:
 		// look for either a ',',':','['
 		switch buf[i] {
 		case '[':
-			return buf, true
+			return buf[:i+1], true
 		case ',':
 			return buf[:i], false
 		case ':':
@@ -248,28 +503,353 @@ loop:
 
 var errNoChange = &errorType{"no change"}
 
-func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
-	stringify, del bool) ([]byte, error) {
-	var err error
+// ErrInvalidInput is returned when Options.ValidateInput is set and the
+// input json is not well-formed.
+var ErrInvalidInput error = &errorType{"invalid json input"}
+
+// ErrInvalidJSON is the same error as ErrInvalidInput. It allows for
+// distinguishing an invalid json document from a malformed path, which is
+// reported as a *PathError. The input isn't validated by default, because
+// that requires reading the whole document, so Set and Delete only return
+// this error when Options.ValidateInput is set. SetStream also returns it
+// when the json it reads is malformed.
+var ErrInvalidJSON = ErrInvalidInput
+
+// ErrInvalidOutput is returned when Options.Validate is set and an edit
+// would produce invalid json.
+var ErrInvalidOutput error = &errorType{"edit would produce invalid json"}
+
+// ErrEmptyRaw is returned when the value passed to SetRaw, or one of its
+// variants, is empty or only whitespace. Use "null" to write a null value.
+var ErrEmptyRaw error = &errorType{"raw value cannot be empty"}
+
+// ErrTimeout is returned when an edit takes longer than Options.Timeout.
+var ErrTimeout error = &errorType{"timeout"}
+
+// ErrNotEqual is returned by SetIfEquals when the existing value does not
+// equal the expected value.
+var ErrNotEqual error = &errorType{"value does not equal the expected value"}
+
+// setState carries the options of a set operation through the path
+// builders, and records where the value was written in the output.
+type setState struct {
+	opts     *Options
+	index    int             // offset of the written value, or -1 if unknown
+	end      int             // end offset of the written value
+	deadline time.Time       // from Options.Timeout, or zero
+	ctx      context.Context // from SetContext, or nil
+	buf      []byte          // buffer for the result, from SetRawBytesBuffer
+	indent   string          // indent unit of the json, for KeepFormatting
+	paths    []pathResult    // compiled path, from SetBatch
+}
+
+// newSetState is kept small enough to be inlined, which allows for the
+// state to live on the stack.
+func newSetState(opts *Options) *setState {
+	st := &setState{opts: opts, index: -1}
+	if opts != nil {
+		st.init()
+	}
+	return st
+}
+
+func (st *setState) init() {
+	if st.opts.Timeout > 0 {
+		st.deadline = time.Now().Add(st.opts.Timeout)
+	}
+	st.ctx = st.opts.ctx
+}
+
+// expired returns true if the deadline has passed or the context is done.
+func (st *setState) expired() bool {
+	return st.canceled() ||
+		!st.deadline.IsZero() && !time.Now().Before(st.deadline)
+}
+
+// canceled returns true if the context is done.
+func (st *setState) canceled() bool {
+	return st.ctx != nil && st.ctx.Err() != nil
+}
+
+// expiredErr returns the error for an expired edit, which is the error of
+// the context when it's done, and ErrTimeout otherwise.
+func (st *setState) expiredErr() error {
+	if st.canceled() {
+		return st.ctx.Err()
+	}
+	return ErrTimeout
+}
+
+// takeBuf returns the buffer for the result. The buffer is only returned
+// once, since later edits may read from the earlier result.
+func (st *setState) takeBuf() []byte {
+	buf := st.buf
+	st.buf = nil
+	return buf
+}
+
+// appendPadding appends n padding elements for an array, each followed by
+// a comma, or each preceded by a comma when leading is set.
+func (st *setState) appendPadding(buf []byte, n int, leading bool) []byte {
+	pad := "null"
+	if st.opts != nil && len(st.opts.PadValue) > 0 {
+		pad = string(st.opts.PadValue)
+	}
+	for i := 0; i < n; i++ {
+		if leading {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, pad...)
+		if !leading {
+			buf = append(buf, ',')
+		}
+	}
+	return buf
+}
+
+// checkPadValue returns an error if Options.PadValue is not valid json.
+func checkPadValue(opts *Options) error {
+	if opts != nil && len(opts.PadValue) > 0 &&
+		!gjson.ValidBytes(opts.PadValue) {
+		return &errorType{"invalid pad value"}
+	}
+	return nil
+}
+
+// checkType returns an error when Options.PreserveType is set and the json
+// type of the new value differs from the existing value.
+func (st *setState) checkType(old, raw string, stringify bool) error {
+	if st.opts == nil || !st.opts.PreserveType {
+		return nil
+	}
+	ntype := "string"
+	if !stringify {
+		ntype = jsonType(raw)
+	}
+	if otype := jsonType(old); otype != ntype {
+		return &errorType{"cannot replace " + otype + " value with " +
+			ntype + " value"}
+	}
+	return nil
+}
+
+// jsonType returns the json type name of the raw value.
+func jsonType(raw string) string {
+	raw = trim(raw)
+	if len(raw) == 0 {
+		return "null"
+	}
+	switch raw[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
+
+// appendValue appends the raw value to buf and records its location.
+func (st *setState) appendValue(buf []byte, raw string, stringify bool) []byte {
+	index := len(buf)
+	if stringify {
+		buf = appendStringify(buf, raw)
+	} else {
+		buf = append(buf, raw...)
+	}
+	st.index, st.end = index, len(buf)
+	return buf
+}
+
+// finish maps errNoChange to the original json and applies the output
+// options to the result.
+func finish(json, res []byte, err error, opts *Options) ([]byte, error) {
+	if err == errNoChange {
+		res, err = json, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	if opts != nil && opts.NormalizeWhitespace {
+		n := skipPrefix(*(*string)(unsafe.Pointer(&res)), opts)
+		res = append(res[:n:n], pretty.Ugly(res[n:])...)
+	}
+	return res, nil
+}
+
+// skipPrefix returns the number of leading bytes that are not part of the
+// json document, as specified by Options.SkipPrefixBytes.
+func skipPrefix(json string, opts *Options) int {
+	if opts == nil || opts.SkipPrefixBytes == 0 {
+		return 0
+	}
+	if opts.SkipPrefixBytes > 0 {
+		if opts.SkipPrefixBytes > len(json) {
+			return len(json)
+		}
+		return opts.SkipPrefixBytes
+	}
+	for i := 0; i < len(json); i++ {
+		if json[i] == '{' || json[i] == '[' {
+			return i
+		}
+	}
+	return 0
+}
+
+// getKeyFold returns the value of the first key in the object that is equal
+// to key under case-folding.
+func getKeyFold(jstr, key string) gjson.Result {
+	obj := gjson.Parse(jstr)
+	if !obj.IsObject() {
+		return gjson.Result{}
+	}
 	var res gjson.Result
-	var found bool
-	if del {
-		if paths[0].part == "-1" && !paths[0].force {
-			res = gjson.Get(jstr, "#")
-			if res.Int() > 0 {
-				res = gjson.Get(jstr, strconv.FormatInt(int64(res.Int()-1), 10))
-				found = true
+	obj.ForEach(func(k, v gjson.Result) bool {
+		if k.Str == key {
+			res = v
+			return false
+		}
+		if !res.Exists() && strings.EqualFold(k.Str, key) {
+			res = v
+		}
+		return true
+	})
+	return res
+}
+
+// getKey returns the value of the key in the object, which is found with a
+// single scan of the object's members. The last occurrence of a duplicate
+// key is returned, unless first is true.
+func getKey(obj, key string, first bool) gjson.Result {
+	var res gjson.Result
+	i := 0
+	for ; i < len(obj) && obj[i] <= ' '; i++ {
+	}
+	if i == len(obj) || obj[i] != '{' {
+		return res
+	}
+	for i++; i < len(obj); i++ {
+		if obj[i] <= ' ' || obj[i] == ',' {
+			continue
+		}
+		if obj[i] != '"' {
+			// end of the object, or invalid json
+			break
+		}
+		kend := stringEnd(obj, i)
+		if kend < i+2 || obj[kend-1] != '"' {
+			// unterminated key
+			break
+		}
+		match := keyEqual(obj[i+1:kend-1], key)
+		for i = kend; i < len(obj) && (obj[i] <= ' ' || obj[i] == ':'); i++ {
+		}
+		if i == len(obj) {
+			break
+		}
+		vend := valueEnd(obj, i)
+		if match {
+			res = gjson.Parse(obj[i:vend])
+			res.Index = i
+			if first {
+				break
+			}
+		}
+		i = vend - 1
+	}
+	return res
+}
+
+// keyEqual returns true if the raw object key, which is the json string
+// without the quotes, is equal to key once the escapes are decoded.
+func keyEqual(raw, key string) bool {
+	if raw == key {
+		return true
+	}
+	// an escape is never shorter than the character it stands for, and
+	// the bytes before the first escape must match as is
+	i := strings.IndexByte(raw, '\\')
+	if i < 0 || len(raw) < len(key) || raw[:i] != key[:min(i, len(key))] {
+		return false
+	}
+	return gjson.Parse(`"`+raw+`"`).Str == key
+}
+
+// stringEnd returns the index after the json string that starts at i.
+func stringEnd(json string, i int) int {
+	for i++; i < len(json); i++ {
+		if json[i] == '\\' {
+			i++
+		} else if json[i] == '"' {
+			return i + 1
+		}
+	}
+	return len(json)
+}
+
+// valueEnd returns the index after the json value that starts at i.
+func valueEnd(json string, i int) int {
+	switch json[i] {
+	case '"':
+		return stringEnd(json, i)
+	case '{', '[':
+		var depth int
+		for ; i < len(json); i++ {
+			switch json[i] {
+			case '"':
+				i = stringEnd(json, i) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
 			}
 		}
+		return len(json)
 	}
-	if !found {
-		res = gjson.Get(jstr, paths[0].gpart)
+	for ; i < len(json); i++ {
+		switch json[i] {
+		case ' ', '\t', '\r', '\n', ',', '}', ']':
+			return i
+		}
+	}
+	return len(json)
+}
+
+// orderedKeyIndex returns the index of the first key in the object that
+// sorts after the key, or zero if there is no such key.
+func orderedKeyIndex(obj, key string) int {
+	var index int
+	gjson.Parse(obj).ForEach(func(k, _ gjson.Result) bool {
+		if k.Str > key {
+			index = k.Index
+		}
+		return index == 0
+	})
+	return index
+}
+
+func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
+	stringify, del bool, st *setState) ([]byte, error) {
+	if st.canceled() {
+		return nil, st.ctx.Err()
 	}
+	var err error
+	res := st.lookup(jstr, paths[0], del)
 	if res.Index > 0 {
 		if len(paths) > 1 {
 			buf = append(buf, jstr[:res.Index]...)
 			buf, err = appendRawPaths(buf, res.Raw, paths[1:], raw,
-				stringify, del)
+				stringify, del, st)
 			if err != nil {
 				return nil, err
 			}
@@ -278,7 +858,11 @@ func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
 		}
 		buf = append(buf, jstr[:res.Index]...)
 		var exidx int // additional forward stripping
-		if del {
+		if del && st.opts != nil && st.opts.DeleteArrayReplacement != "" &&
+			gjson.Parse(jstr).IsArray() {
+			// leave a tombstone in place of the array element
+			buf = st.appendValue(buf, st.opts.DeleteArrayReplacement, false)
+		} else if del {
 			var delNextComma bool
 			buf, delNextComma = deleteTailItem(buf)
 			if delNextComma {
@@ -294,11 +878,10 @@ func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
 				}
 			}
 		} else {
-			if stringify {
-				buf = appendStringify(buf, raw)
-			} else {
-				buf = append(buf, raw...)
+			if err := st.checkType(res.Raw, raw, stringify); err != nil {
+				return nil, err
 			}
+			buf = st.appendValue(buf, raw, stringify)
 		}
 		buf = append(buf, jstr[res.Index+len(res.Raw)+exidx:]...)
 		return buf, nil
@@ -306,6 +889,14 @@ func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
 	if del {
 		return nil, errNoChange
 	}
+	if st.opts != nil && st.opts.NoArrayGrowth {
+		// the rest of the path is new, so a numeric key is a new array
+		for _, r := range paths[1:] {
+			if n, ok := atoui(r); ok {
+				return nil, errArrayGrowth(n)
+			}
+		}
+	}
 	n, numeric := atoui(paths[0])
 	isempty := true
 	for i := 0; i < len(jstr); i++ {
@@ -345,19 +936,56 @@ func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
 	default:
 		return nil, &errorType{"json must be an object or array"}
 	case '{':
+		start := len(buf)
 		end := len(jsres.Raw) - 1
 		for ; end > 0; end-- {
 			if jsres.Raw[end] == '}' {
 				break
 			}
 		}
+		if comma && st.opts != nil && st.opts.PreserveOrder {
+			if i := orderedKeyIndex(jsres.Raw, paths[0].part); i > 0 {
+				// insert before the key, copying the whitespace before it
+				ws := i
+				for ws > 0 && jsres.Raw[ws-1] <= ' ' {
+					ws--
+				}
+				buf = append(buf, jsres.Raw[:i]...)
+				mark := len(buf)
+				buf = appendBuild(buf, false, paths, raw, stringify, st)
+				if st.indent != "" {
+					base := strings.TrimSuffix(lineIndent(buf[:mark]),
+						st.indent)
+					buf = st.formatMember(buf, mark, base, false)
+				}
+				buf = append(buf, ',')
+				buf = append(buf, jsres.Raw[ws:]...)
+				return st.sortObject(buf, start), nil
+			}
+		}
+		if st.indent != "" {
+			base := lineIndent(buf)
+			buf = append(buf, strings.TrimRight(jsres.Raw[:end], " \t\r\n")...)
+			if comma {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, '\n')
+			buf = append(buf, base+st.indent...)
+			mark := len(buf)
+			buf = appendBuild(buf, false, paths, raw, stringify, st)
+			buf = st.formatMember(buf, mark, base, false)
+			buf = append(buf, '\n')
+			buf = append(buf, base...)
+			buf = append(buf, jsres.Raw[end:]...)
+			return st.sortObject(buf, start), nil
+		}
 		buf = append(buf, jsres.Raw[:end]...)
 		if comma {
 			buf = append(buf, ',')
 		}
-		buf = appendBuild(buf, false, paths, raw, stringify)
+		buf = appendBuild(buf, false, paths, raw, stringify, st)
 		buf = append(buf, '}')
-		return buf, nil
+		return st.sortObject(buf, start), nil
 	case '[':
 		var appendit bool
 		if !numeric {
@@ -369,6 +997,51 @@ func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
 						paths[0].part + "'"}
 			}
 		}
+		if appendit && len(paths) == 1 && st.opts != nil &&
+			st.opts.AppendUnique && hasElement(jsres, raw, stringify) {
+			return nil, errNoChange
+		}
+		if !appendit && st.opts != nil && st.opts.NoArrayGrowth {
+			return nil, errArrayGrowth(n)
+		}
+		if st.indent != "" {
+			base := lineIndent(buf)
+			end := strings.LastIndexByte(jsres.Raw, ']')
+			if end < 0 {
+				end = len(jsres.Raw)
+			}
+			buf = append(buf, strings.TrimRight(jsres.Raw[:end], " \t\r\n")...)
+			var pad int
+			if !appendit {
+				pad = n - len(jsres.Array())
+			}
+			for ; pad > 0; pad-- {
+				if comma {
+					buf = append(buf, ',')
+				}
+				buf = append(buf, '\n')
+				buf = append(buf, base+st.indent...)
+				buf = st.appendPadding(buf, 1, false)
+				buf = buf[:len(buf)-1] // padding is followed by a comma
+				comma = true
+			}
+			if comma {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, '\n')
+			buf = append(buf, base+st.indent...)
+			mark := len(buf)
+			buf = appendBuild(buf, true, paths, raw, stringify, st)
+			buf = st.formatMember(buf, mark, base, true)
+			buf = append(buf, '\n')
+			buf = append(buf, base...)
+			if end < len(jsres.Raw) {
+				buf = append(buf, jsres.Raw[end:]...)
+			} else {
+				buf = append(buf, ']')
+			}
+			return buf, nil
+		}
 		if appendit {
 			njson := trim(jsres.Raw)
 			if njson[len(njson)-1] == ']' {
@@ -379,7 +1052,7 @@ func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
 				buf = append(buf, ',')
 			}
 
-			buf = appendBuild(buf, true, paths, raw, stringify)
+			buf = appendBuild(buf, true, paths, raw, stringify, st)
 			buf = append(buf, ']')
 			return buf, nil
 		}
@@ -392,19 +1065,181 @@ func appendRawPaths(buf []byte, jstr string, paths []pathResult, raw string,
 			buf = append(buf, ress[i].Raw...)
 		}
 		if len(ress) == 0 {
-			buf = appendRepeat(buf, "null,", n-len(ress))
+			buf = st.appendPadding(buf, n-len(ress), false)
 		} else {
-			buf = appendRepeat(buf, ",null", n-len(ress))
+			buf = st.appendPadding(buf, n-len(ress), true)
 			if comma {
 				buf = append(buf, ',')
 			}
 		}
-		buf = appendBuild(buf, true, paths, raw, stringify)
+		buf = appendBuild(buf, true, paths, raw, stringify, st)
 		buf = append(buf, ']')
 		return buf, nil
 	}
 }
 
+// lookup returns the existing value in jstr for the path component, which
+// is found when the Index is greater than zero.
+func (st *setState) lookup(jstr string, r pathResult, del bool) gjson.Result {
+	if del && r.part == "-1" && !r.force {
+		res := gjson.Get(jstr, "#")
+		if res.Int() > 0 {
+			return gjson.Get(jstr, strconv.FormatInt(res.Int()-1, 10))
+		}
+	}
+	if st.opts != nil && st.opts.CaseInsensitiveKeys {
+		if res := getKeyFold(jstr, r.part); res.Exists() {
+			return res
+		}
+	}
+	if isObjectJSON(jstr) {
+		return getKey(jstr, r.part, st.opts != nil && st.opts.EditFirstDuplicate)
+	}
+	return gjson.Get(jstr, r.gpart)
+}
+
+// isObjectJSON returns true if the first token of the json is '{'.
+func isObjectJSON(json string) bool {
+	for i := 0; i < len(json); i++ {
+		if json[i] > ' ' {
+			return json[i] == '{'
+		}
+	}
+	return false
+}
+
+// setRoot replaces the whole json document with the value.
+func setRoot(jstr, raw string, stringify bool, st *setState) ([]byte, error) {
+	if !stringify && !gjson.Valid(raw) {
+		return []byte(jstr), &errorType{"invalid json for the document root"}
+	}
+	if trim(jstr) != "" {
+		if err := st.checkType(jstr, raw, stringify); err != nil {
+			return []byte(jstr), err
+		}
+	}
+	return st.appendValue(st.takeBuf(), raw, stringify), nil
+}
+
+// sortObject sorts the keys of the object at buf[start:] for
+// Options.SortKeys. The whitespace in front of each key stays with the key,
+// and a key without any, such as a new one, gets the whitespace of the other
+// keys. The whitespace before the closing brace stays in place, and the
+// location of the written value is updated to match.
+func (st *setState) sortObject(buf []byte, start int) []byte {
+	if st.opts == nil || !st.opts.SortKeys {
+		return buf
+	}
+	type member struct {
+		key        string
+		lead       string // whitespace in front of the key
+		start, end int
+	}
+	obj := string(buf[start:])
+	var members []member
+	var lead, closing string
+	var pos int // end of the last member, including its trailing whitespace
+	gjson.Parse(obj).ForEach(func(key, value gjson.Result) bool {
+		i := key.Index
+		for i > 0 && obj[i-1] <= ' ' {
+			i--
+		}
+		m := member{key.Str, obj[i:key.Index], key.Index,
+			value.Index + len(value.Raw)}
+		if lead == "" {
+			lead = m.lead
+		}
+		for pos = m.end; pos < len(obj) && obj[pos] <= ' '; pos++ {
+		}
+		if pos > m.end {
+			// whitespace after a value, which belongs before the brace
+			closing = obj[m.end:pos]
+		}
+		members = append(members, m)
+		return true
+	})
+	less := func(i, j int) bool { return members[i].key < members[j].key }
+	if sort.SliceIsSorted(members, less) {
+		return buf
+	}
+	sort.SliceStable(members, less)
+	index := st.index - start
+	buf = append(buf[:start], obj[0])
+	for i, m := range members {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if m.lead == "" {
+			m.lead = lead
+		}
+		buf = append(buf, m.lead...)
+		if index >= m.start && index < m.end {
+			st.index = len(buf) + index - m.start
+			st.end = st.index + st.end - start - index
+		}
+		buf = append(buf, obj[m.start:m.end]...)
+	}
+	buf = append(buf, closing...)
+	return append(buf, obj[pos:]...)
+}
+
+// setEmbedded edits the json document that is embedded as a string at the
+// outer path, for the '@json' path component, and writes the edited
+// document back as a string.
+func setEmbedded(jstr, outer, inner, raw string, stringify, del bool,
+	st *setState) ([]byte, error) {
+	if outer == "" {
+		return []byte(jstr), newPathError(outer, 0,
+			"@json must follow the path of a string")
+	}
+	res := gjson.Get(jstr, gjsonPath(outer))
+	if !res.Exists() {
+		if del {
+			return []byte(jstr), errNoChange
+		}
+		return []byte(jstr), &errorType{"path '" + outer + "' does not exist"}
+	}
+	if res.Type != gjson.String || !gjson.Valid(res.Str) {
+		return []byte(jstr), &errorType{"value at '" + outer +
+			"' is not a string of valid json"}
+	}
+	var nopts Options
+	if st.opts != nil {
+		nopts = *st.opts
+		nopts.SkipPrefixBytes = 0
+		nopts.ReplaceInPlace = false
+	}
+	doc, err := set(res.Str, inner, raw, stringify, del, newSetState(&nopts))
+	if err != nil {
+		return []byte(jstr), err
+	}
+	return set(jstr, outer, string(doc), true, false, st)
+}
+
+// errArrayGrowth is returned for Options.NoArrayGrowth.
+func errArrayGrowth(n int) error {
+	return &errorType{"array index " + strconv.Itoa(n) + " is out of range"}
+}
+
+// hasElement returns true if the array has an element that is equal to the
+// value, using the Canonical form of both.
+func hasElement(arr gjson.Result, raw string, stringify bool) bool {
+	if stringify {
+		raw = string(appendStringify(nil, raw))
+	}
+	canon, err := Canonical(raw)
+	if err != nil {
+		return false
+	}
+	var found bool
+	arr.ForEach(func(_, elem gjson.Result) bool {
+		ecanon, err := Canonical(elem.Raw)
+		found = err == nil && ecanon == canon
+		return !found
+	})
+	return found
+}
+
 func isOptimisticPath(path string) bool {
 	for i := 0; i < len(path); i++ {
 		if path[i] < '.' || path[i] > 'z' {
@@ -420,11 +1255,35 @@ func isOptimisticPath(path string) bool {
 	return true
 }
 
+// existingValue returns the existing value for a simple path, if the value
+// can be replaced without looking at the rest of the document. The Index
+// of the value is relative to jstr.
+func (st *setState) existingValue(jstr, path string) (gjson.Result, bool) {
+	if !isOptimisticPath(path) {
+		return gjson.Result{}, false
+	}
+	var res gjson.Result
+	var base int
+	r := pathResult{path: path, more: true}
+	for r.more {
+		r, _ = parsePath(r.path)
+		res = st.lookup(jstr[base:], r, false)
+		if res.Index <= 0 {
+			return gjson.Result{}, false
+		}
+		base += res.Index
+		jstr = jstr[:base+len(res.Raw)]
+	}
+	res.Index = base
+	return res, true
+}
+
 // Set sets a json value for the specified path.
 // A path is in dot syntax, such as "name.last" or "age".
 // This function expects that the json is well-formed, and does not validate.
 // Invalid json will not panic, but it may return back unexpected results.
 // An error is returned if the path is not valid.
+// An empty path replaces the whole document with the value.
 //
 // A path is a series of keys separated by a dot.
 //
@@ -454,6 +1313,9 @@ func SetBytes(json []byte, path string, value interface{}) ([]byte, error) {
 // SetRaw sets a raw json value for the specified path.
 // This function works the same as Set except that the value is set as a
 // raw block of json. This allows for setting premarshalled json objects.
+// SetRaw(json, path, "null") is the same as Set(json, path, nil). An empty
+// value returns ErrEmptyRaw. With an empty path the value replaces the whole
+// document, and an error is returned if the value isn't valid json.
 func SetRaw(json, path, value string) (string, error) {
 	return SetRawOptions(json, path, value, nil)
 }
@@ -462,14 +1324,19 @@ func SetRaw(json, path, value string) (string, error) {
 // This furnction works the same as SetOptions except that the value is set
 // as a raw block of json. This allows for setting premarshalled json objects.
 func SetRawOptions(json, path, value string, opts *Options) (string, error) {
-	var optimistic bool
-	if opts != nil {
-		optimistic = opts.Optimistic
-	}
-	res, err := set(json, path, value, false, false, optimistic, false)
-	if err == errNoChange {
-		return json, nil
+	if opts != nil && opts.ReplaceInPlace {
+		// it's not safe to replace bytes in-place for strings
+		nopts := *opts
+		opts = &nopts
+		opts.ReplaceInPlace = false
 	}
+	jsonh := *(*stringHeader)(unsafe.Pointer(&json))
+	jsonbh := sliceHeader{data: jsonh.data, len: jsonh.len, cap: jsonh.len}
+	jsonb := *(*[]byte)(unsafe.Pointer(&jsonbh))
+	valueh := *(*stringHeader)(unsafe.Pointer(&value))
+	valuebh := sliceHeader{data: valueh.data, len: valueh.len, cap: valueh.len}
+	valueb := *(*[]byte)(unsafe.Pointer(&valuebh))
+	res, err := SetRawBytesOptions(jsonb, path, valueb, opts)
 	return string(res), err
 }
 
@@ -480,16 +1347,135 @@ func SetRawBytes(json []byte, path string, value []byte) ([]byte, error) {
 	return SetRawBytesOptions(json, path, value, nil)
 }
 
-type dtype struct{}
-
-// Delete deletes a value from json for the specified path.
-func Delete(json, path string) (string, error) {
-	return Set(json, path, dtype{})
+// SetRawOrString sets the value for the specified path as raw json when
+// the value is valid json, as reported by gjson.Valid, otherwise the value
+// is set as a string. This means that bare numbers, booleans, and null are
+// set raw, so "1" becomes a number and "hello" becomes a string.
+//
+//	`{"a":1}`  >> {"a":1}
+//	`hello`    >> "hello"
+//	`"hello"`  >> "hello"
+func SetRawOrString(json, path, value string) (string, error) {
+	if gjson.Valid(value) {
+		return SetRaw(json, path, value)
+	}
+	return Set(json, path, value)
 }
 
-// DeleteBytes deletes a value from json for the specified path.
-func DeleteBytes(json []byte, path string) ([]byte, error) {
-	return SetBytes(json, path, dtype{})
+// SetTime sets a time.Time value for the specified path as an RFC 3339
+// string, such as "2006-01-02T15:04:05.999999999Z07:00". Use SetOptions
+// with Options.TimeLayout for other layouts.
+func SetTime(json, path string, t time.Time) (string, error) {
+	return Set(json, path, t)
+}
+
+// SetTimeBytes sets a time.Time value for the specified path.
+// If working with bytes, this method preferred over
+// SetTime(string(data), path, t)
+func SetTimeBytes(json []byte, path string, t time.Time) ([]byte, error) {
+	return SetBytes(json, path, t)
+}
+
+// SetBase64 sets the data for the specified path as a string with the
+// standard base64 encoding, which is the same as encoding/json. This is
+// different from passing a []byte to Set, which sets the bytes as a raw
+// block of json.
+func SetBase64(json, path string, data []byte) (string, error) {
+	return Set(json, path, base64.StdEncoding.EncodeToString(data))
+}
+
+// SetBase64Bytes sets the data for the specified path as a base64 string.
+// If working with bytes, this method preferred over
+// SetBase64(string(json), path, data)
+func SetBase64Bytes(json []byte, path string, data []byte) ([]byte, error) {
+	return SetBytes(json, path, base64.StdEncoding.EncodeToString(data))
+}
+
+// SetFloat sets a float value for the specified path.
+// An error is returned for NaN and infinite values.
+func SetFloat(json, path string, value float64) (string, error) {
+	return SetOptions(json, path, value, nil)
+}
+
+// SetFloatOptions sets a float value for the specified path with options.
+func SetFloatOptions(json, path string, value float64,
+	opts *Options) (string, error) {
+	return SetOptions(json, path, value, opts)
+}
+
+// SetFloatPrecision sets a float value for the specified path, written with
+// exactly prec digits after the decimal point, such as 0.33 for 1.0/3.0 with
+// a prec of 2. A prec of zero writes the value rounded to an integer.
+// An error is returned for NaN and infinite values.
+func SetFloatPrecision(json, path string, value float64,
+	prec int) (string, error) {
+	if prec < 0 {
+		return json, &errorType{"precision cannot be negative"}
+	}
+	if _, err := encodeFloat(value, nil); err != nil {
+		return json, err
+	}
+	return SetRaw(json, path, strconv.FormatFloat(value, 'f', prec, 64))
+}
+
+// SetSlice sets the values as a json array for the specified path. Each
+// element is encoded the same way as a value passed to Set.
+func SetSlice[T any](json, path string, values []T) (string, error) {
+	return SetOptions(json, path, values, nil)
+}
+
+// MustSet is like Set but panics if the value cannot be set. It's intended
+// for tests and scripts where an error is not expected.
+func MustSet(json, path string, value interface{}) string {
+	res, err := Set(json, path, value)
+	if err != nil {
+		panic("sjson: Set(" + strconv.Quote(path) + "): " + err.Error())
+	}
+	return res
+}
+
+// MustSetRaw is like SetRaw but panics if the value cannot be set.
+func MustSetRaw(json, path, value string) string {
+	res, err := SetRaw(json, path, value)
+	if err != nil {
+		panic("sjson: SetRaw(" + strconv.Quote(path) + "): " + err.Error())
+	}
+	return res
+}
+
+// MustDelete is like Delete but panics if the value cannot be deleted.
+func MustDelete(json, path string) string {
+	res, err := Delete(json, path)
+	if err != nil {
+		panic("sjson: Delete(" + strconv.Quote(path) + "): " + err.Error())
+	}
+	return res
+}
+
+type dtype struct{}
+
+// Delete deletes a value from json for the specified path.
+// When an object has a duplicate key, the last occurrence is deleted.
+func Delete(json, path string) (string, error) {
+	return Set(json, path, dtype{})
+}
+
+// DeleteBytes deletes a value from json for the specified path.
+func DeleteBytes(json []byte, path string) ([]byte, error) {
+	return SetBytes(json, path, dtype{})
+}
+
+// DeleteOptions deletes a value from json for the specified path with
+// options.
+func DeleteOptions(json, path string, opts *Options) (string, error) {
+	return SetOptions(json, path, dtype{}, opts)
+}
+
+// DeleteBytesOptions deletes a value from json for the specified path with
+// options.
+func DeleteBytesOptions(json []byte, path string, opts *Options) ([]byte,
+	error) {
+	return SetBytesOptions(json, path, dtype{}, opts)
 }
 
 type stringHeader struct {
@@ -504,13 +1490,63 @@ type sliceHeader struct {
 }
 
 func set(jstr, path, raw string,
-	stringify, del, optimistic, inplace bool) ([]byte, error) {
+	stringify, del bool, st *setState) ([]byte, error) {
+	if path == "" && del {
+		return []byte(jstr), newPathError(path, 0, "path cannot be empty")
+	}
+	if st.canceled() {
+		return []byte(jstr), st.ctx.Err()
+	}
+	if n := skipPrefix(jstr, st.opts); n > 0 {
+		// edit the document without the prefix, then copy the prefix back
+		nopts := *st.opts
+		nopts.SkipPrefixBytes = 0
+		nopts.ReplaceInPlace = false
+		nst := newSetState(&nopts)
+		res, err := set(jstr[n:], path, raw, stringify, del, nst)
+		if err != nil {
+			return []byte(jstr), err
+		}
+		if nst.index >= 0 {
+			st.index, st.end = nst.index+n, nst.end+n
+		}
+		buf := make([]byte, 0, n+len(res))
+		buf = append(buf, jstr[:n]...)
+		return append(buf, res...), nil
+	}
+	if st.opts != nil && st.opts.ValidateInput && trim(jstr) != "" &&
+		!gjson.Valid(jstr) {
+		return []byte(jstr), ErrInvalidInput
+	}
 	if path == "" {
-		return []byte(jstr), &errorType{"path cannot be empty"}
+		return setRoot(jstr, raw, stringify, st)
+	}
+	if strings.Contains(path, "@json") {
+		comps, err := splitComponents(path)
+		if err != nil {
+			return []byte(jstr), err
+		}
+		for i, comp := range comps {
+			if comp == "@json" {
+				return setEmbedded(jstr, strings.Join(comps[:i], "."),
+					strings.Join(comps[i+1:], "."), raw, stringify, del, st)
+			}
+		}
+	}
+	if st.opts != nil && st.opts.KeepFormatting && st.indent == "" {
+		st.indent = detectIndent([]byte(jstr))
+	}
+	var optimistic, inplace, forceKeys bool
+	if opts := st.opts; opts != nil {
+		optimistic = opts.Optimistic && !opts.CaseInsensitiveKeys
+		inplace = opts.ReplaceInPlace
+		forceKeys = opts.ForceObjectKeys
 	}
-	if !del && optimistic && isOptimisticPath(path) {
-		res := gjson.Get(jstr, path)
-		if res.Exists() && res.Index > 0 {
+	if !del && optimistic {
+		if res, ok := st.existingValue(jstr, path); ok {
+			if err := st.checkType(res.Raw, raw, stringify); err != nil {
+				return []byte(jstr), err
+			}
 			sz := len(jstr) - len(res.Raw) + len(raw)
 			if stringify {
 				sz += 2
@@ -521,7 +1557,10 @@ func set(jstr, path, raw string,
 					jsonbh := sliceHeader{
 						data: jsonh.data, len: jsonh.len, cap: jsonh.len}
 					jbytes := *(*[]byte)(unsafe.Pointer(&jsonbh))
-					if stringify {
+					if sz == len(jstr) && !stringify {
+						// same size, so only the value needs to be written
+						copy(jbytes[res.Index:], raw)
+					} else if stringify {
 						jbytes[res.Index] = '"'
 						copy(jbytes[res.Index+1:], []byte(raw))
 						jbytes[res.Index+1+len(raw)] = '"'
@@ -532,52 +1571,89 @@ func set(jstr, path, raw string,
 						copy(jbytes[res.Index+len(raw):],
 							jbytes[res.Index+len(res.Raw):])
 					}
+					st.index, st.end = res.Index, res.Index+sz-len(jstr)+len(res.Raw)
 					return jbytes[:sz], nil
 				}
 				return []byte(jstr), nil
 			}
-			buf := make([]byte, 0, sz)
-			buf = append(buf, jstr[:res.Index]...)
-			if stringify {
-				buf = appendStringify(buf, raw)
-			} else {
-				buf = append(buf, raw...)
+			buf := st.takeBuf()
+			if cap(buf) < sz {
+				buf = make([]byte, 0, sz)
 			}
+			buf = append(buf, jstr[:res.Index]...)
+			buf = st.appendValue(buf, raw, stringify)
 			buf = append(buf, jstr[res.Index+len(res.Raw):]...)
 			return buf, nil
 		}
 	}
-	var paths []pathResult
-	r, simple := parsePath(path)
-	if simple {
-		paths = append(paths, r)
-		for r.more {
-			r, simple = parsePath(r.path)
-			if !simple {
-				break
-			}
-			paths = append(paths, r)
-		}
+	paths, simple := st.paths, true
+	if paths == nil {
+		paths, simple = compilePath(path, forceKeys)
 	}
 	if !simple {
-		return setComplexPath(jstr, path, raw, stringify, del)
+		return setComplexPath(jstr, path, raw, stringify, del, st)
 	}
-	njson, err := appendRawPaths(nil, jstr, paths, raw, stringify, del)
+	njson, err := appendRawPaths(st.takeBuf(), jstr, paths, raw, stringify,
+		del, st)
 	if err != nil {
 		return []byte(jstr), err
 	}
 	return njson, nil
 }
 
-func setComplexPath(jstr, path, raw string, stringify, del bool) ([]byte, error) {
+// compilePath parses every component of a simple path. Returns false if the
+// path has wildcards, queries, or modifiers.
+func compilePath(path string, forceKeys bool) ([]pathResult, bool) {
+	var paths []pathResult
+	r := pathResult{path: path, more: true}
+	for r.more {
+		var simple bool
+		r, simple = parsePath(r.path)
+		if !simple {
+			return nil, false
+		}
+		r.force = r.force || forceKeys
+		paths = append(paths, r)
+	}
+	return paths, true
+}
+
+func setComplexPath(jstr, path, raw string, stringify, del bool,
+	st *setState) ([]byte, error) {
+	if !strings.Contains(path, "@") {
+		if _, err := splitComponents(path); err != nil {
+			return []byte(jstr), err
+		}
+	}
+	if comps, ok := queryComponents(path); ok {
+		return setQueryPath(jstr, path, comps, raw, stringify, del, st)
+	}
 	res := gjson.Get(jstr, path)
+	if st.expired() {
+		return []byte(jstr), st.expiredErr()
+	}
 	if !res.Exists() {
+		if !del && st.opts != nil && st.opts.CreateOnFilterMiss {
+			return createOnFilterMiss(jstr, path, raw, stringify, st)
+		}
 		return []byte(jstr), errNoChange
 	}
+	if st.opts != nil && st.opts.RequireSingleTarget {
+		n := len(res.Indexes)
+		if n == 0 && countSimpleWildcards(path) > 0 {
+			if paths, err := expandPath(jstr, path); err == nil {
+				n = len(paths)
+			}
+		}
+		if n > 1 {
+			return []byte(jstr), &errorType{"path '" + path + "' resolves to " +
+				strconv.Itoa(n) + " values"}
+		}
+	}
 
 	// Handle nested wildcards by processing each level separately
 	if countSimpleWildcards(path) > 1 || (res.Index == 0 && len(res.Indexes) == 0 && countSimpleWildcards(path) == 1) {
-		return setNestedWildcards(jstr, path, raw, stringify, del)
+		return setNestedWildcards(jstr, path, raw, stringify, del, st)
 	}
 
 	if res.Index != 0 && len(res.Indexes) == 0 {
@@ -590,6 +1666,9 @@ func setComplexPath(jstr, path, raw string, stringify, del bool) ([]byte, error)
 			}
 			return []byte(result), nil
 		} else {
+			if err := st.checkType(res.Raw, raw, stringify); err != nil {
+				return []byte(jstr), err
+			}
 			njson := []byte(jstr[:res.Index])
 			if stringify {
 				njson = appendStringify(njson, raw)
@@ -657,6 +1736,12 @@ func setComplexPath(jstr, path, raw string, stringify, del bool) ([]byte, error)
 			sort.SliceStable(vals, func(i, j int) bool {
 				return vals[i].index > vals[j].index
 			})
+			for _, val := range vals {
+				err := st.checkType(val.res.Raw, raw, stringify)
+				if err != nil {
+					return []byte(jstr), err
+				}
+			}
 			for _, val := range vals {
 				vres := val.res
 				index := val.index
@@ -674,6 +1759,257 @@ func setComplexPath(jstr, path, raw string, stringify, del bool) ([]byte, error)
 	return []byte(jstr), nil
 }
 
+// queryComponents returns the components of the path, if the path has a
+// '#(...)' query or a glob key, and no modifiers or pipes.
+func queryComponents(path string) ([]string, bool) {
+	if !strings.Contains(path, "#(") && !strings.ContainsAny(path, "*?") {
+		return nil, false
+	}
+	comps, err := splitComponents(path)
+	if err != nil {
+		return nil, false
+	}
+	var query bool
+	for _, comp := range comps {
+		if strings.HasPrefix(comp, "#(") || isGlobComponent(comp) {
+			query = true
+		} else if strings.HasPrefix(comp, "@") || strings.Contains(comp, "|") {
+			return nil, false
+		}
+	}
+	return comps, query
+}
+
+// isGlobComponent returns true if the path component is an object key with
+// an unescaped '*' or '?' wildcard character.
+func isGlobComponent(comp string) bool {
+	if strings.HasPrefix(comp, "#(") || strings.HasPrefix(comp, "@") {
+		return false
+	}
+	for i := 0; i < len(comp); i++ {
+		switch comp[i] {
+		case '\\':
+			i++
+		case '|':
+			return false
+		case '*', '?':
+			return true
+		}
+	}
+	return false
+}
+
+// expandQueries resolves every '#' wildcard, '#(...)' query, and glob key
+// of the path components against the json, and returns the concrete paths
+// in document order. Elements are matched by gjson itself, so the selection
+// is always the same as reading the path with gjson. A glob key matches
+// every key of an object, rather than only the first like gjson, and keys
+// with scalar values are skipped unless the glob is the last component.
+// A query with a '-' suffix, such as '#(a==1)-', matches the last element.
+func expandQueries(paths []string, json, prefix string,
+	comps []string) []string {
+	for i, comp := range comps {
+		if isGlobComponent(comp) {
+			obj := gjson.Parse(json)
+			if prefix != "" {
+				obj = gjson.Get(json, gjsonPath(prefix))
+			}
+			if !obj.IsObject() {
+				return paths
+			}
+			obj.ForEach(func(key, value gjson.Result) bool {
+				if i < len(comps)-1 && !value.IsObject() && !value.IsArray() {
+					// a scalar cannot have children
+					return true
+				}
+				if match.Match(key.Str, comp) {
+					paths = expandQueries(paths, json,
+						joinPath(prefix, PathForKeys(key.Str)), comps[i+1:])
+				}
+				return true
+			})
+			return paths
+		}
+		if comp != "#" && !strings.HasPrefix(comp, "#(") {
+			prefix = joinPath(prefix, comp)
+			continue
+		}
+		arr := gjson.Parse(json)
+		if prefix != "" {
+			arr = gjson.Get(json, gjsonPath(prefix))
+		}
+		if !arr.IsArray() {
+			return paths
+		}
+		all := comp == "#" || strings.HasSuffix(comp, ")#")
+		last := strings.HasSuffix(comp, ")-")
+		query := strings.TrimSuffix(strings.TrimSuffix(comp, "#"), "-")
+		idx, lastIdx := 0, -1
+		arr.ForEach(func(_, elem gjson.Result) bool {
+			match := comp == "#" ||
+				matchPredicate(elem, query[2:len(query)-1])
+			if match && last {
+				lastIdx = idx
+			} else if match {
+				paths = expandQueries(paths, json,
+					joinPath(prefix, strconv.Itoa(idx)), comps[i+1:])
+			}
+			idx++
+			return all || last || !match
+		})
+		if lastIdx >= 0 {
+			paths = expandQueries(paths, json,
+				joinPath(prefix, strconv.Itoa(lastIdx)), comps[i+1:])
+		}
+		return paths
+	}
+	return append(paths, prefix)
+}
+
+// expandPath splits the path into components and resolves them with
+// expandQueries. A path without wildcards, queries, or glob keys resolves
+// to itself.
+func expandPath(json, path string) ([]string, error) {
+	comps, err := splitComponents(path)
+	if err != nil {
+		return nil, err
+	}
+	return expandQueries(nil, json, "", comps), nil
+}
+
+// setQueryPath sets the value for each of the concrete paths that a path
+// with queries resolves to.
+func setQueryPath(jstr, path string, comps []string, raw string,
+	stringify, del bool, st *setState) ([]byte, error) {
+	paths := expandQueries(nil, jstr, "", comps)
+	if len(paths) == 0 {
+		if !del && st.opts != nil && st.opts.CreateOnFilterMiss {
+			return createOnFilterMiss(jstr, path, raw, stringify, st)
+		}
+		return []byte(jstr), errNoChange
+	}
+	if st.opts != nil && st.opts.RequireSingleTarget && len(paths) > 1 {
+		return []byte(jstr), &errorType{"path '" + path + "' resolves to " +
+			strconv.Itoa(len(paths)) + " values"}
+	}
+	if del {
+		// delete from the last path so that earlier array indexes remain
+		for i, j := 0, len(paths)-1; i < j; i, j = i+1, j-1 {
+			paths[i], paths[j] = paths[j], paths[i]
+		}
+	}
+	res := []byte(jstr)
+	for _, p := range paths {
+		if st.expired() {
+			return []byte(jstr), st.expiredErr()
+		}
+		nres, err := set(string(res), p, raw, stringify, del, st)
+		if err == errNoChange {
+			continue
+		}
+		if err != nil {
+			return []byte(jstr), err
+		}
+		res = nres
+	}
+	if len(paths) > 1 {
+		st.index = -1
+	}
+	return res, nil
+}
+
+// parseEqualityQuery returns the key and raw value of a '#(key=value)' or
+// '#(key==value)' query component.
+func parseEqualityQuery(comp string) (key, value string, ok bool) {
+	q := strings.TrimSuffix(comp, "#")
+	if !strings.HasPrefix(q, "#(") || !strings.HasSuffix(q, ")") {
+		return "", "", false
+	}
+	q = q[2 : len(q)-1]
+	for i := 0; i < len(q); i++ {
+		switch q[i] {
+		case '\\':
+			i++
+		case '!', '<', '>', '%', '~', '#', '(', ')':
+			return "", "", false
+		case '=':
+			key, value = trim(q[:i]), trim(strings.TrimPrefix(q[i+1:], "="))
+			if key == "" || value == "" {
+				return "", "", false
+			}
+			if !gjson.Valid(value) {
+				value = string(appendStringify(nil, value))
+			}
+			return key, value, true
+		}
+	}
+	return "", "", false
+}
+
+// createOnFilterMiss creates the value for a path that has a query which
+// didn't resolve. See Options.CreateOnFilterMiss.
+func createOnFilterMiss(jstr, path, raw string, stringify bool,
+	st *setState) ([]byte, error) {
+	comps, err := splitComponents(path)
+	if err != nil {
+		return []byte(jstr), err
+	}
+	qi := -1
+	for i, comp := range comps {
+		if strings.HasPrefix(comp, "#(") {
+			qi = i
+			break
+		}
+	}
+	if qi < 0 {
+		return []byte(jstr), errNoChange
+	}
+	prefix := strings.Join(comps[:qi], ".")
+	query := comps[qi]
+	rest := strings.Join(comps[qi+1:], ".")
+	if _, _, wild := splitWildcard(prefix); wild {
+		return []byte(jstr), errNoChange
+	}
+	nopts := *st.opts
+	nopts.Optimistic = false
+	nopts.ReplaceInPlace = false
+	elem := gjson.Get(jstr, joinPath(prefix, strings.TrimSuffix(query, "#")))
+	if elem.Exists() {
+		if rest == "" || elem.Index == 0 {
+			return []byte(jstr), errNoChange
+		}
+		// the query matched, create the rest of the path in the element
+		sub, err := set(elem.Raw, rest, raw, stringify, false,
+			newSetState(&nopts))
+		if err != nil {
+			return []byte(jstr), err
+		}
+		buf := append([]byte(jstr[:elem.Index]), sub...)
+		return append(buf, jstr[elem.Index+len(elem.Raw):]...), nil
+	}
+	key, value, ok := parseEqualityQuery(query)
+	if !ok {
+		return []byte(jstr), &errorType{"cannot create an element for query '" +
+			query + "', only equality queries are supported"}
+	}
+	var nelem []byte
+	if rest == "" {
+		nelem = newSetState(nil).appendValue(nil, raw, stringify)
+	} else {
+		nelem, err = set("{}", key, value, false, false, newSetState(nil))
+		if err != nil {
+			return []byte(jstr), err
+		}
+		nelem, err = set(string(nelem), rest, raw, stringify, false,
+			newSetState(&nopts))
+		if err != nil {
+			return []byte(jstr), err
+		}
+	}
+	return set(jstr, joinPath(prefix, "-1"), string(nelem), false, false,
+		newSetState(&nopts))
+}
+
 func countSimpleWildcards(path string) int {
 	count := 0
 	for i := 0; i < len(path); i++ {
@@ -701,7 +2037,8 @@ func countSimpleWildcards(path string) int {
 	return count
 }
 
-func setNestedWildcards(jstr, path, raw string, stringify, del bool) ([]byte, error) {
+func setNestedWildcards(jstr, path, raw string, stringify, del bool,
+	st *setState) ([]byte, error) {
 	// Split the path at the first wildcard
 	parts := strings.Split(path, "#")
 	if len(parts) < 2 {
@@ -729,9 +2066,26 @@ func setNestedWildcards(jstr, path, raw string, stringify, del bool) ([]byte, er
 		remainingPath = remainingPath[1:]
 	}
 
+	// Nested edits share the deadline
+	opts := st.opts
+	if !st.deadline.IsZero() {
+		if st.expired() {
+			return []byte(jstr), st.expiredErr()
+		}
+		nopts := *st.opts
+		nopts.Timeout = time.Until(st.deadline)
+		opts = &nopts
+	}
+
 	// Process each element in the array
 	result := jstr
+	var timeout bool
+	var n int
 	arrayResult.ForEach(func(key, value gjson.Result) bool {
+		if n++; n%64 == 0 && st.expired() {
+			timeout = true
+			return false
+		}
 		// Determine the raw value to set
 		var rawVal interface{}
 		if stringify {
@@ -768,7 +2122,12 @@ func setNestedWildcards(jstr, path, raw string, stringify, del bool) ([]byte, er
 			}
 		} else {
 			// Try to set the value - this will handle both existing and new properties
-			if updated, err := SetOptions(value.Raw, remainingPath, rawVal, nil); err == nil {
+			updated, err := SetOptions(value.Raw, remainingPath, rawVal, opts)
+			if err != nil && st.expired() {
+				timeout = true
+				return false
+			}
+			if err == nil {
 				// Always update, even if the value looks the same (because we want to add new properties)
 				var updatePath string
 				if firstPart == "" {
@@ -784,119 +2143,4215 @@ func setNestedWildcards(jstr, path, raw string, stringify, del bool) ([]byte, er
 		}
 		return true
 	})
+	if timeout {
+		return []byte(jstr), st.expiredErr()
+	}
 
 	return []byte(result), nil
 }
 
-// SetOptions sets a json value for the specified path with options.
-// A path is in dot syntax, such as "name.last" or "age".
-// This function expects that the json is well-formed, and does not validate.
-// Invalid json will not panic, but it may return back unexpected results.
-// An error is returned if the path is not valid.
-func SetOptions(json, path string, value interface{},
-	opts *Options) (string, error) {
-	if opts != nil {
-		if opts.ReplaceInPlace {
-			// it's not safe to replace bytes in-place for strings
-			// copy the Options and set options.ReplaceInPlace to false.
-			nopts := *opts
-			opts = &nopts
-			opts.ReplaceInPlace = false
+// expandExponents rewrites the numbers in the json that use exponent
+// notation into plain decimal notation.
+func expandExponents(json []byte) []byte {
+	var buf []byte
+	var mark int
+	for i := 0; i < len(json); i++ {
+		switch json[i] {
+		case '"':
+			for i++; i < len(json); i++ {
+				if json[i] == '\\' {
+					i++
+				} else if json[i] == '"' {
+					break
+				}
+			}
+		case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			var exp bool
+			j := i
+			for ; j < len(json); j++ {
+				c := json[j]
+				if c == 'e' || c == 'E' {
+					exp = true
+				} else if c != '-' && c != '+' && c != '.' &&
+					(c < '0' || c > '9') {
+					break
+				}
+			}
+			if exp {
+				f, err := strconv.ParseFloat(string(json[i:j]), 64)
+				if err == nil {
+					buf = append(buf, json[mark:i]...)
+					buf = strconv.AppendFloat(buf, f, 'f', -1, 64)
+					mark = j
+				}
+			}
+			i = j - 1
 		}
 	}
-	jsonh := *(*stringHeader)(unsafe.Pointer(&json))
-	jsonbh := sliceHeader{data: jsonh.data, len: jsonh.len, cap: jsonh.len}
-	jsonb := *(*[]byte)(unsafe.Pointer(&jsonbh))
-	res, err := SetBytesOptions(jsonb, path, value, opts)
-	return string(res), err
+	if buf == nil {
+		return json
+	}
+	return append(buf, json[mark:]...)
 }
 
-// SetBytesOptions sets a json value for the specified path with options.
-// If working with bytes, this method preferred over
-// SetOptions(string(data), path, value)
-func SetBytesOptions(json []byte, path string, value interface{},
-	opts *Options) ([]byte, error) {
-	var optimistic, inplace bool
-	if opts != nil {
-		optimistic = opts.Optimistic
-		inplace = opts.ReplaceInPlace
+// integerFloats rewrites the numbers in the json that have a fraction or
+// exponent, but no fractional part, into integers.
+func integerFloats(json []byte) []byte {
+	var buf []byte
+	var mark int
+	for i := 0; i < len(json); i++ {
+		switch json[i] {
+		case '"':
+			for i++; i < len(json); i++ {
+				if json[i] == '\\' {
+					i++
+				} else if json[i] == '"' {
+					break
+				}
+			}
+		case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			j := i
+			for ; j < len(json); j++ {
+				c := json[j]
+				if c != 'e' && c != 'E' && c != '-' && c != '+' && c != '.' &&
+					(c < '0' || c > '9') {
+					break
+				}
+			}
+			if n, ok := integerForm(string(json[i:j])); ok {
+				buf = append(buf, json[mark:i]...)
+				buf = append(buf, n...)
+				mark = j
+			}
+			i = j - 1
+		}
+	}
+	if buf == nil {
+		return json
+	}
+	return append(buf, json[mark:]...)
+}
+
+// integerForm returns the integer form of a json number that has a fraction
+// or exponent, but no fractional part. The conversion is exact, and is
+// limited to integers with up to 400 digits.
+func integerForm(num string) (string, bool) {
+	var sign string
+	if len(num) > 0 && num[0] == '-' {
+		sign, num = "-", num[1:]
+	}
+	mant, exp := num, 0
+	if i := strings.IndexAny(num, "eE"); i >= 0 {
+		e, err := strconv.Atoi(num[i+1:])
+		if err != nil || e < -400 || e > 400 {
+			return "", false
+		}
+		mant, exp = num[:i], e
+	}
+	// the value is 0.digits times 10^point
+	digits, point := mant, len(mant)
+	if i := strings.IndexByte(mant, '.'); i >= 0 {
+		digits, point = mant[:i]+mant[i+1:], i
+	} else if exp == 0 {
+		return "", false // already an integer
+	}
+	point += exp
+	n := len(digits)
+	digits = strings.TrimLeft(digits, "0")
+	point -= n - len(digits)
+	digits = strings.TrimRight(digits, "0")
+	if digits == "" {
+		return "0", true
+	}
+	if point < len(digits) || point > 400 {
+		return "", false
+	}
+	return sign + digits + strings.Repeat("0", point-len(digits)), true
+}
+
+// encodeValue returns the raw json for the value. When stringify is true
+// the raw is the content of a string that has yet to be json encoded. When
+// del is true the value is a deletion.
+func encodeValue(value interface{}, opts *Options) (raw string,
+	stringify, del bool, err error) {
+	if opts != nil && opts.NumberEncoder != nil && isNumber(value) {
+		raw, err := opts.NumberEncoder(value)
+		if err != nil {
+			return "", false, false, err
+		}
+		if res := gjson.Parse(raw); res.Type != gjson.Number ||
+			res.Raw != raw || !gjson.Valid(raw) {
+			return "", false, false, &errorType{
+				"number encoder returned an invalid number '" + raw + "'"}
+		}
+		return raw, false, false, nil
 	}
-	jstr := *(*string)(unsafe.Pointer(&json))
-	var res []byte
-	var err error
 	switch v := value.(type) {
 	default:
-		b, merr := jsongo.Marshal(value)
-		if merr != nil {
-			return nil, merr
+		if raw, ok, err := encodeReflect(value, opts); ok {
+			return raw, false, false, err
 		}
-		raw := *(*string)(unsafe.Pointer(&b))
-		res, err = set(jstr, path, raw, false, false, optimistic, inplace)
+		b, err := jsongo.Marshal(value)
+		if err != nil {
+			return "", false, false, err
+		}
+		if opts != nil && opts.NoExponent {
+			b = expandExponents(b)
+		}
+		if opts != nil && opts.IntegerFloats {
+			b = integerFloats(b)
+		}
+		return *(*string)(unsafe.Pointer(&b)), false, false, nil
 	case dtype:
-		res, err = set(jstr, path, "", false, true, optimistic, inplace)
+		return "", false, true, nil
+	case jsongo.RawMessage:
+		// already encoded, so it's written as is, like SetRaw
+		if len(v) == 0 {
+			return "null", false, false, nil
+		}
+		if !gjson.ValidBytes(v) {
+			return "", false, false, &errorType{"invalid json.RawMessage"}
+		}
+		return *(*string)(unsafe.Pointer(&v)), false, false, nil
 	case string:
-		res, err = set(jstr, path, v, true, false, optimistic, inplace)
+		return v, true, false, nil
 	case []byte:
-		raw := *(*string)(unsafe.Pointer(&v))
-		res, err = set(jstr, path, raw, true, false, optimistic, inplace)
+		// raw json, the same as json.RawMessage
+		if len(v) == 0 {
+			return "null", false, false, nil
+		}
+		if !gjson.ValidBytes(v) {
+			return "", false, false, &errorType{"invalid json in []byte value"}
+		}
+		return *(*string)(unsafe.Pointer(&v)), false, false, nil
 	case bool:
 		if v {
-			res, err = set(jstr, path, "true", false, false, optimistic, inplace)
-		} else {
-			res, err = set(jstr, path, "false", false, false, optimistic, inplace)
+			return "true", false, false, nil
 		}
+		return "false", false, false, nil
 	case int8:
-		res, err = set(jstr, path, strconv.FormatInt(int64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatInt(int64(v), 10), false, false, nil
 	case int16:
-		res, err = set(jstr, path, strconv.FormatInt(int64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatInt(int64(v), 10), false, false, nil
 	case int32:
-		res, err = set(jstr, path, strconv.FormatInt(int64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatInt(int64(v), 10), false, false, nil
 	case int64:
-		res, err = set(jstr, path, strconv.FormatInt(int64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatInt(int64(v), 10), false, false, nil
 	case uint8:
-		res, err = set(jstr, path, strconv.FormatUint(uint64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatUint(uint64(v), 10), false, false, nil
 	case uint16:
-		res, err = set(jstr, path, strconv.FormatUint(uint64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatUint(uint64(v), 10), false, false, nil
 	case uint32:
-		res, err = set(jstr, path, strconv.FormatUint(uint64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatUint(uint64(v), 10), false, false, nil
 	case uint64:
-		res, err = set(jstr, path, strconv.FormatUint(uint64(v), 10),
-			false, false, optimistic, inplace)
+		return strconv.FormatUint(uint64(v), 10), false, false, nil
 	case float32:
-		res, err = set(jstr, path, strconv.FormatFloat(float64(v), 'f', -1, 64),
-			false, false, optimistic, inplace)
+		raw, err := encodeFloat(float64(v), opts)
+		return raw, false, false, err
 	case float64:
-		res, err = set(jstr, path, strconv.FormatFloat(float64(v), 'f', -1, 64),
-			false, false, optimistic, inplace)
+		raw, err := encodeFloat(v, opts)
+		return raw, false, false, err
+	case time.Time:
+		raw, stringify := encodeTime(v, opts)
+		return raw, stringify, false, nil
 	}
-	if err == errNoChange {
-		return json, nil
+}
+
+// UnixTimeLayout is a special Options.TimeLayout that writes a time.Time as
+// the number of seconds since the Unix epoch.
+const UnixTimeLayout = "unix"
+
+// encodeTime returns the raw json for the time, using Options.TimeLayout.
+func encodeTime(t time.Time, opts *Options) (raw string, stringify bool) {
+	layout := time.RFC3339Nano
+	if opts != nil && opts.TimeLayout != "" {
+		layout = opts.TimeLayout
+	}
+	if layout == UnixTimeLayout {
+		return strconv.FormatInt(t.Unix(), 10), false
 	}
-	return res, err
+	return t.Format(layout), true
 }
 
-// SetRawBytesOptions sets a raw json value for the specified path with options.
-// If working with bytes, this method preferred over
-// SetRawOptions(string(data), path, value, opts)
-func SetRawBytesOptions(json []byte, path string, value []byte,
+// encodeReflect encodes slices and arrays as json arrays, and maps as json
+// objects, using the same rules as encodeValue for each element. Map keys
+// are stringified and sorted like encoding/json. Returns false for any other
+// value, or for values that provide their own json encoding.
+func encodeReflect(value interface{}, opts *Options) (string, bool, error) {
+	switch value.(type) {
+	case jsongo.Marshaler, encoding.TextMarshaler:
+		return "", false, nil
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.IsNil() {
+			return "null", true, nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// named byte slices are raw json, the same as []byte
+			b := rv.Bytes()
+			if len(b) == 0 {
+				return "null", true, nil
+			}
+			if !gjson.ValidBytes(b) {
+				return "", true, &errorType{"invalid json in []byte value"}
+			}
+			return string(b), true, nil
+		}
+		fallthrough
+	case reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// byte arrays are encoded by encoding/json as arrays of numbers
+			return "", false, nil
+		}
+		buf := []byte{'['}
+		for i := 0; i < rv.Len(); i++ {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			buf, err = appendEncoded(buf, rv.Index(i).Interface(), opts)
+			if err != nil {
+				return "", true, err
+			}
+		}
+		return string(append(buf, ']')), true, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return "null", true, nil
+		}
+		type member struct {
+			key   string
+			value reflect.Value
+		}
+		members := make([]member, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, ok := mapKeyString(iter.Key())
+			if !ok {
+				// not a valid json key, let encoding/json report it
+				return "", false, nil
+			}
+			members = append(members, member{key, iter.Value()})
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].key < members[j].key
+		})
+		buf := []byte{'{'}
+		for i, m := range members {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendStringify(buf, m.key)
+			buf = append(buf, ':')
+			var err error
+			buf, err = appendEncoded(buf, m.value.Interface(), opts)
+			if err != nil {
+				return "", true, err
+			}
+		}
+		return string(append(buf, '}')), true, nil
+	}
+	return "", false, nil
+}
+
+// mapKeyString returns the json object key for a map key, using the same
+// rules as encoding/json.
+func mapKeyString(k reflect.Value) (string, bool) {
+	if k.Kind() == reflect.String {
+		return k.String(), true
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", true
+		}
+		b, err := tm.MarshalText()
+		return string(b), err == nil
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), true
+	}
+	return "", false
+}
+
+// appendEncoded appends the json encoding of the value to buf.
+func appendEncoded(buf []byte, value interface{}, opts *Options) ([]byte,
+	error) {
+	if value == nil {
+		return append(buf, "null"...), nil
+	}
+	raw, stringify, _, err := encodeValue(value, opts)
+	if err != nil {
+		return buf, err
+	}
+	if stringify {
+		return appendStringify(buf, raw), nil
+	}
+	return append(buf, raw...), nil
+}
+
+// isNumber returns true if the value is a Go integer or float, or a
+// json.Number.
+func isNumber(value interface{}) bool {
+	if _, ok := value.(jsongo.Number); ok {
+		return true
+	}
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32,
+		reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// encodeFloat returns the raw json for the float. NaN and infinite values
+// are handled as specified by Options.InvalidFloat, and the format is
+// specified by Options.FloatPrecision and Options.FloatBitSize.
+func encodeFloat(f float64, opts *Options) (string, error) {
+	prec, bitSize := -1, 64
+	if opts != nil {
+		if opts.FloatPrecision > 0 {
+			prec = opts.FloatPrecision
+		}
+		if opts.FloatBitSize == 32 {
+			bitSize = 32
+		}
+	}
+	invalid := math.IsNaN(f) || math.IsInf(f, 0)
+	if !invalid && bitSize == 32 && math.IsInf(float64(float32(f)), 0) {
+		// overflows a float32, which would be written as +Inf
+		invalid = true
+	}
+	if invalid {
+		if opts != nil && opts.InvalidFloat == NullOnInvalidFloat {
+			return "null", nil
+		}
+		return "", &errorType{"unsupported float value: " +
+			strconv.FormatFloat(f, 'g', -1, 64)}
+	}
+	return strconv.FormatFloat(f, 'f', prec, bitSize), nil
+}
+
+// SetOptions sets a json value for the specified path with options.
+// A path is in dot syntax, such as "name.last" or "age".
+// This function expects that the json is well-formed, and does not validate.
+// Invalid json will not panic, but it may return back unexpected results.
+// An error is returned if the path is not valid.
+func SetOptions(json, path string, value interface{},
+	opts *Options) (string, error) {
+	if opts != nil {
+		if opts.ReplaceInPlace {
+			// it's not safe to replace bytes in-place for strings
+			// copy the Options and set options.ReplaceInPlace to false.
+			nopts := *opts
+			opts = &nopts
+			opts.ReplaceInPlace = false
+		}
+	}
+	jsonh := *(*stringHeader)(unsafe.Pointer(&json))
+	jsonbh := sliceHeader{data: jsonh.data, len: jsonh.len, cap: jsonh.len}
+	jsonb := *(*[]byte)(unsafe.Pointer(&jsonbh))
+	res, err := SetBytesOptions(jsonb, path, value, opts)
+	return string(res), err
+}
+
+// SetBytesOptions sets a json value for the specified path with options.
+// If working with bytes, this method preferred over
+// SetOptions(string(data), path, value)
+func SetBytesOptions(json []byte, path string, value interface{},
 	opts *Options) ([]byte, error) {
+	path, raw, stringify, del, err := prepareSet(path, value, opts)
+	if err != nil {
+		return nil, err
+	}
+	return setPrepared(nil, json, path, raw, stringify, del, opts, nil)
+}
+
+// prepareSet encodes the value and prepares the path for setPrepared.
+func prepareSet(path string, value interface{}, opts *Options) (
+	string, string, bool, bool, error) {
+	raw, stringify, del, err := encodeValue(value, opts)
+	if err != nil {
+		return "", "", false, false, err
+	}
+	if opts != nil && opts.PercentDecodePath {
+		if path, err = percentDecodePath(path); err != nil {
+			return "", "", false, false, err
+		}
+	}
+	if stringify && opts != nil && opts.MaxStringLen > 0 &&
+		len(raw) > opts.MaxStringLen {
+		return "", "", false, false, &errorType{"string value exceeds " +
+			strconv.Itoa(opts.MaxStringLen) + " bytes"}
+	}
+	if !del && opts != nil && opts.EscapeUnicode {
+		if stringify {
+			raw, stringify = string(appendStringify(nil, raw)), false
+		}
+		raw = string(appendEscapeUnicode(nil, raw))
+	}
+	if !del {
+		if err := checkDepth(path, raw, stringify, opts); err != nil {
+			return "", "", false, false, err
+		}
+		if err := checkPadValue(opts); err != nil {
+			return "", "", false, false, err
+		}
+	}
+	return path, raw, stringify, del, nil
+}
+
+// setPrepared sets the encoded value for a path that was prepared by
+// prepareSet. The result is built in buf when possible.
+func setPrepared(buf, json []byte, path, raw string, stringify, del bool,
+	opts *Options, paths []pathResult) ([]byte, error) {
 	jstr := *(*string)(unsafe.Pointer(&json))
-	vstr := *(*string)(unsafe.Pointer(&value))
-	var optimistic, inplace bool
+	validate := opts != nil && opts.Validate && !del
+	if validate && !stringify && !gjson.Valid(raw) {
+		return json, ErrInvalidOutput
+	}
+	st := newSetState(opts)
+	st.buf, st.paths = buf, paths
+	res, err := set(jstr, path, raw, stringify, del, st)
+	if err == nil && validate && st.index >= 0 {
+		min := skipPrefix(*(*string)(unsafe.Pointer(&res)), opts)
+		if !separated(res, min, st.index, st.end) {
+			return json, ErrInvalidOutput
+		}
+	}
+	if err == nil && !stringify && opts != nil && opts.MatchIndent &&
+		st.index >= 0 {
+		res = matchIndent(res, st.index, st.end)
+	}
+	return finish(json, res, err, opts)
+}
+
+// separated returns true if the value at json[start:end] is followed and
+// preceded by a json delimiter, or by either end of the document, where the
+// document begins at min.
+func separated(json []byte, min, start, end int) bool {
+	i := start - 1
+	for i >= min && json[i] <= ' ' {
+		i--
+	}
+	if i >= min && json[i] != ':' && json[i] != ',' && json[i] != '[' &&
+		json[i] != '{' {
+		return false
+	}
+	for end < len(json) && json[end] <= ' ' {
+		end++
+	}
+	return end == len(json) || json[end] == ',' || json[end] == ']' ||
+		json[end] == '}'
+}
+
+// SetBatch sets a json value for the specified path in each of the docs,
+// and returns the resulting documents and errors, one for each doc. The
+// value is encoded and the path is parsed only once, and the parsed path is
+// shared by all of the goroutines. The docs are
+// processed concurrently by up to GOMAXPROCS goroutines, and the docs are
+// never modified, even when opts.ReplaceInPlace is set. A result may share
+// memory with its doc when the doc did not change.
+// When the value or path is invalid, every error is the same error.
+func SetBatch(docs [][]byte, path string, value interface{},
+	opts *Options) ([][]byte, []error) {
+	results := make([][]byte, len(docs))
+	errs := make([]error, len(docs))
+	path, raw, stringify, del, err := prepareSet(path, value, opts)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return results, errs
+	}
+	if opts != nil && opts.ReplaceInPlace {
+		nopts := *opts
+		opts = &nopts
+		opts.ReplaceInPlace = false
+	}
+	var paths []pathResult
+	if path != "" {
+		// the parsed components are read-only, so they can be shared
+		paths, _ = compilePath(path, opts != nil && opts.ForceObjectKeys)
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(docs) {
+		workers = len(docs)
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(docs) {
+					return
+				}
+				results[i], errs[i] = setPrepared(nil, docs[i], path, raw,
+					stringify, del, opts, paths)
+			}
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// SetContext sets a json value for the specified path, and returns the
+// error of the context if it's done before the edit completes. The context
+// is checked for each path component and periodically while expanding
+// wildcards and queries, which bounds the work done on very large or
+// hostile documents.
+func SetContext(ctx context.Context, json, path string,
+	value interface{}) (string, error) {
+	return SetOptions(json, path, value, &Options{ctx: ctx})
+}
+
+// SetRawContext works the same as SetContext, except that the value is a
+// raw block of json.
+func SetRawContext(ctx context.Context, json, path,
+	value string) (string, error) {
+	return SetRawOptions(json, path, value, &Options{ctx: ctx})
+}
+
+// DeleteContext deletes a value from json for the specified path, and
+// returns the error of the context if it's done before the edit completes.
+func DeleteContext(ctx context.Context, json, path string) (string, error) {
+	return DeleteOptions(json, path, &Options{ctx: ctx})
+}
+
+// SetTo sets a json value for the specified path and writes the resulting
+// json to dst, such as a *bytes.Buffer or an http.ResponseWriter, allowing
+// the caller to control the allocation of the output. This function works
+// the same as SetBytesOptions, and the result is written the same way as
+// SetWriter. Errors from dst are returned.
+func SetTo(dst io.Writer, json []byte, path string, value interface{},
+	opts *Options) error {
+	path, raw, stringify, del, err := prepareSet(path, value, opts)
+	if err != nil {
+		return err
+	}
+	return writeSet(dst, json, path, raw, stringify, del, opts)
+}
+
+// SetWriter sets a json value for the specified path and writes the
+// resulting json to w. When an existing value is replaced at a simple path,
+// such as "name.last", the unchanged parts of the json and the new value are
+// written directly to w without building the result in memory. Other edits,
+// such as adding or deleting a value or editing through a wildcard, build
+// the result first. Errors from w are returned.
+func SetWriter(w io.Writer, json, path string, value interface{}) error {
+	raw, stringify, del, err := encodeValue(value, nil)
+	if err != nil {
+		return err
+	}
+	return writeSet(w, stringBytes(json), path, raw, stringify, del, nil)
+}
+
+// SetRawWriter works the same as SetWriter, except that the value is a raw
+// block of json.
+func SetRawWriter(w io.Writer, json, path, value string) error {
+	if trim(value) == "" {
+		return ErrEmptyRaw
+	}
+	return writeSet(w, stringBytes(json), path, value, false, false, nil)
+}
+
+// DeleteWriter deletes a value from json for the specified path and writes
+// the resulting json to w.
+func DeleteWriter(w io.Writer, json, path string) error {
+	return writeSet(w, stringBytes(json), path, "", false, true, nil)
+}
+
+// writeSet writes the result of setting the raw value to w.
+func writeSet(w io.Writer, jsonb []byte, path, raw string, stringify,
+	del bool, opts *Options) error {
+	if !del && streamable(opts, stringify) {
+		json := *(*string)(unsafe.Pointer(&jsonb))
+		st := newSetState(opts)
+		if res, ok := st.existingValue(json, path); ok {
+			if err := st.checkType(res.Raw, raw, stringify); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, json[:res.Index]); err != nil {
+				return err
+			}
+			var err error
+			if stringify {
+				_, err = w.Write(appendStringify(nil, raw))
+			} else {
+				_, err = io.WriteString(w, raw)
+			}
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, json[res.Index+len(res.Raw):])
+			return err
+		}
+	}
+	res, err := setPrepared(nil, jsonb, path, raw, stringify, del, opts, nil)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(res)
+	return err
+}
+
+// streamable returns true if replacing a value with the options only
+// changes the bytes of the value, which allows for writeSet to write the
+// rest of the json as is.
+func streamable(opts *Options, stringify bool) bool {
+	return opts == nil || (!opts.NormalizeWhitespace && !opts.Validate &&
+		!opts.ValidateInput && opts.SkipPrefixBytes == 0 &&
+		(stringify || !opts.MatchIndent))
+}
+
+// stringBytes returns the bytes of the string without copying. The bytes
+// must not be modified.
+func stringBytes(s string) []byte {
+	sh := *(*stringHeader)(unsafe.Pointer(&s))
+	bh := sliceHeader{data: sh.data, len: sh.len, cap: sh.len}
+	return *(*[]byte)(unsafe.Pointer(&bh))
+}
+
+// SetStream sets a json value for the specified path while copying the json
+// from src to dst, without holding the whole document in memory. The bytes
+// before the edited value are copied as they are read, followed by the new
+// value and the rest of the json, which allows for editing very large
+// documents. The value is encoded the same as Set.
+//
+// The path must be a simple path of object keys and array indexes, such as
+// "name.last" or "friends.1.age". Wildcards, queries, and modifiers are not
+// supported. When an object has a duplicate key the first one is edited,
+// rather than the last. Errors from src and dst are returned, in which case
+// dst may have received part of the json.
+func SetStream(dst io.Writer, src io.Reader, path string,
+	value interface{}) error {
+	if path == "" {
+		return newPathError(path, 0, "path cannot be empty")
+	}
+	raw, stringify, _, err := encodeValue(value, nil)
+	if err != nil {
+		return err
+	}
+	if stringify {
+		raw = string(appendStringify(nil, raw))
+	}
+	var paths []pathResult
+	var rest []string
+	for p := path; ; {
+		r, simple := parsePath(p)
+		if !simple {
+			return &errorType{"path '" + path +
+				"' is not supported by SetStream"}
+		}
+		paths = append(paths, r)
+		rest = append(rest, p)
+		if !r.more {
+			break
+		}
+		p = r.path
+	}
+	pp := &pipe{r: bufio.NewReader(src), w: bufio.NewWriter(dst),
+		paths: paths, rest: rest, raw: raw}
+	if err := pp.edit(0); err != nil {
+		return err
+	}
+	if _, err := io.Copy(pp.w, pp.r); err != nil {
+		return err
+	}
+	return pp.w.Flush()
+}
+
+// SetRawReader sets a raw json value, which is read from r, for the
+// specified path. The value is copied from r directly into the result,
+// without first reading it into a string of its own, which is useful for
+// inserting a large value, such as the contents of a file, into a small
+// document. An empty value returns ErrEmptyRaw.
+func SetRawReader(json, path string, r io.Reader) (string, error) {
+	return SetRawReaderOptions(json, path, r, nil)
+}
+
+// SetRawReaderOptions works the same as SetRawReader with options. Use
+// Options.Validate to check that the value is well-formed json. When the
+// path resolves to more than one value, such as with a '#' wildcard, the
+// value is read into memory first. Options.AppendUnique and
+// Options.MatchIndent are not supported.
+func SetRawReaderOptions(json, path string, r io.Reader,
+	opts *Options) (string, error) {
+	// write a placeholder, and then replace it with the value
+	var nopts Options
 	if opts != nil {
-		optimistic = opts.Optimistic
-		inplace = opts.ReplaceInPlace
+		nopts = *opts
 	}
-	res, err := set(jstr, path, vstr, false, false, optimistic, inplace)
-	if err == errNoChange {
-		return json, nil
+	nopts.ReplaceInPlace = false
+	nopts.PreserveType = false
+	nopts.AppendUnique = false
+	nopts.NormalizeWhitespace = false
+	npath, err := prepareSetRaw(path, "null", &nopts)
+	if err != nil {
+		return json, err
+	}
+	st := newSetState(&nopts)
+	res, err := set(json, npath, "null", false, false, st)
+	if err != nil {
+		if err == errNoChange {
+			err = nil
+		}
+		return json, err
+	}
+	if st.index < 0 {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return json, err
+		}
+		return SetRawOptions(json, path, string(value), opts)
+	}
+	var sb strings.Builder
+	sb.Grow(len(res))
+	sb.Write(res[:st.index])
+	n, err := io.Copy(&sb, r)
+	if err != nil {
+		return json, err
+	}
+	sb.Write(res[st.end:])
+	out := sb.String()
+	value := out[st.index : st.index+int(n)]
+	if trim(value) == "" {
+		return json, ErrEmptyRaw
+	}
+	if err := checkDepth(npath, value, false, opts); err != nil {
+		return json, err
+	}
+	if opts != nil && opts.Validate && (!gjson.Valid(value) ||
+		!separated([]byte(out), skipPrefix(out, opts), st.index,
+			st.index+int(n))) {
+		return json, ErrInvalidOutput
+	}
+	if opts != nil && opts.PreserveType {
+		old := gjson.Get(json, gjsonPath(npath))
+		if err := newSetState(opts).checkType(old.Raw, value,
+			false); old.Exists() && err != nil {
+			return json, err
+		}
+	}
+	if opts != nil && opts.NormalizeWhitespace {
+		n := skipPrefix(out, opts)
+		out = out[:n] + string(pretty.Ugly([]byte(out[n:])))
+	}
+	return out, nil
+}
+
+// pipe is the state of SetStream, which copies the json from the reader to
+// the writer.
+type pipe struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	paths []pathResult
+	rest  []string // the remaining path at each component
+	raw   string   // the encoded value
+}
+
+// next reads the next byte, and copies it to the output when write is set.
+func (p *pipe) next(write bool) (byte, error) {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if write {
+		p.w.WriteByte(c)
+	}
+	return c, nil
+}
+
+// peek skips the whitespace, and copies it to the output when write is set,
+// then returns the next byte without reading it. An io.EOF is returned at
+// the end of the input.
+func (p *pipe) peek(write bool) (byte, error) {
+	for {
+		b, err := p.r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if b[0] > ' ' {
+			return b[0], nil
+		}
+		p.next(write)
+	}
+}
+
+// expect reads the next byte, following any whitespace, and returns an
+// error if it's not c.
+func (p *pipe) expect(c byte) error {
+	n, err := p.peek(true)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if n != c {
+		return ErrInvalidJSON
+	}
+	_, err = p.next(true)
+	return err
+}
+
+// copyString copies the rest of a string, after the opening quote, and
+// appends it to key when key isn't nil.
+func (p *pipe) copyString(write bool, key *[]byte) error {
+	for esc := false; ; {
+		c, err := p.next(write)
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			*key = append(*key, c)
+		}
+		switch {
+		case esc:
+			esc = false
+		case c == '\\':
+			esc = true
+		case c == '"':
+			return nil
+		}
+	}
+}
+
+// copyValue copies the next value, or skips it when write isn't set.
+func (p *pipe) copyValue(write bool) error {
+	c, err := p.peek(write)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if c != '{' && c != '[' && c != '"' {
+		// a number or literal ends at the next delimiter
+		for {
+			b, err := p.r.Peek(1)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if b[0] <= ' ' || b[0] == ',' || b[0] == ']' || b[0] == '}' {
+				return nil
+			}
+			p.next(write)
+		}
+	}
+	var depth int
+	for {
+		c, err := p.next(write)
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '"':
+			if err := p.copyString(write, nil); err != nil {
+				return err
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// build returns the value for the path starting at the ith component, for
+// a container that doesn't exist yet.
+func (p *pipe) build(i int) ([]byte, error) {
+	if i == len(p.paths) {
+		return []byte(p.raw), nil
+	}
+	return set("", p.rest[i], p.raw, false, false, newSetState(nil))
+}
+
+// edit copies the json up to the value for the ith path component, and
+// edits it. The input is positioned at the value that is the container of
+// the ith component, or the value itself when i is the last component.
+func (p *pipe) edit(i int) error {
+	c, err := p.peek(true)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if i < len(p.paths) && err == nil && (c == '{' || c == '[') {
+		if c == '{' {
+			return p.editObject(i)
+		}
+		n, numeric := atoui(p.paths[i])
+		if numeric || p.paths[i].part == "-1" && !p.paths[i].force {
+			return p.editArray(i, n, numeric)
+		}
+		return &errorType{"cannot set array element for non-numeric key '" +
+			p.paths[i].part + "'"}
+	}
+	// replace the value, which is a new container when there's more path
+	if err == nil {
+		if err := p.copyValue(false); err != nil {
+			return err
+		}
+	}
+	value, err := p.build(i)
+	if err != nil {
+		return err
+	}
+	p.w.Write(value)
+	return nil
+}
+
+func (p *pipe) editObject(i int) error {
+	p.next(true)
+	for count := 0; ; count++ {
+		c, err := p.peek(true)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		if c == '}' {
+			// the key doesn't exist, so it's added to the end
+			if count > 0 {
+				p.w.WriteByte(',')
+			}
+			value, err := p.build(i + 1)
+			if err != nil {
+				return err
+			}
+			p.w.Write(appendStringify(nil, p.paths[i].part))
+			p.w.WriteByte(':')
+			p.w.Write(value)
+			return nil
+		}
+		if count > 0 {
+			if err := p.expect(','); err != nil {
+				return err
+			}
+		}
+		if err := p.expect('"'); err != nil {
+			return err
+		}
+		key := []byte{'"'}
+		if err := p.copyString(true, &key); err != nil {
+			return err
+		}
+		if err := p.expect(':'); err != nil {
+			return err
+		}
+		if gjson.ParseBytes(key).Str == p.paths[i].part {
+			return p.edit(i + 1)
+		}
+		if err := p.copyValue(true); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *pipe) editArray(i, n int, numeric bool) error {
+	p.next(true)
+	for count := 0; ; count++ {
+		c, err := p.peek(true)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		if c == ']' {
+			// the element doesn't exist, so it's appended with padding
+			st := newSetState(nil)
+			var buf []byte
+			if !numeric {
+				n = count
+			}
+			if count > 0 {
+				buf = st.appendPadding(buf, n-count, true)
+				buf = append(buf, ',')
+			} else {
+				buf = st.appendPadding(buf, n, false)
+			}
+			value, err := p.build(i + 1)
+			if err != nil {
+				return err
+			}
+			p.w.Write(append(buf, value...))
+			return nil
+		}
+		if count > 0 {
+			if err := p.expect(','); err != nil {
+				return err
+			}
+		}
+		if numeric && count == n {
+			return p.edit(i + 1)
+		}
+		if err := p.copyValue(true); err != nil {
+			return err
+		}
+	}
+}
+
+// SetRawBytesOptions sets a raw json value for the specified path with options.
+// If working with bytes, this method preferred over
+// SetRawOptions(string(data), path, value, opts)
+func SetRawBytesOptions(json []byte, path string, value []byte,
+	opts *Options) ([]byte, error) {
+	return setRawBytes(nil, json, path, value, opts)
+}
+
+// SetRawBytesBuffer works the same as SetRawBytesOptions, except that the
+// result is written to dst, which is grown as needed, and returned. This
+// allows for reusing one buffer across many calls, such as one buffer per
+// goroutine. Some edits, such as those with wildcards or queries, build the
+// result separately and then copy it to dst.
+// The dst may be the json itself only when opts.ReplaceInPlace is set, in
+// which case the json is edited in place when the result fits. Otherwise
+// dst must not overlap the json.
+func SetRawBytesBuffer(dst, json []byte, path string, value []byte,
+	opts *Options) ([]byte, error) {
+	inplace := opts != nil && opts.ReplaceInPlace && overlaps(dst, json)
+	if inplace {
+		dst = nil
+	}
+	res, err := setRawBytes(dst[:0], json, path, value, opts)
+	if err != nil {
+		return dst, err
+	}
+	if !inplace && (overlaps(res, json) ||
+		cap(dst) > 0 && !overlaps(res, dst)) {
+		res = append(dst[:0], res...)
+	}
+	return res, nil
+}
+
+// overlaps returns true if the underlying arrays of the slices overlap.
+func overlaps(a, b []byte) bool {
+	if cap(a) == 0 || cap(b) == 0 {
+		return false
+	}
+	a, b = a[:cap(a)], b[:cap(b)]
+	astart := uintptr(unsafe.Pointer(&a[0]))
+	bstart := uintptr(unsafe.Pointer(&b[0]))
+	return astart < bstart+uintptr(len(b)) && bstart < astart+uintptr(len(a))
+}
+
+func setRawBytes(buf, json []byte, path string, value []byte,
+	opts *Options) ([]byte, error) {
+	vstr := *(*string)(unsafe.Pointer(&value))
+	path, err := prepareSetRaw(path, vstr, opts)
+	if err != nil {
+		return json, err
+	}
+	return setPrepared(buf, json, path, vstr, false, false, opts, nil)
+}
+
+// prepareSetRaw checks a raw value and prepares its path, like prepareSet
+// does for a Go value.
+func prepareSetRaw(path, value string, opts *Options) (string, error) {
+	if trim(value) == "" {
+		return "", ErrEmptyRaw
+	}
+	if opts != nil && opts.PercentDecodePath {
+		var err error
+		if path, err = percentDecodePath(path); err != nil {
+			return "", err
+		}
+	}
+	if err := checkDepth(path, value, false, opts); err != nil {
+		return "", err
+	}
+	if err := checkPadValue(opts); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// percentDecodePath decodes the percent-encoded components of the path and
+// escapes them as literal object keys. Query components are left as-is.
+func percentDecodePath(path string) (string, error) {
+	if !strings.Contains(path, "%") {
+		return path, nil
+	}
+	comps, err := splitComponents(path)
+	if err != nil {
+		return "", err
+	}
+	for i, comp := range comps {
+		if kind, _ := classifyComponent(comp); kind == QuerySegment ||
+			!strings.Contains(comp, "%") {
+			continue
+		}
+		key, err := url.PathUnescape(comp)
+		if err != nil {
+			return "", &errorType{"invalid percent-encoding in path " +
+				"component '" + comp + "'"}
+		}
+		comps[i] = PathForKeys(key)
+	}
+	return strings.Join(comps, "."), nil
+}
+
+// checkDepth returns an error if writing the value at the path would exceed
+// Options.MaxResultDepth.
+func checkDepth(path, raw string, stringify bool, opts *Options) error {
+	if opts == nil || opts.MaxResultDepth <= 0 {
+		return nil
+	}
+	var depth int // an empty path is the document root
+	if path != "" {
+		comps, err := splitComponents(path)
+		if err != nil {
+			return err
+		}
+		depth = len(comps)
+	}
+	if !stringify {
+		depth += rawDepth(raw)
+	}
+	if depth > opts.MaxResultDepth {
+		return &errorType{"writing at '" + path + "' exceeds the maximum " +
+			"depth of " + strconv.Itoa(opts.MaxResultDepth)}
+	}
+	return nil
+}
+
+// rawDepth returns the nesting depth of the raw json value, which is zero
+// for strings, numbers, and literals.
+func rawDepth(raw string) int {
+	var depth, max int
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '"':
+			for i++; i < len(raw) && raw[i] != '"'; i++ {
+				if raw[i] == '\\' {
+					i++
+				}
+			}
+		case '{', '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return max
+}
+
+// matchIndent reformats the value at json[start:end] to match the
+// indentation of the surrounding json. The value is made compact when the
+// surrounding json has no line breaks.
+func matchIndent(json []byte, start, end int) []byte {
+	value := json[start:end]
+	var nvalue []byte
+	unit := detectIndent(json[:start], json[end:])
+	if unit == "" {
+		nvalue = pretty.Ugly(value)
+	} else {
+		// indent the value's lines by the indentation of the edited line
+		ls := bytes.LastIndexByte(json[:start], '\n') + 1
+		le := ls
+		for le < start && (json[le] == ' ' || json[le] == '\t') {
+			le++
+		}
+		nvalue = pretty.PrettyOptions(value,
+			&pretty.Options{Width: 80, Indent: unit})
+		nvalue = bytes.TrimRight(nvalue, "\n")
+		nvalue = bytes.ReplaceAll(nvalue, []byte{'\n'},
+			append([]byte{'\n'}, json[ls:le]...))
+	}
+	if bytes.Equal(nvalue, value) {
+		return json
+	}
+	buf := make([]byte, 0, len(json)-len(value)+len(nvalue))
+	buf = append(buf, json[:start]...)
+	buf = append(buf, nvalue...)
+	return append(buf, json[end:]...)
+}
+
+// detectIndent returns the smallest indentation of the lines of the json,
+// or an empty string when the json has no line breaks.
+func detectIndent(parts ...[]byte) string {
+	var unit string
+	var lines bool
+	for _, part := range parts {
+		for i := 0; i < len(part); i++ {
+			if part[i] != '\n' {
+				continue
+			}
+			lines = true
+			j := i + 1
+			for j < len(part) && (part[j] == ' ' || part[j] == '\t') {
+				j++
+			}
+			if j > i+1 && (unit == "" || j-i-1 < len(unit)) {
+				unit = string(part[i+1 : j])
+			}
+		}
+	}
+	if lines && unit == "" {
+		unit = "  "
+	}
+	return unit
+}
+
+// lineIndent returns the leading whitespace of the last line in buf.
+func lineIndent(buf []byte) string {
+	i := bytes.LastIndexByte(buf, '\n') + 1
+	j := i
+	for j < len(buf) && (buf[j] == ' ' || buf[j] == '\t') {
+		j++
+	}
+	return string(buf[i:j])
+}
+
+// formatMember pretty prints the object member, or array element, that was
+// built at buf[mark:], for a container whose line is indented by base. The
+// first line of the member is not indented. The location of the written
+// value is updated to match.
+func (st *setState) formatMember(buf []byte, mark int, base string,
+	array bool) []byte {
+	head := `{`
+	if array {
+		head = `{"":`
+	}
+	wrapped := make([]byte, 0, len(head)+len(buf)-mark+1)
+	wrapped = append(wrapped, head...)
+	wrapped = append(wrapped, buf[mark:]...)
+	wrapped = append(wrapped, '}')
+	out := pretty.PrettyOptions(wrapped,
+		&pretty.Options{Width: 80, Prefix: base, Indent: st.indent})
+	// drop the wrapping braces and the indentation of the first line
+	start := bytes.IndexByte(out, '\n') + 1 + len(base) + len(st.indent)
+	if array {
+		start += len(`"": `)
+	}
+	end := bytes.LastIndexByte(bytes.TrimRight(out, "\n"), '\n')
+	if st.index >= mark {
+		n := significant(wrapped[:len(head)+st.index-mark])
+		i, j := significantRange(out, n, significant(buf[st.index:st.end]))
+		st.index, st.end = mark+i-start, mark+j-start
+	}
+	return append(buf[:mark], out[start:end]...)
+}
+
+// significant returns the number of bytes in json that are not whitespace
+// outside of strings.
+func significant(json []byte) int {
+	i, _ := significantRange(json, len(json)+1, 0)
+	return i
+}
+
+// significantRange returns the offsets of the nth significant byte in json,
+// and of the end of the size significant bytes that follow it. When json
+// has fewer than n significant bytes, the number of significant bytes is
+// returned instead.
+func significantRange(json []byte, n, size int) (int, int) {
+	var count int
+	var str, esc bool
+	start := -1
+	for i := 0; i < len(json); i++ {
+		c := json[i]
+		if !str && c <= ' ' {
+			continue
+		}
+		if count == n {
+			start = i
+		}
+		count++
+		if start >= 0 && count == n+size {
+			return start, i + 1
+		}
+		switch {
+		case esc:
+			esc = false
+		case str && c == '\\':
+			esc = true
+		case c == '"':
+			str = !str
+		}
+	}
+	if start >= 0 {
+		return start, len(json)
+	}
+	return count, count
+}
+
+// IncrementInt adds delta to the integer value at the specified path and
+// returns the updated json. The arithmetic is done in int64 space so large
+// counters don't lose precision. When the path does not exist the value is
+// created as delta.
+// An error is returned if the existing value isn't an integer or if the
+// result would overflow an int64.
+func IncrementInt(json, path string, delta int64) (string, error) {
+	var n int64
+	res := gjson.Get(json, gjsonPath(path))
+	if res.Exists() {
+		if res.Type != gjson.Number {
+			return json, &errorType{"value at '" + path + "' is not an integer"}
+		}
+		var err error
+		n, err = strconv.ParseInt(res.Raw, 10, 64)
+		if err != nil {
+			if nerr, ok := err.(*strconv.NumError); ok &&
+				nerr.Err == strconv.ErrRange {
+				return json, &errorType{
+					"value at '" + path + "' overflows int64"}
+			}
+			return json, &errorType{"value at '" + path + "' is not an integer"}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) ||
+			(delta < 0 && n < math.MinInt64-delta) {
+			return json, &errorType{"increment at '" + path + "' overflows int64"}
+		}
+	}
+	return SetRaw(json, path, strconv.FormatInt(n+delta, 10))
+}
+
+// Bump adds delta to the number at the specified path and returns the
+// updated json along with the resulting number. When the path does not
+// exist the value is created as delta. The result is written in its
+// shortest form, so whole numbers have no fraction, such as 3 rather than
+// 3.0.
+// An error is returned if the existing value isn't a number, or if the
+// result isn't a finite number.
+func Bump(json, path string, delta float64) (string, float64, error) {
+	n := delta
+	if res := gjson.Get(json, gjsonPath(path)); res.Exists() {
+		if res.Type != gjson.Number {
+			return json, 0, &errorType{"value at '" + path +
+				"' is not a number"}
+		}
+		n += res.Num
+	}
+	raw, err := encodeFloat(n, nil)
+	if err != nil {
+		return json, 0, err
+	}
+	res, err := SetRaw(json, path, raw)
+	if err != nil {
+		return json, 0, err
+	}
+	return res, n, nil
+}
+
+// splitWildcard splits the path at the first '#' wildcard component.
+// Queries such as '#(...)' are not considered wildcards.
+func splitWildcard(path string) (prefix, rest string, ok bool) {
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			i++
+		case '#':
+			if i+1 < len(path) && path[i+1] == '(' {
+				depth := 0
+				for i++; i < len(path); i++ {
+					if path[i] == '(' {
+						depth++
+					} else if path[i] == ')' {
+						depth--
+						if depth == 0 {
+							break
+						}
+					}
+				}
+				continue
+			}
+			if (i == 0 || path[i-1] == '.') &&
+				(i+1 == len(path) || path[i+1] == '.') {
+				prefix = strings.TrimSuffix(path[:i], ".")
+				rest = strings.TrimPrefix(path[i+1:], ".")
+				return prefix, rest, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// DeleteMany deletes the values at each of the paths. Unlike DeleteManyReport,
+// every path is resolved against the original json, including '#'
+// wildcards, queries, and glob keys. The values are then deleted from right
+// to left in document order, so that deleting an array element does not
+// shift the indexes of the elements addressed by the other paths. For
+// example, deleting "a.1" and "a.3" from {"a":[0,1,2,3]} results in
+// {"a":[0,2]}. Paths that match nothing are ignored.
+func DeleteMany(json string, paths []string) (string, error) {
+	type target struct {
+		path  string
+		index int
+	}
+	var targets []target
+	for _, path := range paths {
+		comps, err := splitComponents(path)
+		if err != nil {
+			return json, err
+		}
+		for _, p := range expandQueries(nil, json, "", comps) {
+			res := gjson.Get(json, gjsonPath(p))
+			if res.Exists() {
+				targets = append(targets, target{p, res.Index})
+			}
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].index > targets[j].index
+	})
+	out := json
+	for i, t := range targets {
+		if i > 0 && t.index == targets[i-1].index {
+			continue
+		}
+		var err error
+		if out, err = Delete(out, t.path); err != nil {
+			return json, err
+		}
+	}
+	return out, nil
+}
+
+// DeleteManyBytes deletes the values at each of the paths.
+// If working with bytes, this method preferred over
+// DeleteMany(string(data), paths)
+func DeleteManyBytes(json []byte, paths []string) ([]byte, error) {
+	res, err := DeleteMany(string(json), paths)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+// DeleteManyReport deletes the values at each of the paths, in order, and
+// returns a map of every resolved path to the raw value that was removed.
+// Paths may have '#' wildcards, queries, and glob keys, which are resolved
+// the same as DeleteMany, and each concrete path is reported. Paths are
+// resolved against the json as it is after the previous paths have been
+// deleted. Paths that match nothing are absent from the map.
+func DeleteManyReport(json string, paths []string) (out string,
+	removed map[string]string, err error) {
+	removed = make(map[string]string)
+	out = json
+	for _, path := range paths {
+		comps, err := splitComponents(path)
+		if err != nil {
+			return json, nil, err
+		}
+		matches := expandQueries(nil, out, "", comps)
+		// delete from the last match so that earlier array indexes remain
+		for i := len(matches) - 1; i >= 0; i-- {
+			res := gjson.Get(out, gjsonPath(matches[i]))
+			if !res.Exists() {
+				continue
+			}
+			next, err := Delete(out, matches[i])
+			if err != nil {
+				return json, nil, err
+			}
+			if next != out {
+				removed[matches[i]] = res.Raw
+				out = next
+			}
+		}
+	}
+	return out, removed, nil
+}
+
+// DeleteManyReportBytes deletes the values at each of the paths.
+// If working with bytes, this method preferred over
+// DeleteManyReport(string(data), paths)
+func DeleteManyReportBytes(json []byte, paths []string) ([]byte,
+	map[string]string, error) {
+	res, removed, err := DeleteManyReport(string(json), paths)
+	if err != nil {
+		return json, nil, err
+	}
+	return []byte(res), removed, nil
+}
+
+// Toggle negates the boolean value at the specified path. When the path does
+// not exist the value is created as true. The '#' wildcard, queries, and
+// glob keys may be used to toggle every value that they match.
+// An error is returned if an existing value isn't a boolean.
+func Toggle(json, path string) (string, error) {
+	paths, err := expandPath(json, path)
+	if err != nil {
+		return json, err
+	}
+	njson := json
+	for _, path := range paths {
+		var raw string
+		res := gjson.Get(njson, gjsonPath(path))
+		switch {
+		case !res.Exists(), res.Type == gjson.False:
+			raw = "true"
+		case res.Type == gjson.True:
+			raw = "false"
+		default:
+			return json, &errorType{"value at '" + path + "' is not a boolean"}
+		}
+		njson, err = SetRaw(njson, path, raw)
+		if err != nil {
+			return json, err
+		}
+	}
+	return njson, nil
+}
+
+// ToggleBytes negates the boolean value at the specified path.
+// If working with bytes, this method preferred over
+// Toggle(string(data), path)
+func ToggleBytes(json []byte, path string) ([]byte, error) {
+	res, err := Toggle(string(json), path)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+// SetEach sets a json value for every element that the wildcards in the
+// path resolve to, computing each value with fn. The fn receives the
+// position of the element, in document order, and the value matched by the
+// last '#' wildcard, query, or glob key in the path. For a path without
+// wildcards, fn is called once with the value at the path.
+// Returning an error from fn aborts the operation and the error is returned.
+func SetEach(json, wildcardPath string,
+	fn func(index int, elem gjson.Result) (interface{}, error)) (string, error) {
+	comps, err := splitComponents(wildcardPath)
+	if err != nil {
+		return json, err
+	}
+	last := len(comps) - 1
+	for i, comp := range comps {
+		switch kind, _ := classifyComponent(comp); kind {
+		case WildcardSegment, QuerySegment, GlobSegment:
+			last = i
+		}
+	}
+	njson := json
+	for i, path := range expandQueries(nil, json, "", comps) {
+		// a concrete path has one component for each component of the pattern
+		elem := path
+		if pcomps, err := splitComponents(path); err == nil &&
+			last < len(pcomps) {
+			elem = strings.Join(pcomps[:last+1], ".")
+		}
+		value, err := fn(i, gjson.Get(json, gjsonPath(elem)))
+		if err != nil {
+			return json, err
+		}
+		njson, err = Set(njson, path, value)
+		if err != nil {
+			return json, err
+		}
+	}
+	return njson, nil
+}
+
+// PathForKeys returns a path that addresses the literal object keys, with
+// each key escaped as needed. Numeric keys are prefixed with the ':'
+// character so that they are never treated as array indexes.
+//
+//	PathForKeys("fav.movie", "2020")  >> "fav\.movie.:2020"
+func PathForKeys(keys ...string) string {
+	var buf []byte
+	for i, key := range keys {
+		if i > 0 {
+			buf = append(buf, '.')
+		}
+		if _, numeric := atoui(pathResult{part: key}); numeric || key == "-1" {
+			buf = append(buf, ':')
+		} else if len(key) > 0 && key[0] == ':' {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, gjson.Escape(key)...)
+	}
+	return string(buf)
+}
+
+// SplitPath decodes a path into its literal components. This is the inverse
+// of PathForKeys.
+// An error is returned if the path contains a component that isn't a
+// literal key or index, such as a wildcard or query.
+func SplitPath(path string) ([]string, error) {
+	var keys []string
+	r := pathResult{path: path, more: true}
+	for r.more {
+		var simple bool
+		pos := len(path) - len(r.path)
+		r, simple = parsePath(r.path)
+		if !simple {
+			return nil, newPathError(path, pos,
+				"component is not a literal key or index")
+		}
+		keys = append(keys, r.part)
+	}
+	return keys, nil
+}
+
+// PathBuilder builds a path from components, escaping each component as
+// needed. The zero value is an empty path.
+//
+//	var b sjson.PathBuilder
+//	b.Key("fav.movie").Index(2).Key("name").String()  >> "fav\.movie.2.name"
+type PathBuilder struct {
+	comps []string
+	err   error
+}
+
+// Key appends a literal object key.
+func (b *PathBuilder) Key(key string) *PathBuilder {
+	b.comps = append(b.comps, PathForKeys(key))
+	return b
+}
+
+// Index appends an array index.
+func (b *PathBuilder) Index(index int) *PathBuilder {
+	if index < 0 && b.err == nil {
+		b.err = &errorType{"array index cannot be negative"}
+	}
+	b.comps = append(b.comps, strconv.Itoa(index))
+	return b
+}
+
+// Append appends the "-1" component, which appends to an array.
+func (b *PathBuilder) Append() *PathBuilder {
+	b.comps = append(b.comps, "-1")
+	return b
+}
+
+// Wildcard appends the '#' component, which matches every element of an
+// array.
+func (b *PathBuilder) Wildcard() *PathBuilder {
+	b.comps = append(b.comps, "#")
+	return b
+}
+
+// Filter appends a '#(key op val)' query, which matches the first element
+// of an array where the key satisfies the condition. The op is one of "==",
+// "=", "!=", "<", "<=", ">", ">=", "%", or "!%". The val is used as raw json
+// when it is valid json, such as a number or a quoted string, otherwise it's
+// used as a string.
+func (b *PathBuilder) Filter(key, op, val string) *PathBuilder {
+	switch op {
+	case "==", "=", "!=", "<", "<=", ">", ">=", "%", "!%":
+	default:
+		if b.err == nil {
+			b.err = &errorType{"invalid filter operator '" + op + "'"}
+		}
+	}
+	if !gjson.Valid(val) {
+		val = string(appendStringify(nil, val))
+	}
+	b.comps = append(b.comps, "#("+gjson.Escape(key)+op+val+")")
+	return b
+}
+
+// String returns the path.
+func (b *PathBuilder) String() string {
+	return strings.Join(b.comps, ".")
+}
+
+// Build returns the path, or an error if a component was invalid or the
+// path is empty.
+func (b *PathBuilder) Build() (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	if len(b.comps) == 0 {
+		return "", newPathError("", 0, "path cannot be empty")
+	}
+	return b.String(), nil
+}
+
+// Builder builds a json document from scratch with a series of edits. The
+// edits are recorded by Set, SetRaw, and Delete, and are applied in order by
+// Bytes or String, which reuse the same buffers for every edit rather than
+// allocating a new document each time. The zero value is an empty builder
+// that uses the default options.
+//
+//	var b sjson.Builder
+//	b.Set("name.first", "Tom").Set("age", 37)
+//	json, err := b.String()  >> {"name":{"first":"Tom"},"age":37}
+type Builder struct {
+	opts *Options
+	ops  []builderOp
+	err  error
+}
+
+type builderOp struct {
+	path, raw      string
+	stringify, del bool
+}
+
+// NewBuilder returns an empty Builder that applies its edits using the
+// provided options.
+func NewBuilder(opts *Options) *Builder {
+	return &Builder{opts: opts}
+}
+
+// Set records setting a json value for the specified path. The value is
+// encoded right away, so later changes to the value are not included.
+func (b *Builder) Set(path string, value interface{}) *Builder {
+	if b.err != nil {
+		return b
+	}
+	path, raw, stringify, del, err := prepareSet(path, value, b.opts)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.ops = append(b.ops, builderOp{path, raw, stringify, del})
+	return b
+}
+
+// SetRaw records setting a raw json value for the specified path.
+func (b *Builder) SetRaw(path, value string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	path, err := prepareSetRaw(path, value, b.opts)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.ops = append(b.ops, builderOp{path: path, raw: value})
+	return b
+}
+
+// Delete records deleting a value for the specified path.
+func (b *Builder) Delete(path string) *Builder {
+	return b.Set(path, dtype{})
+}
+
+// Reset removes all of the recorded edits and errors.
+func (b *Builder) Reset() {
+	b.ops = b.ops[:0]
+	b.err = nil
+}
+
+// Bytes applies the recorded edits to an empty document and returns the
+// result. The first error from recording or applying an edit is returned.
+func (b *Builder) Bytes() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	opts := b.opts
+	if opts != nil && opts.ReplaceInPlace {
+		nopts := *opts
+		opts = &nopts
+		opts.ReplaceInPlace = false
+	}
+	var json, spare []byte
+	for _, op := range b.ops {
+		res, err := setPrepared(spare[:0], json, op.path, op.raw,
+			op.stringify, op.del, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !overlaps(res, json) {
+			// the previous document becomes the buffer for the next edit
+			spare = json
+		}
+		json = res
+	}
+	return json, nil
+}
+
+// String applies the recorded edits to an empty document and returns the
+// result. The first error from recording or applying an edit is returned.
+func (b *Builder) String() (string, error) {
+	json, err := b.Bytes()
+	return string(json), err
+}
+
+// matchPredicate returns true if the value satisfies the gjson query
+// predicate, such as `=="hello"`, `>10` or `name%"J*"`.
+func matchPredicate(value gjson.Result, predicate string) bool {
+	return gjson.Get("["+value.Raw+"]", "#("+predicate+")").Exists()
+}
+
+// DeleteIf deletes a value from json for the specified path, but only when
+// the current value satisfies the predicate. The predicate uses the gjson
+// query syntax, which is the condition that would appear inside of a
+// '#(...)' query. For example, `==""` deletes an empty string and
+// `age>60` deletes an object with an age field greater than 60.
+// When the path contains '#' wildcards, queries, or glob keys, each matched
+// value is deleted only if it satisfies the predicate.
+func DeleteIf(json, path, predicate string) (string, error) {
+	matches, err := expandPath(json, path)
+	if err != nil {
+		return json, err
+	}
+	njson := json
+	for i := len(matches) - 1; i >= 0; i-- {
+		res := gjson.Get(njson, gjsonPath(matches[i]))
+		if !res.Exists() || !matchPredicate(res, predicate) {
+			continue
+		}
+		njson, err = Delete(njson, matches[i])
+		if err != nil {
+			return json, err
+		}
+	}
+	return njson, nil
+}
+
+// mergeObjects deep merges the patch object into the target object, with a
+// single pass over each of them. Keys in the patch win on conflicts, except
+// when both values are objects, which are merged recursively, and when both
+// values are arrays, which are combined as specified by opts. If either
+// value isn't an object then the patch is returned. The formatting of the
+// target is kept, and new keys are added to the end.
+func mergeObjects(target, patch string, opts *MergeOptions) string {
+	tres, pres := gjson.Parse(target), gjson.Parse(patch)
+	if !tres.IsObject() || !pres.IsObject() {
+		return patch
+	}
+	// the last value of each key in the patch, in the order of the keys
+	values := make(map[string]gjson.Result)
+	var order []string
+	pres.ForEach(func(key, value gjson.Result) bool {
+		if _, ok := values[key.Str]; !ok {
+			order = append(order, key.Str)
+		}
+		values[key.Str] = value
+		return true
+	})
+	type member struct {
+		key          string
+		start, value int // index of the key and the value
+		end          int
+	}
+	var members []member
+	last := make(map[string]int)
+	tres.ForEach(func(key, value gjson.Result) bool {
+		last[key.Str] = len(members)
+		members = append(members, member{key.Str, key.Index, value.Index,
+			value.Index + len(value.Raw)})
+		return true
+	})
+	buf := make([]byte, 0, len(target)+len(patch))
+	var tail string
+	if len(members) == 0 {
+		end := strings.LastIndexByte(target, '}')
+		buf, tail = append(buf, target[:end]...), target[end:]
+	} else {
+		buf = append(buf, target[:members[0].start]...)
+		tail = target[members[len(members)-1].end:]
+	}
+	var n int
+	for i, m := range members {
+		raw := target[m.value:m.end]
+		if pv, ok := values[m.key]; ok && last[m.key] == i {
+			delete(values, m.key)
+			if pv.Type == gjson.Null && opts != nil && opts.DeleteNulls {
+				continue
+			}
+			raw = mergeValue(gjson.Parse(raw), pv, opts)
+		}
+		if n > 0 {
+			// the separator that precedes the member, with the comma
+			buf = append(buf, target[members[i-1].end:m.start]...)
+		}
+		buf = append(buf, target[m.start:m.value]...)
+		buf = append(buf, raw...)
+		n++
+	}
+	for _, key := range order {
+		pv, ok := values[key]
+		if !ok || (pv.Type == gjson.Null && opts != nil && opts.DeleteNulls) {
+			continue
+		}
+		if n > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendStringify(buf, key)
+		buf = append(buf, ':')
+		buf = append(buf, mergeValue(gjson.Result{}, pv, opts)...)
+		n++
+	}
+	return string(append(buf, tail...))
+}
+
+// mergeValue returns the result of merging the patch value into the
+// existing value, which may not exist.
+func mergeValue(cur, patch gjson.Result, opts *MergeOptions) string {
+	switch {
+	case patch.IsObject():
+		if cur.IsObject() {
+			return mergeObjects(cur.Raw, patch.Raw, opts)
+		}
+		if opts != nil && opts.DeleteNulls {
+			// removes the null values of the patch
+			return mergeObjects("{}", patch.Raw, opts)
+		}
+	case patch.IsArray() && cur.IsArray() && opts != nil &&
+		opts.Arrays != ReplaceArrays:
+		return mergeArrays(cur, patch, opts.Arrays == UnionArrays)
+	}
+	return patch.Raw
+}
+
+// MergeArrayByIndex merges the raw array into the array at the specified
+// path, position by position. For each index, if both the existing and the
+// incoming elements are objects then they are deep merged, otherwise the
+// incoming element replaces the existing one. Incoming elements past the end
+// of the existing array are appended, and existing elements past the end of
+// the incoming array are kept. When the path does not exist the raw array
+// is set as is.
+// An error is returned if the raw value or the existing value isn't an array.
+func MergeArrayByIndex(json, path, rawArray string) (string, error) {
+	incoming := gjson.Parse(rawArray)
+	if !incoming.IsArray() {
+		return json, &errorType{"raw value must be an array"}
+	}
+	cur := gjson.Get(json, gjsonPath(path))
+	if !cur.Exists() {
+		return SetRaw(json, path, rawArray)
+	}
+	if !cur.IsArray() {
+		return json, &errorType{"value at '" + path + "' is not an array"}
+	}
+	existing, elems := cur.Array(), incoming.Array()
+	buf := []byte{'['}
+	for i := 0; i < len(existing) || i < len(elems); i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if i >= len(elems) {
+			buf = append(buf, existing[i].Raw...)
+			continue
+		}
+		raw := elems[i].Raw
+		if i < len(existing) && existing[i].IsObject() && elems[i].IsObject() {
+			raw = mergeObjects(existing[i].Raw, raw, nil)
+		}
+		buf = append(buf, raw...)
+	}
+	buf = append(buf, ']')
+	return SetRaw(json, path, string(buf))
+}
+
+// ArrayMergeMode is how Merge combines an array in the patch with an
+// existing array.
+type ArrayMergeMode int
+
+const (
+	// ReplaceArrays replaces the existing array with the array in the patch.
+	ReplaceArrays ArrayMergeMode = iota
+	// AppendArrays appends the elements of the array in the patch to the
+	// existing array.
+	AppendArrays
+	// UnionArrays appends the elements of the array in the patch that are
+	// not already in the existing array. Elements are compared using their
+	// Canonical form.
+	UnionArrays
+)
+
+// MergeOptions represents additional options for the Merge function.
+type MergeOptions struct {
+	// Arrays is how arrays are combined. The default is ReplaceArrays.
+	Arrays ArrayMergeMode
+	// DeleteNulls deletes the keys that are null in the patch, as with
+	// RFC 7386 JSON Merge Patch. By default null values are written.
+	DeleteNulls bool
+}
+
+// Merge deep merges the raw object into the object at the specified path.
+// Keys in the patch win on conflicts, except when both values are objects,
+// in which case they are merged recursively. When the path does not exist
+// the object is created. An empty path merges into the root of the json.
+// An error is returned if the raw value or the existing value isn't an
+// object.
+func Merge(json, path, rawObject string) (string, error) {
+	return MergeWithOptions(json, path, rawObject, nil)
+}
+
+// MergeWithOptions works the same as Merge with options.
+func MergeWithOptions(json, path, rawObject string,
+	opts *MergeOptions) (string, error) {
+	patch := gjson.Parse(rawObject)
+	if !patch.IsObject() {
+		return json, &errorType{"raw value must be an object"}
+	}
+	cur := gjson.Parse(json)
+	if path != "" {
+		cur = gjson.Get(json, gjsonPath(path))
+	}
+	target := "{}"
+	if cur.Exists() {
+		if !cur.IsObject() {
+			return json, &errorType{"value at '" + path + "' is not an object"}
+		}
+		target = cur.Raw
+	}
+	merged := mergeObjects(target, rawObject, opts)
+	if path == "" {
+		return merged, nil
+	}
+	return SetRaw(json, path, merged)
+}
+
+// mergeArrays appends the elements of the patch array to the target array,
+// skipping the elements that are already in the target when unique is set.
+func mergeArrays(target, patch gjson.Result, unique bool) string {
+	raw := trim(target.Raw)
+	buf := []byte(raw[:len(raw)-1]) // without the closing bracket
+	n := len(target.Array())
+	seen := make(map[string]bool)
+	if unique {
+		target.ForEach(func(_, elem gjson.Result) bool {
+			canon, _ := Canonical(elem.Raw)
+			seen[canon] = true
+			return true
+		})
+	}
+	patch.ForEach(func(_, elem gjson.Result) bool {
+		if unique {
+			canon, _ := Canonical(elem.Raw)
+			if seen[canon] {
+				return true
+			}
+			seen[canon] = true
+		}
+		if n > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, elem.Raw...)
+		n++
+		return true
+	})
+	return string(append(buf, ']'))
+}
+
+// SetReturning sets a json value for the specified path and returns the
+// updated json along with a gjson.Result of the written value. The result
+// is positioned using the location of the edit, rather than searching the
+// updated json again. For paths with '#' wildcards or queries the result
+// is the first edited value.
+func SetReturning(json, path string, value interface{}) (string,
+	gjson.Result, error) {
+	raw, stringify, del, err := encodeValue(value, nil)
+	if err != nil {
+		return json, gjson.Result{}, err
+	}
+	st := newSetState(nil)
+	res, err := set(json, path, raw, stringify, del, st)
+	if err == errNoChange {
+		return json, gjson.Result{}, nil
+	}
+	if err != nil {
+		return json, gjson.Result{}, err
+	}
+	njson := string(res)
+	var result gjson.Result
+	if st.index >= 0 {
+		result = gjson.Parse(njson[st.index:st.end])
+		result.Index = st.index
+	} else if matches, _ := expandPath(njson, path); len(matches) > 0 {
+		result = gjson.Get(njson, gjsonPath(matches[0]))
+	}
+	return njson, result, nil
+}
+
+// RenameOptions represents additional options for the RenameKeys function.
+type RenameOptions struct {
+	// LastWins resolves a rename that collides with a sibling key by keeping
+	// the last of the colliding keys, in document order, and removing the
+	// others. By default a collision returns an error.
+	LastWins bool
+}
+
+type rangeEdit struct {
+	start, end int    // range of the input being replaced
+	raw        string // replacement
+}
+
+// applyEdits replaces the ranges of the json with the edits. The edits must
+// not overlap.
+func applyEdits(json string, edits []rangeEdit) string {
+	if len(edits) == 0 {
+		return json
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start
+	})
+	var buf []byte
+	var mark int
+	for _, e := range edits {
+		buf = append(buf, json[mark:e.start]...)
+		buf = append(buf, e.raw...)
+		mark = e.end
+	}
+	buf = append(buf, json[mark:]...)
+	return string(buf)
+}
+
+// joinPath appends the path component to the path.
+func joinPath(path, comp string) string {
+	if path == "" {
+		return comp
+	}
+	return path + "." + comp
+}
+
+// RenameKeys walks the entire json and calls rename for every object key.
+// The rename function receives the path of the key and the key itself, and
+// returns the new key and true to rename it. Renamed keys keep their value
+// and position. An error is returned if a renamed key collides with a
+// sibling key.
+func RenameKeys(json string,
+	rename func(path, key string) (string, bool)) (string, error) {
+	return RenameKeysOptions(json, rename, nil)
+}
+
+// RenameKeysOptions works the same as RenameKeys with options.
+func RenameKeysOptions(json string,
+	rename func(path, key string) (string, bool),
+	opts *RenameOptions) (string, error) {
+	lastWins := opts != nil && opts.LastWins
+	edits, err := appendRenames(nil, gjson.Parse(json), "", rename, lastWins)
+	if err != nil {
+		return json, err
+	}
+	return applyEdits(json, edits), nil
+}
+
+func appendRenames(edits []rangeEdit, value gjson.Result, path string,
+	rename func(path, key string) (string, bool),
+	lastWins bool) ([]rangeEdit, error) {
+	var err error
+	if value.IsArray() {
+		var i int
+		value.ForEach(func(_, value gjson.Result) bool {
+			edits, err = appendRenames(edits, value,
+				joinPath(path, strconv.Itoa(i)), rename, lastWins)
+			i++
+			return err == nil
+		})
+		return edits, err
+	}
+	if !value.IsObject() {
+		return edits, nil
+	}
+	type entry struct {
+		key, value gjson.Result
+		name       string
+		renamed    bool
+	}
+	var entries []entry
+	last := make(map[string]int)
+	renamed := make(map[string]bool)
+	value.ForEach(func(key, value gjson.Result) bool {
+		e := entry{key: key, value: value, name: key.Str}
+		name, ok := rename(joinPath(path, PathForKeys(key.Str)), key.Str)
+		if ok && name != key.Str {
+			e.name, e.renamed = name, true
+			renamed[name] = true
+		}
+		last[e.name] = len(entries)
+		entries = append(entries, e)
+		return true
+	})
+	for i, e := range entries {
+		if last[e.name] != i && renamed[e.name] {
+			if !lastWins {
+				return edits, &errorType{"renaming key '" + e.key.Str +
+					"' to '" + e.name + "' collides with a sibling key"}
+			}
+			// remove the entry up to the start of the next key
+			edits = append(edits, rangeEdit{start: e.key.Index,
+				end: entries[i+1].key.Index})
+			continue
+		}
+		if e.renamed {
+			edits = append(edits, rangeEdit{start: e.key.Index,
+				end: e.key.Index + len(e.key.Raw),
+				raw: string(appendStringify(nil, e.name))})
+		}
+		edits, err = appendRenames(edits, e.value,
+			joinPath(path, PathForKeys(e.key.Str)), rename, lastWins)
+		if err != nil {
+			return edits, err
+		}
+	}
+	return edits, nil
+}
+
+// SetAllSuffix walks the entire json and sets the value of every object
+// field whose key equals keySuffix, at any depth, including fields of
+// objects inside of arrays. Only existing fields are updated, missing keys
+// are never created. A matched field's value is replaced as a whole, so
+// fields nested inside of it are not visited.
+func SetAllSuffix(json, keySuffix string, value interface{}) (string, error) {
+	raw, stringify, _, err := encodeValue(value, nil)
+	if err != nil {
+		return json, err
+	}
+	if stringify {
+		raw = string(appendStringify(nil, raw))
+	}
+	edits := appendKeyEdits(nil, gjson.Parse(json), keySuffix, raw)
+	return applyEdits(json, edits), nil
+}
+
+// SetAllSuffixBytes sets the value of every object field with the key.
+// If working with bytes, this method preferred over
+// SetAllSuffix(string(data), keySuffix, value)
+func SetAllSuffixBytes(json []byte, keySuffix string,
+	value interface{}) ([]byte, error) {
+	res, err := SetAllSuffix(string(json), keySuffix, value)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+func appendKeyEdits(edits []rangeEdit, value gjson.Result, key,
+	raw string) []rangeEdit {
+	obj := value.IsObject()
+	value.ForEach(func(k, v gjson.Result) bool {
+		if obj && k.Str == key {
+			edits = append(edits, rangeEdit{v.Index, v.Index + len(v.Raw), raw})
+		} else if v.IsObject() || v.IsArray() {
+			edits = appendKeyEdits(edits, v, key, raw)
+		}
+		return true
+	})
+	return edits
+}
+
+// Flatten returns every leaf value of the json, keyed by its path. Object
+// keys are escaped and array elements use numeric indexes, so each path can
+// be passed straight back to Set. Empty objects and arrays are leaf values.
+// Numbers are json.Number values, so they keep their full precision.
+//
+//	{"a":{"b":1},"c":["x"]}  >> {"a.b":1,"c.0":"x"}
+//
+// An error is returned if the json isn't a valid object or array.
+func Flatten(json string) (map[string]interface{}, error) {
+	if !gjson.Valid(json) {
+		return nil, &errorType{"invalid json"}
+	}
+	res := gjson.Parse(json)
+	if !res.IsObject() && !res.IsArray() {
+		return nil, &errorType{"json must be an object or array"}
+	}
+	flat := make(map[string]interface{})
+	flatten(flat, res, "")
+	return flat, nil
+}
+
+func flatten(flat map[string]interface{}, res gjson.Result, path string) {
+	empty := true
+	var i int
+	res.ForEach(func(key, value gjson.Result) bool {
+		empty = false
+		comp := strconv.Itoa(i)
+		if res.IsObject() {
+			comp = PathForKeys(key.Str)
+		}
+		i++
+		if value.IsObject() || value.IsArray() {
+			flatten(flat, value, joinPath(path, comp))
+		} else if value.Type == gjson.Number {
+			flat[joinPath(path, comp)] = jsongo.Number(value.Raw)
+		} else {
+			flat[joinPath(path, comp)] = value.Value()
+		}
+		return true
+	})
+	if empty && path != "" {
+		flat[path] = res.Value()
+	}
+}
+
+// CompactOptions represents the values that are removed by Compact.
+type CompactOptions struct {
+	EmptyStrings bool // remove ""
+	EmptyArrays  bool // remove []
+	EmptyObjects bool // remove {}
+	Nulls        bool // remove null
+	Zeros        bool // remove numbers equal to zero
+	// EmptyObjectElements also removes array elements that are empty
+	// objects. By default only object keys are removed.
+	EmptyObjectElements bool
+}
+
+// Compact walks the entire json and removes the object keys whose values
+// are empty, as selected by opts. Values are checked after their children
+// have been compacted, so an object that only holds empty values is itself
+// empty. Objects and arrays that have been changed are written without
+// whitespace, everything else is left as-is.
+//
+//	{"a":"","b":{"c":null},"d":1}  >> {"d":1}
+//
+// An error is returned if the json isn't valid.
+func Compact(json string, opts CompactOptions) (string, error) {
+	if !gjson.Valid(json) {
+		return json, &errorType{"invalid json"}
+	}
+	res := gjson.Parse(json)
+	raw := compactValue(res, &opts)
+	if raw == res.Raw {
+		return json, nil
+	}
+	return json[:res.Index] + raw + json[res.Index+len(res.Raw):], nil
+}
+
+// CompactBytes removes the empty values from the json.
+// If working with bytes, this method preferred over
+// Compact(string(data), opts)
+func CompactBytes(json []byte, opts CompactOptions) ([]byte, error) {
+	res, err := Compact(string(json), opts)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+// compactValue returns the value with its empty children removed.
+func compactValue(value gjson.Result, opts *CompactOptions) string {
+	if !value.IsObject() && !value.IsArray() {
+		return value.Raw
+	}
+	obj := value.IsObject()
+	buf := []byte{value.Raw[0]}
+	var changed bool
+	value.ForEach(func(key, value gjson.Result) bool {
+		raw := compactValue(value, opts)
+		if raw != value.Raw {
+			changed = true
+			value = gjson.Parse(raw)
+		}
+		if (obj && isCompactEmpty(value, opts)) || (!obj &&
+			opts.EmptyObjectElements && value.IsObject() &&
+			isEmptyContainer(value)) {
+			changed = true
+			return true
+		}
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		if obj {
+			buf = append(buf, key.Raw...)
+			buf = append(buf, ':')
+		}
+		buf = append(buf, raw...)
+		return true
+	})
+	if !changed {
+		return value.Raw
+	}
+	return string(append(buf, value.Raw[len(value.Raw)-1]))
+}
+
+func isEmptyContainer(value gjson.Result) bool {
+	empty := true
+	value.ForEach(func(_, _ gjson.Result) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
+
+// isCompactEmpty returns true if the value is removed by the options.
+func isCompactEmpty(value gjson.Result, opts *CompactOptions) bool {
+	switch value.Type {
+	case gjson.Null:
+		return opts.Nulls
+	case gjson.String:
+		return opts.EmptyStrings && value.Str == ""
+	case gjson.Number:
+		return opts.Zeros && value.Num == 0
+	}
+	if value.IsArray() {
+		return opts.EmptyArrays && isEmptyContainer(value)
+	}
+	if value.IsObject() {
+		return opts.EmptyObjects && isEmptyContainer(value)
+	}
+	return false
+}
+
+// Canonical returns the json in a canonical form, suitable for comparing or
+// signing documents. The canonical form has:
+//
+//   - no whitespace
+//   - object keys sorted by the bytes of their unescaped keys, recursively
+//   - array elements in their original order
+//   - numbers in their shortest round-trip form, as written by
+//     encoding/json for a float64, such as 1.0 >> 1, 1e2 >> 100, and
+//     1e21 >> 1e+21. Negative zero is written as 0.
+//   - strings escaped only where required, using the short escapes \b, \f,
+//     \n, \r, \t, \", and \\, and \u00XX for other control characters
+//
+// Numbers are converted to float64, so integers beyond 2^53 may lose
+// precision. An error is returned if the json isn't valid.
+func Canonical(json string) (string, error) {
+	if !gjson.Valid(json) {
+		return json, &errorType{"invalid json"}
+	}
+	buf, err := appendCanonical(nil, gjson.Parse(json))
+	if err != nil {
+		return json, err
+	}
+	return string(buf), nil
+}
+
+func appendCanonical(buf []byte, value gjson.Result) ([]byte, error) {
+	switch {
+	case value.IsObject():
+		var keys, values []gjson.Result
+		value.ForEach(func(key, value gjson.Result) bool {
+			keys = append(keys, key)
+			values = append(values, value)
+			return true
+		})
+		idxs := make([]int, len(keys))
+		for i := range idxs {
+			idxs[i] = i
+		}
+		sort.SliceStable(idxs, func(i, j int) bool {
+			return keys[idxs[i]].Str < keys[idxs[j]].Str
+		})
+		buf = append(buf, '{')
+		for i, idx := range idxs {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendCanonicalString(buf, keys[idx].Str)
+			buf = append(buf, ':')
+			var err error
+			buf, err = appendCanonical(buf, values[idx])
+			if err != nil {
+				return buf, err
+			}
+		}
+		return append(buf, '}'), nil
+	case value.IsArray():
+		buf = append(buf, '[')
+		var err error
+		var i int
+		value.ForEach(func(_, value gjson.Result) bool {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			i++
+			buf, err = appendCanonical(buf, value)
+			return err == nil
+		})
+		if err != nil {
+			return buf, err
+		}
+		return append(buf, ']'), nil
+	case value.Type == gjson.String:
+		return appendCanonicalString(buf, value.Str), nil
+	case value.Type == gjson.Number:
+		f, err := strconv.ParseFloat(value.Raw, 64)
+		if err != nil {
+			return buf, &errorType{"invalid number '" + value.Raw + "'"}
+		}
+		if f == 0 {
+			return append(buf, '0'), nil
+		}
+		b, err := jsongo.Marshal(f)
+		if err != nil {
+			return buf, err
+		}
+		return append(buf, b...), nil
+	}
+	return append(buf, value.Raw...), nil
+}
+
+// appendCanonicalString appends the string as json, escaping only the
+// characters that must be escaped.
+func appendCanonicalString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\b':
+			buf = append(buf, '\\', 'b')
+		case '\f':
+			buf = append(buf, '\\', 'f')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			if c < ' ' {
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+	return append(buf, '"')
+}
+
+// PushUnique appends the value to the array at the specified path, unless
+// the array already has an equal element, in which case false is returned.
+// Elements are compared using their Canonical form, so formatting, key
+// order, and number notation don't matter. When the path does not exist a
+// new array is created.
+// An error is returned if the existing value isn't an array.
+func PushUnique(json, path string, value interface{}) (string, bool, error) {
+	raw, stringify, _, err := encodeValue(value, nil)
+	if err != nil {
+		return json, false, err
+	}
+	if stringify {
+		raw = string(appendStringify(nil, raw))
+	}
+	return PushUniqueRaw(json, path, raw)
+}
+
+// PushUniqueRaw works the same as PushUnique, except that the value is a
+// raw block of json.
+func PushUniqueRaw(json, path, value string) (string, bool, error) {
+	canon, err := Canonical(value)
+	if err != nil {
+		return json, false, err
+	}
+	arr := gjson.Get(json, gjsonPath(path))
+	if arr.Exists() && !arr.IsArray() {
+		return json, false, &errorType{"value at '" + path +
+			"' is not an array"}
+	}
+	var found bool
+	arr.ForEach(func(_, elem gjson.Result) bool {
+		ecanon, err := Canonical(elem.Raw)
+		found = err == nil && ecanon == canon
+		return !found
+	})
+	if found {
+		return json, false, nil
+	}
+	res, err := SetRaw(json, path+".-1", value)
+	if err != nil {
+		return json, false, err
+	}
+	return res, true, nil
+}
+
+// EnsureArrayPush appends the value to the array at the specified path,
+// which is useful for fields that may hold either a single value or an
+// array of values. When the path does not exist a new array is created with
+// the value, when the existing value is an array the value is appended, and
+// any other existing value, including objects and null, is first wrapped
+// into an array, such that `x` becomes `[x,value]`.
+func EnsureArrayPush(json, path string, value interface{}) (string, error) {
+	raw, stringify, _, err := encodeValue(value, nil)
+	if err != nil {
+		return json, err
+	}
+	if stringify {
+		raw = string(appendStringify(nil, raw))
+	}
+	cur := gjson.Get(json, gjsonPath(path))
+	if !cur.Exists() || cur.IsArray() {
+		return SetRaw(json, path+".-1", raw)
+	}
+	return SetRaw(json, path, "["+cur.Raw+","+raw+"]")
+}
+
+// SortedOptions represents additional options for the SetSorted function.
+type SortedOptions struct {
+	// MissingKeyError returns an error when the inserted element does not
+	// have the sort key. By default the element is inserted after all of the
+	// elements that have the sort key.
+	MissingKeyError bool
+}
+
+// SetSorted inserts the raw json element into the array at arrayPath at the
+// position that keeps the array sorted in ascending order by the sortKey
+// field of each element, which is a gjson path. The array is expected to
+// already be sorted.
+//
+// Values are compared using gjson's Result.Less, case-sensitive, so numbers
+// compare numerically, strings compare by bytes, and values of different
+// types order as null, false, numbers, strings, true, then objects and
+// arrays. The element is inserted after existing elements with an equal
+// sort key. Elements without the sort key are sorted last.
+// When the path does not exist a new array is created. An empty arrayPath
+// is the root array of the document.
+func SetSorted(json, arrayPath, raw, sortKey string) (string, error) {
+	return SetSortedOptions(json, arrayPath, raw, sortKey, nil)
+}
+
+// SetSortedOptions works the same as SetSorted with options.
+func SetSortedOptions(json, arrayPath, raw, sortKey string,
+	opts *SortedOptions) (string, error) {
+	key := gjson.Get(raw, sortKey)
+	if !key.Exists() && opts != nil && opts.MissingKeyError {
+		return json, &errorType{"element does not have the sort key '" +
+			sortKey + "'"}
+	}
+	var arr gjson.Result
+	if arrayPath == "" {
+		arr = gjson.Parse(json)
+	} else {
+		arr = gjson.Get(json, gjsonPath(arrayPath))
+	}
+	if arr.Exists() && !arr.IsArray() {
+		return json, &errorType{"value at '" + arrayPath +
+			"' is not an array"}
+	}
+	var at gjson.Result
+	if key.Exists() {
+		arr.ForEach(func(_, elem gjson.Result) bool {
+			ekey := elem.Get(sortKey)
+			if !ekey.Exists() || key.Less(ekey, true) {
+				at = elem
+				return false
+			}
+			return true
+		})
+	}
+	if at.Index == 0 {
+		if arrayPath == "" && !arr.Exists() {
+			return SetRaw(json, "", "["+raw+"]")
+		}
+		return SetRaw(json, joinPath(arrayPath, "-1"), raw)
+	}
+	return json[:at.Index] + raw + "," + json[at.Index:], nil
+}
+
+// Add adds the value to the container at the specified path, following the
+// "add" operation of JSON Patch. The decision rule is:
+//
+//   - array and key is "" or "-": the value is appended
+//   - array and key is an index: the value is inserted at the index,
+//     shifting the following elements. The index may equal the length.
+//   - object: the value is set at key, replacing any existing value. The
+//     key is a literal key, and is never treated as a path.
+//   - missing: a new array holding the value is created when key is "",
+//     otherwise a new object with the key is created.
+//
+// An error is returned if the value at path isn't an array or object, if
+// the key is empty for an object, or if the index is out of range.
+func Add(json, path string, keyOrNothing string, value interface{}) (string,
+	error) {
+	target := gjson.Get(json, gjsonPath(path))
+	key := keyOrNothing
+	switch {
+	case !target.Exists() && key == "", target.IsArray() &&
+		(key == "" || key == "-"):
+		return Set(json, path+".-1", value)
+	case !target.Exists(), target.IsObject():
+		if key == "" {
+			return json, &errorType{"key is required to add to an object"}
+		}
+		return Set(json, path+"."+PathForKeys(key), value)
+	case target.IsArray():
+		n, err := strconv.Atoi(key)
+		if err != nil || n < 0 || strings.HasPrefix(key, "+") {
+			return json, &errorType{"invalid array index '" + key + "'"}
+		}
+		var at gjson.Result
+		var i int
+		target.ForEach(func(_, elem gjson.Result) bool {
+			if i == n {
+				at = elem
+			}
+			i++
+			return i <= n
+		})
+		if n > i {
+			return json, &errorType{"array index " + key + " is out of range"}
+		}
+		if n == i {
+			return Set(json, path+".-1", value)
+		}
+		raw, stringify, _, err := encodeValue(value, nil)
+		if err != nil {
+			return json, err
+		}
+		if stringify {
+			raw = string(appendStringify(nil, raw))
+		}
+		return json[:at.Index] + raw + "," + json[at.Index:], nil
+	}
+	return json, &errorType{"value at '" + path +
+		"' is not an array or object"}
+}
+
+// SetComputed sets the value for the specified path to the value returned
+// by fn, which is passed the parsed json document. This allows for keeping
+// derived fields, such as totals, up to date with a single extra parse.
+// An error returned by fn is returned as is.
+func SetComputed(json, path string,
+	fn func(doc gjson.Result) (interface{}, error)) (string, error) {
+	value, err := fn(gjson.Parse(json))
+	if err != nil {
+		return json, err
+	}
+	return Set(json, path, value)
+}
+
+// valueLen returns the length of the json value at the start of s, without
+// validating the value.
+func valueLen(s string) int {
+	var depth int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if depth == 0 {
+				return min(i+1, len(s))
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth <= 0 {
+				return i + 1
+			}
+		case ' ', '\t', '\r', '\n', ',', ':':
+			if depth == 0 {
+				return max(i, 1)
+			}
+		}
+	}
+	return len(s)
+}
+
+// SetConcatenated sets a json value for the specified path in each of the
+// json values of a stream of concatenated values, such as `{"a":1}{"a":2}`
+// or values separated by whitespace or newlines. The separators between the
+// values, which are the whitespace characters space, tab, carriage return,
+// and newline, are preserved exactly. Any other character between values
+// is an error, as is a value that isn't valid json.
+func SetConcatenated(input string, path string, value interface{},
+	opts *Options) (string, error) {
+	var buf []byte
+	var n int
+	for i := 0; i < len(input); {
+		if input[i] <= ' ' {
+			if input[i] != ' ' && input[i] != '\t' && input[i] != '\r' &&
+				input[i] != '\n' {
+				return input, &errorType{"malformed stream at offset " +
+					strconv.Itoa(i)}
+			}
+			buf = append(buf, input[i])
+			i++
+			continue
+		}
+		raw := input[i : i+valueLen(input[i:])]
+		if !gjson.Valid(raw) {
+			return input, &errorType{"malformed stream value at offset " +
+				strconv.Itoa(i)}
+		}
+		res, err := SetOptions(raw, path, value, opts)
+		if err != nil {
+			return input, &errorType{"stream value " + strconv.Itoa(n) +
+				": " + err.Error()}
+		}
+		buf = append(buf, res...)
+		i += len(raw)
+		n++
+	}
+	return string(buf), nil
+}
+
+// SetWhereIndex sets the value for the subPath of each element of the array
+// at arrayPath whose index satisfies pred, such as every even index. When
+// subPath is empty the whole element is set. All of the elements are
+// written in a single pass.
+// An error is returned if the value at arrayPath isn't an array.
+func SetWhereIndex(json, arrayPath string, pred func(i int) bool,
+	subPath string, value interface{}) (string, error) {
+	arr := gjson.Get(json, gjsonPath(arrayPath))
+	if !arr.IsArray() {
+		return json, &errorType{"value at '" + arrayPath +
+			"' is not an array"}
+	}
+	raw, stringify, del, err := encodeValue(value, nil)
+	if err != nil {
+		return json, err
+	}
+	if stringify {
+		raw, stringify = string(appendStringify(nil, raw)), false
+	}
+	var edits []rangeEdit
+	var keep []string
+	var i int
+	arr.ForEach(func(_, elem gjson.Result) bool {
+		match := pred(i)
+		i++
+		if !match {
+			keep = append(keep, elem.Raw)
+			return true
+		}
+		if subPath == "" {
+			if !del {
+				edits = append(edits, rangeEdit{elem.Index,
+					elem.Index + len(elem.Raw), raw})
+			}
+			return true
+		}
+		var nelem []byte
+		nelem, err = set(elem.Raw, subPath, raw, stringify, del,
+			newSetState(nil))
+		nelem, err = finish([]byte(elem.Raw), nelem, err, nil)
+		if err != nil {
+			return false
+		}
+		edits = append(edits, rangeEdit{elem.Index,
+			elem.Index + len(elem.Raw), string(nelem)})
+		return true
+	})
+	if err != nil {
+		return json, err
+	}
+	if del && subPath == "" {
+		if len(keep) == i {
+			return json, nil
+		}
+		// rebuild the array without the deleted elements
+		return json[:arr.Index] + "[" + strings.Join(keep, ",") + "]" +
+			json[arr.Index+len(arr.Raw):], nil
+	}
+	return applyEdits(json, edits), nil
+}
+
+// SetWhereIndexBytes sets the value for the subPath of each element of the
+// array whose index satisfies pred.
+// If working with bytes, this method preferred over
+// SetWhereIndex(string(data), arrayPath, pred, subPath, value)
+func SetWhereIndexBytes(json []byte, arrayPath string, pred func(i int) bool,
+	subPath string, value interface{}) ([]byte, error) {
+	res, err := SetWhereIndex(string(json), arrayPath, pred, subPath, value)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+// DeleteWhereIndex deletes the subPath of each element of the array at
+// arrayPath whose index satisfies pred. When subPath is empty the elements
+// themselves are removed from the array.
+func DeleteWhereIndex(json, arrayPath string, pred func(i int) bool,
+	subPath string) (string, error) {
+	return SetWhereIndex(json, arrayPath, pred, subPath, dtype{})
+}
+
+// SetArraySize resizes the array at the specified path to exactly size
+// elements. Short arrays are padded with null, and long arrays are
+// truncated. When the path does not exist a new array of nulls is created.
+// An error is returned if the existing value isn't an array.
+func SetArraySize(json, path string, size int) (string, error) {
+	return SetArraySizeFill(json, path, size, "null")
+}
+
+// SetArraySizeFill works the same as SetArraySize, except that short arrays
+// are padded with the fill raw json value rather than null.
+func SetArraySizeFill(json, path string, size int, fill string) (string,
+	error) {
+	if size < 0 {
+		return json, &errorType{"array size cannot be negative"}
+	}
+	var elems []gjson.Result
+	if cur := gjson.Get(json, gjsonPath(path)); cur.Exists() {
+		if !cur.IsArray() {
+			return json, &errorType{"value at '" + path + "' is not an array"}
+		}
+		elems = cur.Array()
+	}
+	buf := []byte{'['}
+	for i := 0; i < size; i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if i < len(elems) {
+			buf = append(buf, elems[i].Raw...)
+		} else {
+			buf = append(buf, fill...)
+		}
+	}
+	buf = append(buf, ']')
+	return SetRaw(json, path, string(buf))
+}
+
+// SetArraySizeBytes resizes the array at the specified path.
+// If working with bytes, this method preferred over
+// SetArraySize(string(data), path, size)
+func SetArraySizeBytes(json []byte, path string, size int) ([]byte, error) {
+	res, err := SetArraySize(string(json), path, size)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+// DeleteElementWhere deletes every element of the array at the specified
+// path that satisfies the predicate. The predicate uses the gjson query
+// syntax and may refer to nested fields of the element, such as
+// `meta.bad=true`. An empty path refers to a root array.
+func DeleteElementWhere(json, arrayPath, predicate string) (string, error) {
+	return DeleteIf(json, joinPath(arrayPath, "#"), predicate)
+}
+
+// Codec compresses and decompresses the embedded json used by
+// SetInCompressed.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCodec is a Codec using the gzip format.
+var GzipCodec Codec = gzipCodec{}
+
+// FlateCodec is a Codec using the raw deflate format.
+var FlateCodec Codec = flateCodec{}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// SetInCompressed sets a value inside of a json document that is stored
+// compressed and base64 encoded in the string at fieldPath. The embedded
+// document is decoded and decompressed with the codec, the value is set at
+// innerPath, and the document is compressed and encoded back into the
+// field.
+// An error is returned if the field isn't a string, or if the decompressed
+// content isn't valid json.
+func SetInCompressed(json, fieldPath, innerPath string, value interface{},
+	codec Codec) (string, error) {
+	return SetInEncoded(json, fieldPath, innerPath, value,
+		func(data []byte) ([]byte, error) {
+			data, err := base64.StdEncoding.AppendDecode(nil, data)
+			if err != nil {
+				return nil, err
+			}
+			return codec.Decompress(data)
+		},
+		func(data []byte) ([]byte, error) {
+			data, err := codec.Compress(data)
+			if err != nil {
+				return nil, err
+			}
+			return base64.StdEncoding.AppendEncode(nil, data), nil
+		})
+}
+
+// SetInEncoded sets a value inside of a json document that is stored in
+// the string at fieldPath in an encoded form, such as base64, compressed,
+// or encrypted. The string is decoded with decode, the value is set at
+// innerPath, and the document is encoded with encode and written back into
+// the field as a json string.
+// An error is returned if the field isn't a string, if the decoded content
+// isn't valid json, or if decode or encode return an error.
+func SetInEncoded(json, fieldPath, innerPath string, value interface{},
+	decode func([]byte) ([]byte, error),
+	encode func([]byte) ([]byte, error)) (string, error) {
+	field := gjson.Get(json, gjsonPath(fieldPath))
+	if field.Type != gjson.String {
+		return json, &errorType{"value at '" + fieldPath + "' is not a string"}
+	}
+	data, err := decode([]byte(field.Str))
+	if err != nil {
+		return json, err
+	}
+	if !gjson.ValidBytes(data) {
+		return json, &errorType{"value at '" + fieldPath +
+			"' does not contain valid json"}
+	}
+	data, err = SetBytes(data, innerPath, value)
+	if err != nil {
+		return json, err
+	}
+	data, err = encode(data)
+	if err != nil {
+		return json, err
+	}
+	return Set(json, fieldPath, string(data))
+}
+
+// MoveElement moves the array element at index from to index to, shifting
+// the elements in between. The to index is the position of the element
+// after the move, so MoveElement(json, path, 0, 2) on [a,b,c] results in
+// [b,c,a]. Negative indexes count from the end of the array, where -1 is
+// the last element. The raw encoding of every element is preserved.
+// An error is returned if the value isn't an array or if an index is out of
+// range.
+func MoveElement(json, path string, from, to int) (string, error) {
+	cur := gjson.Get(json, gjsonPath(path))
+	if !cur.IsArray() {
+		return json, &errorType{"value at '" + path + "' is not an array"}
+	}
+	elems := cur.Array()
+	if from < 0 {
+		from += len(elems)
+	}
+	if to < 0 {
+		to += len(elems)
+	}
+	if from < 0 || from >= len(elems) || to < 0 || to >= len(elems) {
+		return json, &errorType{"array index out of range"}
+	}
+	if from == to {
+		return json, nil
+	}
+	elem := elems[from]
+	if from < to {
+		copy(elems[from:], elems[from+1:to+1])
+	} else {
+		copy(elems[to+1:], elems[to:from])
+	}
+	elems[to] = elem
+	buf := []byte{'['}
+	for i, elem := range elems {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, elem.Raw...)
+	}
+	buf = append(buf, ']')
+	return SetRaw(json, path, string(buf))
+}
+
+// MoveElementBytes moves an array element within the same array.
+// If working with bytes, this method preferred over
+// MoveElement(string(data), path, from, to)
+func MoveElementBytes(json []byte, path string, from, to int) ([]byte, error) {
+	res, err := MoveElement(string(json), path, from, to)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+// Reparent moves the value at fromPath to the object at toParentPath,
+// keeping its key name. For example, moving "a.token" to "b" results in
+// "b.token". The raw value is moved as-is.
+// An error is returned if the value does not exist, if it is not an object
+// member, if the target is not an object, or if the target already has a
+// member with the same key, or if fromPath has wildcards, queries, or glob
+// keys.
+func Reparent(json, fromPath, toParentPath string) (string, error) {
+	comps, err := splitComponents(fromPath)
+	if err != nil {
+		return json, err
+	}
+	for _, comp := range comps {
+		switch kind, _ := classifyComponent(comp); kind {
+		case WildcardSegment, QuerySegment, GlobSegment:
+			return json, &errorType{"path '" + fromPath +
+				"' must name a single value"}
+		}
+	}
+	comp := comps[len(comps)-1]
+	if kind, _ := classifyComponent(comp); kind != KeySegment {
+		return json, &errorType{"value at '" + fromPath +
+			"' is not an object member"}
+	}
+	res := gjson.Get(json, gjsonPath(fromPath))
+	if !res.Exists() {
+		return json, &errorType{"value at '" + fromPath + "' does not exist"}
+	}
+	if toParentPath == fromPath ||
+		strings.HasPrefix(toParentPath, fromPath+".") {
+		return json, &errorType{"cannot move '" + fromPath +
+			"' into itself"}
+	}
+	if !gjson.Get(json, gjsonPath(toParentPath)).IsObject() {
+		return json, &errorType{"value at '" + toParentPath +
+			"' is not an object"}
+	}
+	toPath := toParentPath + "." + comp
+	if toPath == fromPath {
+		return json, nil
+	}
+	if gjson.Get(json, gjsonPath(toPath)).Exists() {
+		return json, &errorType{"value at '" + toPath + "' already exists"}
+	}
+	out, err := Delete(json, fromPath)
+	if err != nil {
+		return json, err
+	}
+	out, err = SetRaw(out, toPath, res.Raw)
+	if err != nil {
+		return json, err
+	}
+	return out, nil
+}
+
+// ReparentBytes moves the value at fromPath to the object at toParentPath.
+// If working with bytes, this method preferred over
+// Reparent(string(data), fromPath, toParentPath)
+func ReparentBytes(json []byte, fromPath, toParentPath string) ([]byte,
+	error) {
+	res, err := Reparent(string(json), fromPath, toParentPath)
+	if err != nil {
+		return json, err
+	}
+	return []byte(res), nil
+}
+
+// SegmentKind is the kind of a path component.
+type SegmentKind int
+
+const (
+	// KeySegment is an object key, such as "name" or ":2313".
+	KeySegment SegmentKind = iota
+	// IndexSegment is an array index, such as "2".
+	IndexSegment
+	// AppendSegment is the "-1" component, which appends to an array.
+	AppendSegment
+	// WildcardSegment is the '#' component, which matches every element of
+	// an array.
+	WildcardSegment
+	// QuerySegment is a '#(...)' or '#(...)#' query component.
+	QuerySegment
+	// GlobSegment is an object key with a '*' or '?' pattern, such as
+	// "user*", which matches every key of an object that fits the pattern.
+	GlobSegment
+	// EmbeddedSegment is the "@json" component, which edits the json that
+	// is embedded in the string value of the path before it.
+	EmbeddedSegment
+)
+
+// String returns the name of the kind.
+func (kind SegmentKind) String() string {
+	switch kind {
+	case KeySegment:
+		return "key"
+	case IndexSegment:
+		return "index"
+	case AppendSegment:
+		return "append"
+	case WildcardSegment:
+		return "wildcard"
+	case QuerySegment:
+		return "query"
+	case GlobSegment:
+		return "glob"
+	case EmbeddedSegment:
+		return "embedded"
+	default:
+		return "unknown"
+	}
+}
+
+// splitComponents splits the path into its raw components, leaving escape
+// characters and queries intact.
+func splitComponents(path string) ([]string, error) {
+	if path == "" {
+		return nil, newPathError(path, 0, "path cannot be empty")
+	}
+	var comps []string
+	var start, depth, open int
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			i++
+		case '(':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, newPathError(path, i, "unexpected ')'")
+			}
+		case '"':
+			if depth > 0 {
+				for i++; i < len(path) && path[i] != '"'; i++ {
+					if path[i] == '\\' {
+						i++
+					}
+				}
+			}
+		case '.':
+			if depth == 0 {
+				comps = append(comps, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth > 0 {
+		return nil, newPathError(path, open, "unterminated query")
+	}
+	return append(comps, path[start:]), nil
+}
+
+// classifyComponent returns the kind of a raw path component and its key,
+// which has the escape characters and forcing colon removed.
+func classifyComponent(comp string) (SegmentKind, string) {
+	if comp == "#" {
+		return WildcardSegment, comp
+	}
+	if strings.HasPrefix(comp, "#(") {
+		return QuerySegment, comp
+	}
+	if comp == "@json" {
+		return EmbeddedSegment, comp
+	}
+	if isGlobComponent(comp) {
+		return GlobSegment, comp
+	}
+	r, simple := parsePath(comp)
+	if !simple {
+		return KeySegment, unescapeComponent(comp)
+	}
+	if _, numeric := atoui(r); numeric {
+		return IndexSegment, r.part
+	}
+	if !r.force && r.part == "-1" {
+		return AppendSegment, r.part
+	}
+	return KeySegment, r.part
+}
+
+// unescapeComponent removes the escape characters and forcing colon from a
+// raw path component.
+func unescapeComponent(comp string) string {
+	comp = strings.TrimPrefix(comp, ":")
+	if !strings.Contains(comp, "\\") {
+		return comp
+	}
+	key := make([]byte, 0, len(comp))
+	for i := 0; i < len(comp); i++ {
+		if comp[i] == '\\' && i+1 < len(comp) {
+			i++
+		}
+		key = append(key, comp[i])
+	}
+	return string(key)
+}
+
+// Segment is a single parsed component of a path.
+type Segment struct {
+	Kind SegmentKind // kind of component
+	// Key is the key or index with the escape characters and forcing colon
+	// removed. For the other kinds it's the same as Raw.
+	Key string
+	Raw string // raw path component
+}
+
+// ParsePath parses a path into its components, using the same rules as Set.
+// An empty path, which refers to the document root, has no components.
+// A *PathError is returned for unterminated queries, and for pipes and
+// modifiers other than "@json", which Set cannot edit through.
+//
+//	sjson.ParsePath(`friends.#(last=="Murphy").nick\.name`)
+//	  >> query `#(last=="Murphy")`, key "nick.name"
+func ParsePath(path string) ([]Segment, error) {
+	if path == "" {
+		return nil, nil
+	}
+	comps, err := splitComponents(path)
+	if err != nil {
+		return nil, err
+	}
+	segs := make([]Segment, 0, len(comps))
+	var pos int
+	for _, comp := range comps {
+		kind, key := classifyComponent(comp)
+		if kind == KeySegment && (comp[0] == '@' || hasPipe(comp)) {
+			return nil, newPathError(path, pos,
+				"modifiers and pipes are not supported")
+		}
+		segs = append(segs, Segment{Kind: kind, Key: key, Raw: comp})
+		pos += len(comp) + 1
+	}
+	return segs, nil
+}
+
+// hasPipe returns true if the raw path component has an unescaped '|'.
+func hasPipe(comp string) bool {
+	for i := 0; i < len(comp); i++ {
+		switch comp[i] {
+		case '\\':
+			i++
+		case '|':
+			return true
+		}
+	}
+	return false
+}
+
+// EditPlan describes how a path is interpreted against a json document.
+type EditPlan struct {
+	Path  string
+	Steps []PlanStep
+}
+
+// PlanStep describes a single path component of an EditPlan.
+type PlanStep struct {
+	Component string      // raw path component
+	Key       string      // key or index, without escape characters
+	Kind      SegmentKind // kind of component
+	// Exists is true when the component matches an existing value. Steps
+	// that don't exist will be created by Set.
+	Exists bool
+	// Index and Len are the byte range of the matched value in the json,
+	// or -1 and 0 when the component doesn't exist. For wildcards, queries,
+	// and globs the first match is used, and the steps that follow are
+	// resolved against it.
+	Index int
+	Len   int
+}
+
+// Plan returns an EditPlan that describes how the path will be interpreted
+// for the json, without making any changes.
+func Plan(json, path string) (*EditPlan, error) {
+	return PlanOptions(json, path, nil)
+}
+
+// PlanOptions is the same as Plan, but the path is interpreted as Set would
+// with the options, such as ForceObjectKeys and CaseInsensitiveKeys.
+func PlanOptions(json, path string, opts *Options) (*EditPlan, error) {
+	comps, err := splitComponents(path)
+	if err != nil {
+		return nil, err
+	}
+	st := newSetState(opts)
+	plan := &EditPlan{Path: path}
+	cur, base := json, 0
+	root := gjson.Parse(json)
+	exists := root.IsObject() || root.IsArray()
+	for i, comp := range comps {
+		step := PlanStep{Component: comp, Index: -1}
+		step.Kind, step.Key = classifyComponent(comp)
+		var container gjson.Result
+		if exists {
+			container = gjson.Parse(cur)
+		}
+		switch step.Kind {
+		case IndexSegment, AppendSegment:
+			// Set uses numbers and "-1" as keys of an object
+			if container.IsObject() || (opts != nil && opts.ForceObjectKeys) {
+				step.Kind = KeySegment
+			}
+		}
+		var res gjson.Result
+		if exists {
+			switch step.Kind {
+			case WildcardSegment, QuerySegment, GlobSegment:
+				// the first of the concrete paths that Set would edit
+				paths := expandQueries(nil, cur, "", comps[i:])
+				if len(paths) > 0 {
+					first, _ := splitComponents(paths[0])
+					res = gjson.Get(cur, gjsonPath(first[0]))
+				}
+			case EmbeddedSegment:
+			default:
+				r, simple := parsePath(comp)
+				if simple {
+					r.force = r.force || (opts != nil && opts.ForceObjectKeys)
+					res = st.lookup(cur, r, false)
+				} else {
+					res = gjson.Get(cur, comp)
+				}
+			}
+		}
+		if res.Index > 0 {
+			step.Exists, step.Index, step.Len = true, base+res.Index,
+				len(res.Raw)
+			cur, base = res.Raw, base+res.Index
+		} else {
+			exists = false
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan, nil
+}
+
+// parentExists returns true when the container holding the last component
+// of the path exists in the json.
+func parentExists(json, path string) bool {
+	root := gjson.Parse(json)
+	if !root.IsObject() && !root.IsArray() {
+		return false
+	}
+	plan, err := Plan(json, path)
+	if err != nil {
+		return false
+	}
+	for _, step := range plan.Steps[:len(plan.Steps)-1] {
+		if !step.Exists {
+			return false
+		}
+	}
+	return true
+}
+
+// Kind is the kind of a json container.
+type Kind int
+
+const (
+	// ObjectKind is a json object.
+	ObjectKind Kind = iota + 1
+	// ArrayKind is a json array.
+	ArrayKind
+)
+
+// String returns the name of the kind.
+func (kind Kind) String() string {
+	switch kind {
+	case ObjectKind:
+		return "object"
+	case ArrayKind:
+		return "array"
+	default:
+		return "unknown"
+	}
+}
+
+// SetExpectingParent sets a json value for the specified path, but only if
+// the immediate parent of the value is of the parentKind. When the parent
+// does not exist yet, the kind that Set will create is used, which is an
+// array for an index or "-1" component, and an object otherwise. For '#'
+// wildcard and query paths every matched parent is checked.
+// An error is returned, and the json is not changed, if a parent is of a
+// different kind.
+func SetExpectingParent(json, path string, value interface{},
+	parentKind Kind) (string, error) {
+	comps, err := splitComponents(path)
+	if err != nil {
+		return json, err
+	}
+	kind, _ := classifyComponent(comps[len(comps)-1])
+	created := ObjectKind
+	if kind == IndexSegment || kind == AppendSegment {
+		created = ArrayKind
+	}
+	for _, parent := range expandQueries(nil, json, "", comps[:len(comps)-1]) {
+		res := gjson.Parse(json)
+		if parent != "" {
+			res = gjson.Get(json, gjsonPath(parent))
+		}
+		actual := created
+		switch {
+		case res.IsObject():
+			actual = ObjectKind
+		case res.IsArray():
+			actual = ArrayKind
+		case res.Exists():
+			actual = 0
+		}
+		if actual != parentKind {
+			if parent == "" {
+				parent = "@this"
+			}
+			return json, &errorType{"parent '" + parent + "' is " +
+				actual.String() + ", expected " + parentKind.String()}
+		}
+	}
+	return Set(json, path, value)
+}
+
+// SetDefault sets a json value for the specified path only if the path
+// does not exist yet, otherwise the json is returned unchanged. With '#'
+// wildcards, queries, or glob keys, the value is set for each matched
+// element where the rest of the path does not exist.
+func SetDefault(json, path string, value interface{}) (string, error) {
+	comps, err := splitComponents(path)
+	if err != nil {
+		return json, err
+	}
+	out := json
+	for _, p := range expandQueries(nil, json, "", comps) {
+		if gjson.Get(out, gjsonPath(p)).Exists() {
+			continue
+		}
+		if out, err = Set(out, p, value); err != nil {
+			return json, err
+		}
+	}
+	return out, nil
+}
+
+// SetIfEquals sets a json value for the specified path only if the existing
+// value equals the expected value, which allows for optimistic concurrency
+// in the style of compare-and-swap. Values are compared using their
+// Canonical form, so formatting, key order, and number notation don't
+// matter. ErrNotEqual is returned, along with the unchanged json, when the
+// value is different or does not exist.
+func SetIfEquals(json, path string, expected,
+	value interface{}) (string, error) {
+	raw, stringify, _, err := encodeValue(expected, nil)
+	if err != nil {
+		return json, err
+	}
+	if stringify {
+		raw = string(appendStringify(nil, raw))
+	}
+	want, err := Canonical(raw)
+	if err != nil {
+		return json, err
+	}
+	cur := gjson.Get(json, gjsonPath(path))
+	if !cur.Exists() {
+		return json, ErrNotEqual
+	}
+	if got, err := Canonical(cur.Raw); err != nil || got != want {
+		return json, ErrNotEqual
+	}
+	return Set(json, path, value)
+}
+
+// PathExists returns true if the path resolves to at least one existing
+// value in the json, using the same path rules as Set. This includes '#'
+// wildcards, queries, glob keys, and the ':' prefix for numeric object keys.
+// The "-1" key never exists, because it's the position after the last
+// element of an array. An invalid path does not exist, and an empty path is
+// the document root.
+func PathExists(json, path string) bool {
+	if path == "" {
+		return gjson.Parse(json).Exists()
+	}
+	comps, err := splitComponents(path)
+	if err != nil {
+		return false
+	}
+	st := newSetState(nil)
+	for _, p := range expandQueries(nil, json, "", comps) {
+		if st.pathExists(json, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathExists returns true if the concrete path, without wildcards or
+// queries, resolves to a value using the same lookup as Set.
+func (st *setState) pathExists(jstr, path string) bool {
+	comps, err := splitComponents(path)
+	if err != nil {
+		return false
+	}
+	for _, comp := range comps {
+		r, simple := parsePath(comp)
+		if !simple {
+			return gjson.Get(jstr, gjsonPath(path)).Exists()
+		}
+		res := st.lookup(jstr, r, false)
+		if res.Index <= 0 {
+			return false
+		}
+		jstr = res.Raw
+	}
+	return true
+}
+
+// PathResolvable returns true if Set would be able to write a value at the
+// path, either by replacing an existing value or by adding a new one. It
+// returns false when Set would fail, such as for a non-numeric key of an
+// existing array, or when a wildcard or query matches nothing. An error is
+// returned if the path is not valid. The json is not modified.
+func PathResolvable(json, path string) (bool, error) {
+	_, err := set(json, path, "null", false, false, newSetState(nil))
+	if _, ok := err.(*PathError); ok {
+		return false, err
+	}
+	return err == nil, nil
+}
+
+// DeleteWithStatus deletes a value from json for the specified path, and
+// reports whether a value existed and was removed. When nothing was removed
+// the json is returned unchanged.
+func DeleteWithStatus(json, path string) (string, bool, error) {
+	res, err := Delete(json, path)
+	if err != nil {
+		return json, false, err
+	}
+	// deleting a value always makes the json shorter
+	return res, len(res) < len(json), nil
+}
+
+// SetFirstExisting sets a json value at the first of the paths whose parent
+// already exists, and returns the updated json and the path that was used.
+// This allows for updating documents that have alternative layouts, such as
+// "spec.replicas" and "replicas", without creating the wrong one. When none
+// of the parents exist the value is set at the last path.
+func SetFirstExisting(json string, paths []string, value interface{}) (string,
+	string, error) {
+	return SetFirstExistingOptions(json, paths, value, nil)
+}
+
+// FirstExistingOptions represents additional options for the
+// SetFirstExisting function.
+type FirstExistingOptions struct {
+	// MissingParentError returns an error when none of the parents of the
+	// paths exist. By default the value is set at the last path.
+	MissingParentError bool
+}
+
+// SetFirstExistingOptions works the same as SetFirstExisting with options.
+func SetFirstExistingOptions(json string, paths []string, value interface{},
+	opts *FirstExistingOptions) (string, string, error) {
+	if len(paths) == 0 {
+		return json, "", &errorType{"no paths provided"}
+	}
+	path := ""
+	for _, p := range paths {
+		if parentExists(json, p) {
+			path = p
+			break
+		}
+	}
+	if path == "" {
+		if opts != nil && opts.MissingParentError {
+			return json, "", &errorType{"none of the parents of the paths exist"}
+		}
+		path = paths[len(paths)-1]
+	}
+	res, err := Set(json, path, value)
+	return res, path, err
+}
+
+// gjsonPath converts the path into the equivalent gjson path. Components
+// that are forced to be keys with the ':' character are escaped instead.
+func gjsonPath(path string) string {
+	comps, err := splitComponents(path)
+	if err != nil {
+		return path
+	}
+	var changed bool
+	for i, comp := range comps {
+		if len(comp) > 0 && comp[0] == ':' {
+			if r, simple := parsePath(comp); simple {
+				comps[i] = gjson.Escape(r.part)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return path
+	}
+	return strings.Join(comps, ".")
+}
+
+// SetBytesWithDiff sets a json value for the specified path and also
+// returns a human readable diff of the change, suitable for logging. The
+// diff has one "path: old -> new" line for each value that was written,
+// using the concrete path for each element of a '#' wildcard. Values that
+// didn't exist are shown as "(absent)".
+func SetBytesWithDiff(json []byte, path string, value interface{}) ([]byte,
+	string, error) {
+	raw, stringify, del, err := encodeValue(value, nil)
+	if err != nil {
+		return json, "", err
+	}
+	jstr := string(json)
+	matches, err := expandPath(jstr, path)
+	if err != nil {
+		return json, "", err
+	}
+	st := newSetState(nil)
+	res, err := set(jstr, path, raw, stringify, del, st)
+	res, err = finish(json, res, err, nil)
+	if err != nil {
+		return json, "", err
+	}
+	var diff []byte
+	for _, m := range matches {
+		old := gjson.Get(jstr, gjsonPath(m))
+		if del && !old.Exists() {
+			continue
+		}
+		var nraw string
+		switch {
+		case del:
+			nraw = "(removed)"
+		case len(matches) == 1 && st.index >= 0:
+			nraw = string(res[st.index:st.end])
+		default:
+			nraw = gjson.GetBytes(res, gjsonPath(m)).Raw
+		}
+		oraw := old.Raw
+		if !old.Exists() {
+			oraw = "(absent)"
+		}
+		if len(diff) > 0 {
+			diff = append(diff, '\n')
+		}
+		diff = append(diff, m...)
+		diff = append(diff, ": "...)
+		diff = append(diff, oraw...)
+		diff = append(diff, " -> "...)
+		diff = append(diff, nraw...)
+	}
+	return res, string(diff), nil
+}
+
+// DeleteBytesWithDiff deletes a value from json for the specified path and
+// also returns a human readable diff of the change. The new value of each
+// deleted path is shown as "(removed)".
+func DeleteBytesWithDiff(json []byte, path string) ([]byte, string, error) {
+	return SetBytesWithDiff(json, path, dtype{})
+}
+
+// SetBytesChecksum sets a json value for the specified path and also returns
+// a checksum of the resulting json, which is the 64-bit FNV-1a hash of the
+// bytes, as provided by hash/fnv. The algorithm will not change, so the
+// checksum may be stored and compared later. The checksum is computed while
+// the result is copied, without another pass over the json.
+func SetBytesChecksum(json []byte, path string, value interface{}) (out []byte,
+	sum uint64, err error) {
+	raw, stringify, del, err := encodeValue(value, nil)
+	if err != nil {
+		return json, 0, err
+	}
+	w := &checksumWriter{
+		out: make([]byte, 0, len(json)+len(raw)+2),
+		h:   fnv.New64a(),
+	}
+	if err := writeSet(w, json, path, raw, stringify, del, nil); err != nil {
+		return json, 0, err
+	}
+	return w.out, w.h.Sum64(), nil
+}
+
+// checksumWriter appends the written bytes to out and adds them to the hash.
+type checksumWriter struct {
+	out []byte
+	h   hash.Hash64
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	w.out = append(w.out, p...)
+	w.h.Write(p)
+	return len(p), nil
+}
+
+// SetBytesTyped sets a json value for the specified path and also returns
+// the json type of the previous value and of the new value, which is one
+// of "object", "array", "string", "number", "boolean", or "null". The old
+// type is "absent" when the value was created.
+// For a '#' wildcard path the old type is the type shared by every matched
+// value, or "mixed" when they differ.
+func SetBytesTyped(json []byte, path string, value interface{}) (out []byte,
+	oldType, newType string, err error) {
+	raw, stringify, del, err := encodeValue(value, nil)
+	if err != nil {
+		return json, "", "", err
+	}
+	jstr := string(json)
+	matches, err := expandPath(jstr, path)
+	if err != nil {
+		return json, "", "", err
+	}
+	oldType = "absent"
+	for i, m := range matches {
+		typ := "absent"
+		if old := gjson.Get(jstr, gjsonPath(m)); old.Exists() {
+			typ = jsonType(old.Raw)
+		}
+		if i == 0 {
+			oldType = typ
+		} else if typ != oldType {
+			oldType = "mixed"
+		}
+	}
+	switch {
+	case del:
+		newType = "absent"
+	case stringify:
+		newType = "string"
+	default:
+		newType = jsonType(raw)
+	}
+	res, err := set(jstr, path, raw, stringify, del, newSetState(nil))
+	res, err = finish(json, res, err, nil)
+	if err != nil {
+		return json, "", "", err
+	}
+	return res, oldType, newType, nil
+}
+
+// SetBytesDelta sets a json value for the specified path and also returns
+// the number of bytes that the json grew, or a negative number when it
+// shrank. This allows for keeping a running size across many edits.
+func SetBytesDelta(json []byte, path string, value interface{}) ([]byte, int,
+	error) {
+	n := len(json)
+	res, err := SetBytes(json, path, value)
+	if err != nil {
+		return res, 0, err
+	}
+	return res, len(res) - n, nil
+}
+
+// Cursor holds the byte range of a value in a json document, allowing for
+// repeated edits to a deep value without walking the document from the
+// root each time. Paths passed to a Cursor are relative to the value.
+//
+// A Cursor is only valid for the json that it was created for, or the json
+// returned by the Cursor's own Set and Delete methods.
+type Cursor struct {
+	start, end int
+}
+
+// At returns a Cursor for the value at the specified path.
+func At(json []byte, path string) (*Cursor, error) {
+	res := gjson.GetBytes(json, gjsonPath(path))
+	if !res.Exists() {
+		return nil, &errorType{"path '" + path + "' does not exist"}
+	}
+	end := res.Index + len(res.Raw)
+	if res.Index < 0 || end > len(json) ||
+		string(json[res.Index:end]) != res.Raw {
+		// computed results, such as from queries, are not in the json
+		return nil, &errorType{"path '" + path +
+			"' does not address a single value in the json"}
+	}
+	return &Cursor{start: res.Index, end: end}, nil
+}
+
+// Range returns the byte range of the value in the json.
+func (c *Cursor) Range() (start, end int) {
+	return c.start, c.end
+}
+
+// Raw returns the value that the Cursor points to.
+func (c *Cursor) Raw(json []byte) []byte {
+	return json[c.start:c.end]
+}
+
+// Set sets a json value for the path relative to the Cursor's value. The
+// updated json is returned along with a Cursor for the whole updated value
+// of this Cursor, not only the value at path, so that the same relative
+// paths may be used for further edits.
+func (c *Cursor) Set(json []byte, path string, value interface{}) ([]byte,
+	*Cursor, error) {
+	if err := c.check(json); err != nil {
+		return json, c, err
+	}
+	sub, err := SetBytes(json[c.start:c.end], path, value)
+	if err != nil {
+		return json, c, err
+	}
+	return c.splice(json, sub)
+}
+
+// SetRaw sets a raw json value for the path relative to the Cursor's value.
+func (c *Cursor) SetRaw(json []byte, path string, value []byte) ([]byte,
+	*Cursor, error) {
+	if err := c.check(json); err != nil {
+		return json, c, err
+	}
+	sub, err := SetRawBytes(json[c.start:c.end], path, value)
+	if err != nil {
+		return json, c, err
+	}
+	return c.splice(json, sub)
+}
+
+// Delete deletes a value for the path relative to the Cursor's value.
+func (c *Cursor) Delete(json []byte, path string) ([]byte, *Cursor, error) {
+	if err := c.check(json); err != nil {
+		return json, c, err
+	}
+	sub, err := DeleteBytes(json[c.start:c.end], path)
+	if err != nil {
+		return json, c, err
+	}
+	return c.splice(json, sub)
+}
+
+func (c *Cursor) check(json []byte) error {
+	if c.end > len(json) {
+		return &errorType{"cursor is out of range for the json"}
+	}
+	return nil
+}
+
+// splice replaces the Cursor's value with sub.
+func (c *Cursor) splice(json, sub []byte) ([]byte, *Cursor, error) {
+	buf := make([]byte, 0, len(json)-(c.end-c.start)+len(sub))
+	buf = append(buf, json[:c.start]...)
+	buf = append(buf, sub...)
+	buf = append(buf, json[c.end:]...)
+	return buf, &Cursor{start: c.start, end: c.start + len(sub)}, nil
+}
+
+// ApplyPatch applies an RFC 6902 JSON Patch, which is an array of
+// operations such as {"op":"add","path":"/a/b","value":1}, to the json. The
+// add, remove, replace, move, copy, and test operations are supported, and
+// the JSON Pointer paths are converted to the equivalent paths of this
+// package. The operations are applied in order, and the json is returned
+// unchanged if any of them fails. The test operation compares values using
+// their Canonical form.
+func ApplyPatch(json, patch string) (string, error) {
+	ops := gjson.Parse(patch)
+	if !ops.IsArray() {
+		return json, &errorType{"patch must be an array"}
+	}
+	out := json
+	var err error
+	var i int
+	ops.ForEach(func(_, op gjson.Result) bool {
+		out, err = applyPatchOp(out, op)
+		if err != nil {
+			err = &errorType{"patch operation " + strconv.Itoa(i) + ": " +
+				err.Error()}
+			return false
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		return json, err
+	}
+	return out, nil
+}
+
+// applyPatchOp applies a single JSON Patch operation.
+func applyPatchOp(json string, op gjson.Result) (string, error) {
+	if !op.IsObject() {
+		return json, &errorType{"operation must be an object"}
+	}
+	name, ptr := op.Get("op").String(), op.Get("path")
+	if !ptr.Exists() {
+		return json, &errorType{"missing 'path'"}
+	}
+	value := op.Get("value")
+	switch name {
+	case "add", "replace", "test":
+		if !value.Exists() {
+			return json, &errorType{"missing 'value' for '" + name + "'"}
+		}
+	case "move", "copy":
+		from := op.Get("from")
+		if !from.Exists() {
+			return json, &errorType{"missing 'from' for '" + name + "'"}
+		}
+		if name == "move" && ptr.Str == from.Str {
+			return json, nil
+		}
+		if name == "move" && strings.HasPrefix(ptr.Str, from.Str+"/") {
+			return json, &errorType{"cannot move '" + from.Str +
+				"' into itself"}
+		}
+		path, err := pointerPath(json, from.Str)
+		if err != nil {
+			return json, err
+		}
+		value = pointerGet(json, path)
+		if !value.Exists() {
+			return json, &errorType{"'" + from.Str + "' does not exist"}
+		}
+		if name == "move" {
+			if path == "" {
+				return json, &errorType{"cannot move the root"}
+			}
+			if json, err = Delete(json, path); err != nil {
+				return json, err
+			}
+		}
+		return pointerAdd(json, ptr.Str, value.Raw)
+	case "remove":
+	default:
+		return json, &errorType{"unknown op '" + name + "'"}
+	}
+	if name == "add" {
+		return pointerAdd(json, ptr.Str, value.Raw)
+	}
+	path, err := pointerPath(json, ptr.Str)
+	if err != nil {
+		return json, err
+	}
+	cur := pointerGet(json, path)
+	if !cur.Exists() {
+		return json, &errorType{"'" + ptr.Str + "' does not exist"}
+	}
+	switch name {
+	case "remove":
+		if path == "" {
+			return json, &errorType{"cannot remove the root"}
+		}
+		return Delete(json, path)
+	case "replace":
+		if path == "" {
+			return value.Raw, nil
+		}
+		return SetRaw(json, path, value.Raw)
+	default: // test
+		expect, err1 := Canonical(value.Raw)
+		actual, err2 := Canonical(cur.Raw)
+		if err1 != nil || err2 != nil || expect != actual {
+			return json, &errorType{"test failed: value at '" + ptr.Str +
+				"' is " + cur.Raw + ", expected " + value.Raw}
+		}
+		return json, nil
+	}
+}
+
+// pointerAdd performs the JSON Patch add operation, which inserts rather
+// than replaces array elements.
+func pointerAdd(json, ptr, raw string) (string, error) {
+	if ptr == "" {
+		return raw, nil
+	}
+	i := strings.LastIndexByte(ptr, '/')
+	parentPath, err := pointerPath(json, ptr[:i])
+	if err != nil {
+		return json, err
+	}
+	parent := pointerGet(json, parentPath)
+	token := unescapePointerToken(ptr[i+1:])
+	switch {
+	case parent.IsObject():
+		return SetRaw(json, joinPath(parentPath, PathForKeys(token)), raw)
+	case parent.IsArray():
+		elems := parent.Array()
+		idx := len(elems)
+		if token != "-" {
+			n, ok := pointerIndex(token)
+			if !ok || n > len(elems) {
+				return json, &errorType{"invalid array index '" + token +
+					"' in '" + ptr + "'"}
+			}
+			idx = n
+		}
+		if idx == len(elems) {
+			return SetRaw(json, joinPath(parentPath, "-1"), raw)
+		}
+		buf := []byte{'['}
+		for j, elem := range elems {
+			if j == idx {
+				buf = append(buf, raw...)
+				buf = append(buf, ',')
+			}
+			buf = append(buf, elem.Raw...)
+			if j < len(elems)-1 {
+				buf = append(buf, ',')
+			}
+		}
+		buf = append(buf, ']')
+		if parentPath == "" {
+			return string(buf), nil
+		}
+		return SetRaw(json, parentPath, string(buf))
+	case parent.Exists():
+		return json, &errorType{"parent of '" + ptr +
+			"' is not an object or array"}
+	default:
+		return json, &errorType{"parent of '" + ptr + "' does not exist"}
+	}
+}
+
+// pointerPath converts the JSON Pointer into a path, using the json to
+// determine if a numeric token is an array index or an object key. An empty
+// path is the root.
+func pointerPath(json, ptr string) (string, error) {
+	if ptr == "" {
+		return "", nil
+	}
+	if ptr[0] != '/' {
+		return "", &errorType{"invalid JSON Pointer '" + ptr + "'"}
+	}
+	var path string
+	cur := gjson.Parse(json)
+	for _, token := range strings.Split(ptr[1:], "/") {
+		token = unescapePointerToken(token)
+		if cur.IsArray() {
+			if _, ok := pointerIndex(token); !ok {
+				return "", &errorType{"invalid array index '" + token +
+					"' in '" + ptr + "'"}
+			}
+			path = joinPath(path, token)
+		} else {
+			path = joinPath(path, PathForKeys(token))
+		}
+		cur = pointerGet(json, path)
+	}
+	return path, nil
+}
+
+// pointerGet returns the value at the path, where an empty path is the root.
+func pointerGet(json, path string) gjson.Result {
+	if path == "" {
+		return gjson.Parse(json)
+	}
+	return gjson.Get(json, gjsonPath(path))
+}
+
+// pointerIndex parses a JSON Pointer array index, which has no sign or
+// leading zeros.
+func pointerIndex(token string) (int, bool) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	return atoui(pathResult{part: token})
+}
+
+// unescapePointerToken replaces "~1" with "/" and "~0" with "~".
+func unescapePointerToken(token string) string {
+	if !strings.Contains(token, "~") {
+		return token
 	}
-	return res, err
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
 }
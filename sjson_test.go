@@ -1,10 +1,21 @@
 package sjson
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/hex"
+	jsongo "encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -775,3 +786,4095 @@ func TestUserRequestedWildcardDeletion(t *testing.T) {
 		t.Fatalf("Nested settings scenario failed. Expected '%v', got '%v'", expected3, result3)
 	}
 }
+
+func TestIncrementInt(t *testing.T) {
+	json, err := IncrementInt(`{"id":9007199254740993}`, "id", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"id":9007199254740995}` {
+		t.Fatalf("expected '%v', got '%v'", `{"id":9007199254740995}`, json)
+	}
+	json, err = IncrementInt(`{}`, "a.b", -3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":{"b":-3}}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":{"b":-3}}`, json)
+	}
+	if _, err := IncrementInt(`{"id":1.5}`, "id", 1); err == nil {
+		t.Fatal("expected error for float value")
+	}
+	if _, err := IncrementInt(`{"id":"1"}`, "id", 1); err == nil {
+		t.Fatal("expected error for string value")
+	}
+	if _, err := IncrementInt(`{"id":9223372036854775807}`, "id", 1); err == nil {
+		t.Fatal("expected overflow error")
+	}
+	if _, err := IncrementInt(`{"id":-9223372036854775808}`, "id", -1); err == nil {
+		t.Fatal("expected overflow error")
+	}
+	json, err = IncrementInt(`{"1":{"c":5}}`, ":1.c", 1)
+	if err != nil || json != `{"1":{"c":6}}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"1":{"c":6}}`, json, err)
+	}
+}
+
+func TestToggle(t *testing.T) {
+	json, err := Toggle(`{"a":true,"b":false}`, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, err = Toggle(json, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, err = Toggle(json, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":false,"b":true,"c":true}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":false,"b":true,"c":true}`, json)
+	}
+	if _, err := Toggle(`{"a":1}`, "a"); err == nil {
+		t.Fatal("expected error for non-boolean value")
+	}
+	json2, err := ToggleBytes([]byte(`{"flags":[{"on":true},{"on":false},{}]}`),
+		"flags.#.on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"flags":[{"on":false},{"on":true},{"on":true}]}`
+	if string(json2) != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, json2)
+	}
+	json3, err := Toggle(`[{"x":[true,false]},{"x":[false]}]`, "#.x.#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json3 != `[{"x":[false,true]},{"x":[true]}]` {
+		t.Fatalf("expected '%v', got '%v'", `[{"x":[false,true]},{"x":[true]}]`, json3)
+	}
+	json, err = Toggle(`{"1":{"c":true}}`, ":1.c")
+	if err != nil || json != `{"1":{"c":false}}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"1":{"c":false}}`, json, err)
+	}
+	json, err = Toggle(`{"1":[{"c":true},{"c":false}]}`, ":1.#.c")
+	if err != nil || json != `{"1":[{"c":false},{"c":true}]}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	json, err = Toggle(`{"a":[{"k":1,"c":true},{"k":2,"c":true}]}`,
+		"a.#(k==2).c")
+	if err != nil || json != `{"a":[{"k":1,"c":true},{"k":2,"c":false}]}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	json, err = Toggle(`{"on1":true,"on2":false,"x":1}`, "on*")
+	if err != nil || json != `{"on1":false,"on2":true,"x":1}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+}
+
+func TestForceObjectKeys(t *testing.T) {
+	opts := &Options{ForceObjectKeys: true}
+	json, err := SetOptions(``, "2021.revenue", 5, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"2021":{"revenue":5}}` {
+		t.Fatalf("expected '%v', got '%v'", `{"2021":{"revenue":5}}`, json)
+	}
+	json, err = SetOptions(`{"2020":{"revenue":1}}`, "2021.revenue", 5, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"2020":{"revenue":1},"2021":{"revenue":5}}` {
+		t.Fatalf("expected '%v', got '%v'",
+			`{"2020":{"revenue":1},"2021":{"revenue":5}}`, json)
+	}
+	json, err = SetOptions(json, "2020.revenue", 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"2020":{"revenue":2},"2021":{"revenue":5}}` {
+		t.Fatalf("expected '%v', got '%v'",
+			`{"2020":{"revenue":2},"2021":{"revenue":5}}`, json)
+	}
+	json, err = SetOptions(`{}`, "years.2022.1", "q1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"years":{"2022":{"1":"q1"}}}` {
+		t.Fatalf("expected '%v', got '%v'", `{"years":{"2022":{"1":"q1"}}}`, json)
+	}
+	// without the option numeric components still create arrays
+	json, err = Set(``, "2021.revenue", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.Parse(json).IsObject() {
+		t.Fatalf("expected array root, got '%v'", json)
+	}
+	// a colon has no additional effect with the option
+	for _, path := range []string{"a.2.-1", "a.:2.:-1", ":a.2.:-1"} {
+		json, err = SetOptions(`{}`, path, 1, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if json != `{"a":{"2":{"-1":1}}}` {
+			t.Fatalf("%v: expected '%v', got '%v'", path,
+				`{"a":{"2":{"-1":1}}}`, json)
+		}
+	}
+	// existing array elements can be replaced, but not appended
+	json, err = SetOptions(`{"a":[1]}`, "a.0", 2, opts)
+	if err != nil || json != `{"a":[2]}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"a":[2]}`, json, err)
+	}
+	if _, err = SetOptions(`{"a":[1]}`, "a.-1", 2, opts); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNormalizeWhitespace(t *testing.T) {
+	json := "{\n  \"a\":   1,\n  \"b\": [ 1, 2 ]\n}"
+	opts := &Options{NormalizeWhitespace: true}
+	res, err := SetOptions(json, "a", 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":2,"b":[1,2]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":2,"b":[1,2]}`, res)
+	}
+	res, err = SetRawOptions(json, "c", `{ "d" : true }`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":1,"b":[1,2],"c":{"d":true}}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":1,"b":[1,2],"c":{"d":true}}`, res)
+	}
+	// the default leaves untouched regions alone
+	res, err = Set(json, "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "{\n  \"a\":   2,\n  \"b\": [ 1, 2 ]\n}" {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+}
+
+func TestSetEach(t *testing.T) {
+	json := `{"users":[{"name":"John"},{"name":"Jane"}]}`
+	res, err := SetEach(json, "users.#.label",
+		func(index int, elem gjson.Result) (interface{}, error) {
+			return fmt.Sprintf("%d:%s", index, elem.Get("name").String()), nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"users":[{"name":"John","label":"0:John"},{"name":"Jane","label":"1:Jane"}]}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	res, err = SetEach(`[{"a":[1,2]},{"a":[3]}]`, "#.a.#",
+		func(index int, elem gjson.Result) (interface{}, error) {
+			return elem.Int() * 10, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `[{"a":[10,20]},{"a":[30]}]` {
+		t.Fatalf("expected '%v', got '%v'", `[{"a":[10,20]},{"a":[30]}]`, res)
+	}
+	_, err = SetEach(json, "users.#.label",
+		func(index int, elem gjson.Result) (interface{}, error) {
+			return nil, fmt.Errorf("fail")
+		})
+	if err == nil || err.Error() != "fail" {
+		t.Fatalf("expected 'fail' error, got '%v'", err)
+	}
+	name := func(index int, elem gjson.Result) (interface{}, error) {
+		return elem.Get("n").String(), nil
+	}
+	for _, tc := range []struct {
+		json, path, exp string
+	}{
+		{`{"1":[{"n":"x"},{"n":"y"}]}`, ":1.#.b",
+			`{"1":[{"n":"x","b":"x"},{"n":"y","b":"y"}]}`},
+		{`{"a":[{"n":"x"},{"n":"y"}]}`, `a.#(n=="y").b`,
+			`{"a":[{"n":"x"},{"n":"y","b":"y"}]}`},
+		{`{"a":{"k1":{"n":"x"},"k2":{"n":"y"},"z":{}}}`, "a.k*.b",
+			`{"a":{"k1":{"n":"x","b":"x"},"k2":{"n":"y","b":"y"},"z":{}}}`},
+	} {
+		res, err = SetEach(tc.json, tc.path, name)
+		if err != nil || res != tc.exp {
+			t.Fatalf("%v: expected '%v', got '%v', %v", tc.path, tc.exp, res, err)
+		}
+	}
+	if _, err = SetEach(json, "users.#(", name); err == nil {
+		t.Fatal("expected error for invalid path")
+	}
+}
+
+func TestPathForKeys(t *testing.T) {
+	keys := []string{"fav.movie", ":colon", "back\\slash", "a#b", "😇", "2020",
+		"-1", "", "@at", "q?*|"}
+	path := PathForKeys(keys...)
+	skeys, err := SplitPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(skeys) != fmt.Sprint(keys) || len(skeys) != len(keys) {
+		t.Fatalf("expected '%v', got '%v'", keys, skeys)
+	}
+	for _, key := range keys {
+		json, err := Set(``, PathForKeys("x", key), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		gjson.Get(json, "x").ForEach(func(k, _ gjson.Result) bool {
+			found = k.String() == key
+			return true
+		})
+		if !found {
+			t.Fatalf("key '%v' not found in '%v'", key, json)
+		}
+	}
+	if PathForKeys("fav.movie", "2020") != `fav\.movie.:2020` {
+		t.Fatalf("unexpected path '%v'", PathForKeys("fav.movie", "2020"))
+	}
+	if _, err := SplitPath("friends.#.name"); err == nil {
+		t.Fatal("expected error for wildcard path")
+	}
+}
+
+func TestDeleteIfPredicate(t *testing.T) {
+	json, err := DeleteIf(`{"token":"","name":"Tom"}`, "token", `==""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"name":"Tom"}` {
+		t.Fatalf("expected '%v', got '%v'", `{"name":"Tom"}`, json)
+	}
+	json, err = DeleteIf(`{"token":"abc","name":"Tom"}`, "token", `==""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"token":"abc","name":"Tom"}` {
+		t.Fatalf("expected '%v', got '%v'", `{"token":"abc","name":"Tom"}`, json)
+	}
+	json, err = DeleteIf(example, "friends.#", `age>45`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.Get(json, "friends.#.first").String() != `["Dale"]` {
+		t.Fatalf("unexpected result '%v'", gjson.Get(json, "friends.#.first"))
+	}
+	json, err = DeleteIf(example, "friends.#.nets.#", `=="tw"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.Get(json, "friends.#.nets").String() != `[["ig", "fb"],["fb"],["ig"]]` {
+		t.Fatalf("unexpected result '%v'", gjson.Get(json, "friends.#.nets"))
+	}
+	json, err = DeleteIf(`{"1":{"t":""}}`, ":1.t", `==""`)
+	if err != nil || json != `{"1":{}}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"1":{}}`, json, err)
+	}
+}
+
+func TestNoExponent(t *testing.T) {
+	// structs are encoded by encoding/json
+	value := struct {
+		Big   float64   `json:"big"`
+		List  []float64 `json:"list"`
+		Small float64   `json:"small"`
+		Str   string    `json:"str"`
+	}{1e21, []float64{-2.5e-7}, 0.0000001, "1e+21"}
+	json, err := Set(`{}`, "v", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"v":{"big":1e+21,"list":[-2.5e-7],"small":1e-7,"str":"1e+21"}}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	json, err = SetOptions(`{}`, "v", value, &Options{NoExponent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"v":{"big":1000000000000000000000,"list":[-0.00000025],"small":0.0000001,"str":"1e+21"}}`
+	if json != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, json)
+	}
+	json, err = SetOptions(`{}`, "v", 1e21, &Options{NoExponent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"v":1000000000000000000000}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+}
+
+func TestMergeArrayByIndex(t *testing.T) {
+	json := `{"a":[{"x":1,"y":{"z":1}},2,{"k":"v"}]}`
+	res, err := MergeArrayByIndex(json, "a", `[{"y":{"w":2}},{"n":3}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"a":[{"x":1,"y":{"z":1,"w":2}},{"n":3},{"k":"v"}]}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	res, err = MergeArrayByIndex(`{"a":[{"x":1}]}`, "a", `["s",{"y":2},null]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":["s",{"y":2},null]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":["s",{"y":2},null]}`, res)
+	}
+	res, err = MergeArrayByIndex(`{}`, "a", `[1]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":[1]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[1]}`, res)
+	}
+	if _, err := MergeArrayByIndex(`{"a":{}}`, "a", `[1]`); err == nil {
+		t.Fatal("expected error for non-array target")
+	}
+	if _, err := MergeArrayByIndex(`{"a":[]}`, "a", `{}`); err == nil {
+		t.Fatal("expected error for non-array value")
+	}
+	res, err = MergeArrayByIndex(`{"1":[1,2]}`, ":1", `[9]`)
+	if err != nil || res != `{"1":[9,2]}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"1":[9,2]}`, res, err)
+	}
+}
+
+func TestSetReturning(t *testing.T) {
+	json, res, err := SetReturning(`{"a":{"b":1}}`, "a.b", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":{"b":"hello"}}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":{"b":"hello"}}`, json)
+	}
+	if res.String() != "hello" || res.Raw != `"hello"` ||
+		json[res.Index:res.Index+len(res.Raw)] != res.Raw {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	json, res, err = SetReturning(`{"a":{"b":1}}`, "a.c.0", map[string]int{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Raw != `{"x":1}` || res.Get("x").Int() != 1 ||
+		json[res.Index:res.Index+len(res.Raw)] != res.Raw {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	json, res, err = SetReturning(example, "friends.#.age", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Raw != `1` || gjson.Get(json, "friends.#.age").String() != `[1,1,1]` {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestSkipPrefixBytes(t *testing.T) {
+	prefix := "#!/usr/bin/env app\n// config\n"
+	json := prefix + `{"a":1}`
+	res, err := SetOptions(json, "b", 2, &Options{SkipPrefixBytes: len(prefix)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != prefix+`{"a":1,"b":2}` {
+		t.Fatalf("expected '%v', got '%v'", prefix+`{"a":1,"b":2}`, res)
+	}
+	res2, err := SetRawBytesOptions([]byte(json), "a", []byte(`[ 1 ]`),
+		&Options{SkipPrefixBytes: -1, NormalizeWhitespace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res2) != prefix+`{"a":[1]}` {
+		t.Fatalf("expected '%v', got '%v'", prefix+`{"a":[1]}`, res2)
+	}
+	res, err = SetOptions(json, "a", 2, &Options{SkipPrefixBytes: -1,
+		Optimistic: true, ReplaceInPlace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != prefix+`{"a":2}` {
+		t.Fatalf("expected '%v', got '%v'", prefix+`{"a":2}`, res)
+	}
+}
+
+func TestRenameKeys(t *testing.T) {
+	json := `{"firstName":"Tom", "lastName":"Anderson", "kids":[{"kidName":"Sara"}]}`
+	var paths []string
+	res, err := RenameKeys(json, func(path, key string) (string, bool) {
+		paths = append(paths, path)
+		var snake []byte
+		for i := 0; i < len(key); i++ {
+			if key[i] >= 'A' && key[i] <= 'Z' {
+				snake = append(snake, '_', key[i]+32)
+			} else {
+				snake = append(snake, key[i])
+			}
+		}
+		return string(snake), true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"first_name":"Tom", "last_name":"Anderson", "kids":[{"kid_name":"Sara"}]}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	if fmt.Sprint(paths) != "[firstName lastName kids kids.0.kidName]" {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+	toB := func(path, key string) (string, bool) { return "b", key == "a" }
+	if _, err := RenameKeys(`{"a":1,"b":2}`, toB); err == nil {
+		t.Fatal("expected collision error")
+	}
+	res, err = RenameKeysOptions(`{"a":1, "b":2}`, toB, &RenameOptions{LastWins: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"b":2}` {
+		t.Fatalf("expected '%v', got '%v'", `{"b":2}`, res)
+	}
+	res, err = RenameKeysOptions(`{"b":1,"a":2}`, toB, &RenameOptions{LastWins: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"b":2}` {
+		t.Fatalf("expected '%v', got '%v'", `{"b":2}`, res)
+	}
+}
+
+func TestPreserveType(t *testing.T) {
+	opts := &Options{PreserveType: true}
+	json := `{"age":37,"name":"Tom","tags":["a"],"ok":true,"nil":null}`
+	if _, err := SetOptions(json, "age", "old", opts); err == nil {
+		t.Fatal("expected error replacing number with string")
+	}
+	if _, err := SetRawOptions(json, "tags", `{}`, opts); err == nil {
+		t.Fatal("expected error replacing array with object")
+	}
+	if _, err := SetOptions(json, "ok", 1, opts); err == nil {
+		t.Fatal("expected error replacing boolean with number")
+	}
+	if _, err := SetOptions(json, "nil", false, opts); err == nil {
+		t.Fatal("expected error replacing null with boolean")
+	}
+	res, err := SetOptions(json, "age", 38.5, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = SetOptions(res, "ok", false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = SetOptions(res, "new", "x", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"age":38.5,"name":"Tom","tags":["a"],"ok":false,"nil":null,"new":"x"}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	opts.Optimistic = true
+	if _, err := SetOptions(json, "name", 1, opts); err == nil {
+		t.Fatal("expected error replacing string with number")
+	}
+	if _, err := SetOptions(example, "friends.#.age", "old", opts); err == nil {
+		t.Fatal("expected error replacing number with string")
+	}
+	if _, err := SetOptions(example, `friends.#(last="Craig").age`, "old",
+		opts); err == nil {
+		t.Fatal("expected error replacing number with string")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	json := `{"a":{"b":1,"c.d":true},"e":["x",{"f":null}],"g":{},"h":[],"2020":"y"}`
+	flat, err := Flatten(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `map[:2020:y a.b:1 a.c\.d:true e.0:x e.1.f:<nil> g:map[] h:[]]`
+	if fmt.Sprint(flat) != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, fmt.Sprint(flat))
+	}
+	var res string
+	for path, value := range flat {
+		res, err = Set(res, path, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sortJSON(res) != sortJSON(json) {
+		t.Fatalf("expected '%v', got '%v'", sortJSON(json), sortJSON(res))
+	}
+	json = `{"id":12345678901234567891,"f":[1.50,-2e+3]}`
+	flat, err = Flatten(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = ""
+	for _, path := range []string{"id", "f.0", "f.1"} {
+		res, err = Set(res, path, flat[path])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res != json {
+		t.Fatalf("expected '%v', got '%v'", json, res)
+	}
+	if _, err := Flatten(`{"a":`); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+	if _, err := Flatten(`1`); err == nil {
+		t.Fatal("expected error for scalar json")
+	}
+}
+
+func TestRequireSingleTarget(t *testing.T) {
+	opts := &Options{RequireSingleTarget: true}
+	if _, err := SetOptions(example, "friends.#.age", 1, opts); err == nil {
+		t.Fatal("expected error for wildcard with many values")
+	}
+	if _, err := SetOptions(example, `friends.#(last="Murphy")#.age`, 1,
+		opts); err == nil {
+		t.Fatal("expected error for query with many matches")
+	}
+	if _, err := DeleteOptions(example, "friends.#.nets.#", opts); err == nil {
+		t.Fatal("expected error for nested wildcards with many values")
+	}
+	json, err := SetOptions(example, `friends.#(last="Craig")#.age`, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.Get(json, "friends.#.age").String() != `[44,1,47]` {
+		t.Fatalf("unexpected result '%v'", gjson.Get(json, "friends.#.age"))
+	}
+	json, err = DeleteOptions(`{"a":[{"b":1,"c":2}]}`, "a.#.b", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":[{"c":2}]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[{"c":2}]}`, json)
+	}
+	json2, err := DeleteBytesOptions([]byte(`{"a":1,"b":2}`), "a", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(json2) != `{"b":2}` {
+		t.Fatalf("expected '%v', got '%v'", `{"b":2}`, json2)
+	}
+}
+
+func TestSetArraySize(t *testing.T) {
+	json, err := SetArraySize(`{}`, "months", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.Get(json, "months.#").Int() != 12 ||
+		gjson.Get(json, "months.11").Type != gjson.Null {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	json, err = SetArraySizeFill(`{"a":[1,2]}`, "a", 4, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":[1,2,0,0]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[1,2,0,0]}`, json)
+	}
+	json2, err := SetArraySizeBytes([]byte(`{"a":[1,2,3]}`), "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(json2) != `{"a":[1]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[1]}`, json2)
+	}
+	if _, err := SetArraySize(`{"a":{}}`, "a", 1); err == nil {
+		t.Fatal("expected error for non-array value")
+	}
+	if _, err := SetArraySize(`{"a":[]}`, "a", -1); err == nil {
+		t.Fatal("expected error for negative size")
+	}
+	json, err = SetArraySize(`{"1":[1,2,3]}`, ":1", 2)
+	if err != nil || json != `{"1":[1,2]}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"1":[1,2]}`, json, err)
+	}
+}
+
+func TestDeleteElementWhere(t *testing.T) {
+	json := `{"items":[{"id":1,"meta":{"bad":true}},{"id":2,"meta":{"bad":false}},{"id":3,"meta":{"bad":true}}]}`
+	res, err := DeleteElementWhere(json, "items", `meta.bad=true`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"items":[{"id":2,"meta":{"bad":false}}]}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, err = DeleteElementWhere(`[{"a":1},{"a":2}]`, "", `a>1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `[{"a":1}]` {
+		t.Fatalf("expected '%v', got '%v'", `[{"a":1}]`, res)
+	}
+	res, err = DeleteElementWhere(json, "missing", `id=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != json {
+		t.Fatalf("expected '%v', got '%v'", json, res)
+	}
+}
+
+func TestMaxStringLen(t *testing.T) {
+	opts := &Options{MaxStringLen: 5}
+	json, err := SetOptions(`{}`, "a", `"\"`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":"\"\\\""}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	if _, err := SetOptions(`{}`, "a", "123456", opts); err == nil {
+		t.Fatal("expected error for long string")
+	}
+	// a []byte is raw json, which isn't limited
+	if _, err := SetBytesOptions([]byte(`{}`), "a", []byte(`"123456"`),
+		opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetOptions(`{}`, "a", 1234567, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetInCompressed(t *testing.T) {
+	for _, codec := range []Codec{GzipCodec, FlateCodec} {
+		data, err := codec.Compress([]byte(`{"a":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		json, err := Set(`{"id":1}`, "payload",
+			base64.StdEncoding.EncodeToString(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		json, err = SetInCompressed(json, "payload", "b", "two", codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = base64.StdEncoding.DecodeString(gjson.Get(json, "payload").Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = codec.Decompress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != `{"a":1,"b":"two"}` {
+			t.Fatalf("expected '%v', got '%v'", `{"a":1,"b":"two"}`, string(data))
+		}
+		if gjson.Get(json, "id").Int() != 1 {
+			t.Fatalf("unexpected result '%v'", json)
+		}
+		data, _ = codec.Compress([]byte(`not json`))
+		json, _ = Set(`{}`, "payload", base64.StdEncoding.EncodeToString(data))
+		if _, err := SetInCompressed(json, "payload", "b", 1, codec); err == nil {
+			t.Fatal("expected error for invalid embedded json")
+		}
+	}
+	if _, err := SetInCompressed(`{"payload":1}`, "payload", "b", 1,
+		GzipCodec); err == nil {
+		t.Fatal("expected error for non-string field")
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	opts := &Options{ValidateInput: true}
+	if _, err := SetOptions(`{"a":1`, "b", 2, opts); err != ErrInvalidInput {
+		t.Fatalf("expected ErrInvalidInput, got '%v'", err)
+	}
+	if _, err := DeleteOptions(`{"a":1}}`, "a", opts); err != ErrInvalidInput {
+		t.Fatalf("expected ErrInvalidInput, got '%v'", err)
+	}
+	json, err := SetOptions(``, "a", 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, err = SetRawOptions(json, "b", `[1]`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":1,"b":[1]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":1,"b":[1]}`, json)
+	}
+	if _, err := SetOptions(`{"a":1`, "b", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMoveElement(t *testing.T) {
+	json := `{"list":["a", {"b":1}, "c", "d"]}`
+	for _, tc := range []struct {
+		from, to int
+		expected string
+	}{
+		{0, 2, `{"list":[{"b":1},"c","a","d"]}`},
+		{3, 0, `{"list":["d","a",{"b":1},"c"]}`},
+		{-1, 1, `{"list":["a","d",{"b":1},"c"]}`},
+		{1, -1, `{"list":["a","c","d",{"b":1}]}`},
+		{2, 2, json},
+	} {
+		res, err := MoveElement(json, "list", tc.from, tc.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	res, err := MoveElementBytes([]byte(`[[1,2,3]]`), "0", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != `[[2,1,3]]` {
+		t.Fatalf("expected '%v', got '%v'", `[[2,1,3]]`, string(res))
+	}
+	if _, err := MoveElement(json, "list", 4, 0); err == nil {
+		t.Fatal("expected out of range error")
+	}
+	if _, err := MoveElement(json, "list", 0, -5); err == nil {
+		t.Fatal("expected out of range error")
+	}
+	if _, err := MoveElement(`{"list":{}}`, "list", 0, 0); err == nil {
+		t.Fatal("expected error for non-array value")
+	}
+	out, err := MoveElement(`{"1":["a","b","c"]}`, ":1", 0, 2)
+	if err != nil || out != `{"1":["b","c","a"]}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"1":["b","c","a"]}`, out, err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	json := ` {"users":{"2313":{"name":"Sara"}},"friends":[{"last":"Murphy","nets":["fb"]}]}`
+	plan, err := Plan(json, "users.:2313.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 3 {
+		t.Fatalf("expected 3 steps, got %d", len(plan.Steps))
+	}
+	for _, step := range plan.Steps {
+		if !step.Exists || step.Kind != KeySegment {
+			t.Fatalf("unexpected step %+v", step)
+		}
+	}
+	last := plan.Steps[2]
+	if last.Key != "name" || json[last.Index:last.Index+last.Len] != `"Sara"` {
+		t.Fatalf("unexpected step %+v", last)
+	}
+	plan, err = Plan(json, `friends.#(last="Murphy").nets.-1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, step := range plan.Steps {
+		kinds = append(kinds, fmt.Sprintf("%s:%v", step.Kind, step.Exists))
+	}
+	if fmt.Sprint(kinds) != "[key:true query:true key:true append:false]" {
+		t.Fatalf("unexpected kinds %v", kinds)
+	}
+	step := plan.Steps[2]
+	if json[step.Index:step.Index+step.Len] != `["fb"]` {
+		t.Fatalf("unexpected step %+v", step)
+	}
+	plan, err = Plan(json, `friends.#.nets.0.x.y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds = kinds[:0]
+	for _, step := range plan.Steps {
+		kinds = append(kinds, fmt.Sprintf("%s:%v", step.Kind, step.Exists))
+	}
+	if fmt.Sprint(kinds) !=
+		"[key:true wildcard:true key:true index:true key:false key:false]" {
+		t.Fatalf("unexpected kinds %v", kinds)
+	}
+	// offsets are into the original json, including leading whitespace
+	plan, err = Plan("\n\t  {\"a\":{\"b\":\"x\"}}", "a.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step := plan.Steps[1]; step.Index != 14 || step.Len != 3 {
+		t.Fatalf("unexpected step %+v", step)
+	}
+	// the same resolution as Set
+	json = `{"-1":{"a":1,"a":2},"g":{"x":1,"y":{"z":3}},"Name":"x","arr":[]}`
+	for _, tc := range []struct {
+		path  string
+		opts  *Options
+		kinds string
+		value string
+	}{
+		{"-1.a", nil, "[key:true key:true]", "2"},
+		{"g.*.z", nil, "[key:true glob:true key:true]", "3"},
+		{"name", &Options{CaseInsensitiveKeys: true}, "[key:true]", `"x"`},
+		{"arr.0", &Options{ForceObjectKeys: true}, "[key:true key:false]", ""},
+		{"arr.-1", nil, "[key:true append:false]", ""},
+	} {
+		plan, err := PlanOptions(json, tc.path, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds = kinds[:0]
+		for _, step := range plan.Steps {
+			kinds = append(kinds, fmt.Sprintf("%s:%v", step.Kind, step.Exists))
+		}
+		if fmt.Sprint(kinds) != tc.kinds {
+			t.Fatalf("%s: unexpected kinds %v", tc.path, kinds)
+		}
+		last := plan.Steps[len(plan.Steps)-1]
+		if last.Exists && json[last.Index:last.Index+last.Len] != tc.value {
+			t.Fatalf("%s: unexpected step %+v", tc.path, last)
+		}
+	}
+	if _, err := Plan(json, `friends.#(last="Murphy"`); err == nil {
+		t.Fatal("expected error for unterminated query")
+	}
+	if _, err := Plan(json, ``); err == nil {
+		t.Fatal("expected error for empty path")
+	}
+}
+
+func TestSetFirstExisting(t *testing.T) {
+	paths := []string{"spec.replicas", "replicas"}
+	json, path, err := SetFirstExisting(`{"spec":{"replicas":1}}`, paths, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "spec.replicas" || json != `{"spec":{"replicas":3}}` {
+		t.Fatalf("unexpected result '%v' '%v'", path, json)
+	}
+	json, path, err = SetFirstExisting(`{"spec":{}}`, paths, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "spec.replicas" || json != `{"spec":{"replicas":3}}` {
+		t.Fatalf("unexpected result '%v' '%v'", path, json)
+	}
+	json, path, err = SetFirstExisting(`{"replicas":1}`, paths, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "replicas" || json != `{"replicas":3}` {
+		t.Fatalf("unexpected result '%v' '%v'", path, json)
+	}
+	json, path, err = SetFirstExisting(``, []string{"a.b", "c.d"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "c.d" || json != `{"c":{"d":3}}` {
+		t.Fatalf("unexpected result '%v' '%v'", path, json)
+	}
+	if _, _, err := SetFirstExisting(`{}`, nil, 3); err == nil {
+		t.Fatal("expected error for no paths")
+	}
+	opts := &FirstExistingOptions{MissingParentError: true}
+	json, path, err = SetFirstExistingOptions(`{"x":1}`,
+		[]string{"spec.replicas", "config.replicas"}, 3, opts)
+	if err == nil || json != `{"x":1}` || path != "" {
+		t.Fatalf("expected error, got '%v' '%v'", path, json)
+	}
+	json, path, err = SetFirstExistingOptions(`{"spec":{}}`, paths, 3, opts)
+	if err != nil || path != "spec.replicas" ||
+		json != `{"spec":{"replicas":3}}` {
+		t.Fatalf("unexpected result '%v' '%v', %v", path, json, err)
+	}
+}
+
+func TestSetBytesWithDiff(t *testing.T) {
+	json := []byte(`{"name":"Tom","users":{"2313":{"age":1}},"list":[{"a":1},{"a":2}]}`)
+	for _, tc := range []struct {
+		path  string
+		value interface{}
+		diff  string
+	}{
+		{"name", "Sara", `name: "Tom" -> "Sara"`},
+		{"age", 37, `age: (absent) -> 37`},
+		{"users.:2313.age", 2, `users.:2313.age: 1 -> 2`},
+		{"list.-1", map[string]int{"a": 3}, `list.-1: (absent) -> {"a":3}`},
+		{"list.#.a", true, "list.0.a: 1 -> true\nlist.1.a: 2 -> true"},
+	} {
+		_, diff, err := SetBytesWithDiff(json, tc.path, tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff != tc.diff {
+			t.Fatalf("expected '%v', got '%v'", tc.diff, diff)
+		}
+	}
+	res, diff, err := DeleteBytesWithDiff(json, "list.#.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "list.0.a: 1 -> (removed)\nlist.1.a: 2 -> (removed)" {
+		t.Fatalf("unexpected diff '%v'", diff)
+	}
+	if gjson.GetBytes(res, "list").Raw != `[{},{}]` {
+		t.Fatalf("unexpected result '%v'", string(res))
+	}
+	_, diff, err = DeleteBytesWithDiff(json, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Fatalf("expected empty diff, got '%v'", diff)
+	}
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	opts := &Options{CaseInsensitiveKeys: true}
+	json := ` {"Name":{"First":"Tom"},"AGE":37}`
+	res, err := SetOptions(json, "name.first", "Sara", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != ` {"Name":{"First":"Sara"},"AGE":37}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, err = SetOptions(json, "name.Last", "Smith", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != ` {"Name":{"First":"Tom","Last":"Smith"},"AGE":37}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, err = DeleteOptions(json, "age", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != ` {"Name":{"First":"Tom"}}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	// the first matching key wins
+	res, err = SetOptions(`{"KEY":1,"key":2}`, "Key", 3,
+		&Options{CaseInsensitiveKeys: true, Optimistic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"KEY":3,"key":2}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	// an exact match is preferred
+	res, err = SetOptions(`{"KEY":1,"key":2}`, "key", 3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"KEY":1,"key":3}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, err = DeleteOptions(`{"KEY":1,"key":2}`, "KEY", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"key":2}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	// escaped keys and missing keys deeper in the path
+	res, err = SetOptions(`{"Fav.Movie":{"A":[1,{"B":2}]}}`,
+		`fav\.movie.a.1.b`, 3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"Fav.Movie":{"A":[1,{"B":3}]}}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, err = SetOptions(`{"Fav":{}}`, "FAV.New.Key", 3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"Fav":{"New":{"Key":3}}}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	// without the option a new key is added
+	res, err = Set(json, "age", 38)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"Name":{"First":"Tom"},"AGE":37,"age":38}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+}
+
+func TestSetBytesDelta(t *testing.T) {
+	json := []byte(`{"name":"Tom"}`)
+	for _, tc := range []struct {
+		path  string
+		value interface{}
+		delta int
+	}{
+		{"name", "Sara", 1},
+		{"name", "T", -2},
+		{"name", "Tim", 0},
+		{"age", 37, 9},
+		{"missing.#.x", 1, 0},
+	} {
+		res, delta, err := SetBytesDelta(json, tc.path, tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta != tc.delta || len(res)-len(json) != delta {
+			t.Fatalf("expected %d, got %d", tc.delta, delta)
+		}
+	}
+}
+
+func TestCreateOnFilterMiss(t *testing.T) {
+	opts := &Options{CreateOnFilterMiss: true}
+	json, err := SetOptions(`{}`, `items.#(id="x").value`, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"items":[{"id":"x","value":1}]}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	json, err = SetOptions(json, `items.#(id=="y").value`, 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, err = SetOptions(json, `items.#(id="x").value`, 3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, err = SetOptions(json, `items.#(id="y").extra.a`, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"items":[{"id":"x","value":3},{"id":"y","value":2,"extra":{"a":true}}]}`
+	if json != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, json)
+	}
+	json, err = SetOptions(`{"items":[]}`, `items.#(n=5).name`, "five", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"items":[{"n":5,"name":"five"}]}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	if _, err := SetOptions(`{}`, `items.#(n>5).name`, "x", opts); err == nil {
+		t.Fatal("expected error for non-equality query")
+	}
+	// without the option nothing is created
+	json, err = Set(`{}`, `items.#(id="x").value`, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	json := `{"a":"","b":{"c":null,"d":[]},"e":0,"f":[{},{"g":""},1],"h":"x"}`
+	res, err := Compact(json, CompactOptions{EmptyStrings: true, Nulls: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"b":{"d":[]},"e":0,"f":[{},{},1],"h":"x"}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	res, err = Compact(json, CompactOptions{EmptyStrings: true, Nulls: true,
+		EmptyArrays: true, EmptyObjects: true, Zeros: true,
+		EmptyObjectElements: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"f":[1],"h":"x"}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	// untouched documents keep their formatting
+	json = "{ \"a\" : 1,\n  \"b\": [ 2 ] }"
+	res, err = Compact(json, CompactOptions{Nulls: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != json {
+		t.Fatalf("expected '%v', got '%v'", json, res)
+	}
+	bres, err := CompactBytes([]byte(`[{"a":null}]`), CompactOptions{Nulls: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bres) != `[{}]` {
+		t.Fatalf("expected '%v', got '%v'", `[{}]`, string(bres))
+	}
+	if _, err := Compact(`{"a":`, CompactOptions{}); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+}
+
+func TestSetRawOrString(t *testing.T) {
+	for _, tc := range []struct{ value, expected string }{
+		{`{"a":1}`, `{"v":{"a":1}}`},
+		{`hello`, `{"v":"hello"}`},
+		{`"hello"`, `{"v":"hello"}`},
+		{`12`, `{"v":12}`},
+		{`true`, `{"v":true}`},
+		{`{"a":`, `{"v":"{\"a\":"}`},
+	} {
+		res, err := SetRawOrString(`{}`, "v", tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	json := []byte(`{"a":{"b":{"c":1,"d":[1,2]}},"e":true}`)
+	cur, err := At(json, "a.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, cur, err = cur.Set(json, "c", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cursor is for the whole value, not only the edited value
+	if raw := string(cur.Raw(json)); raw != `{"c":"hello","d":[1,2]}` {
+		t.Fatalf("unexpected cursor value '%v'", raw)
+	}
+	json, cur, err = cur.SetRaw(json, "d.-1", []byte(`{"x":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json, cur, err = cur.Delete(json, "d.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"a":{"b":{"c":"hello","d":[2,{"x":3}]}},"e":true}`
+	if string(json) != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, string(json))
+	}
+	if raw := string(cur.Raw(json)); raw != gjson.GetBytes(json, "a.b").Raw {
+		t.Fatalf("unexpected cursor value '%v'", raw)
+	}
+	if _, err := At(json, "a.x"); err == nil {
+		t.Fatal("expected error for missing path")
+	}
+	if _, err := At(json, "a.b.d.#.x"); err == nil {
+		t.Fatal("expected error for computed result")
+	}
+}
+
+func TestInvalidFloat(t *testing.T) {
+	nullOpts := &Options{InvalidFloat: NullOnInvalidFloat}
+	for _, f := range []float64{math.Inf(1), math.Inf(-1), math.NaN()} {
+		if _, err := Set(`{}`, "a", f); err == nil {
+			t.Fatalf("expected error for %v", f)
+		}
+		if _, err := SetFloat(`{}`, "a", f); err == nil {
+			t.Fatalf("expected error for %v", f)
+		}
+		if _, err := Set(`{"a":[{},{}]}`, "a.#.v", float32(f)); err == nil {
+			t.Fatalf("expected error for %v", f)
+		}
+		res, err := SetOptions(`{}`, "a", f, nullOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != `{"a":null}` {
+			t.Fatalf("expected '%v', got '%v'", `{"a":null}`, res)
+		}
+		res, err = SetFloatOptions(`{}`, "a", f, nullOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != `{"a":null}` {
+			t.Fatalf("expected '%v', got '%v'", `{"a":null}`, res)
+		}
+		res, err = SetOptions(`{"a":[{},{}]}`, "a.#.v", f, nullOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != `{"a":[{"v":null},{"v":null}]}` {
+			t.Fatalf("expected '%v', got '%v'", `{"a":[{"v":null},{"v":null}]}`,
+				res)
+		}
+	}
+	res, err := SetFloat(`{}`, "a", 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":1.5}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":1.5}`, res)
+	}
+}
+
+func TestSetSlice(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{[]int{1, 2, 3}, `{"a":[1,2,3]}`},
+		{[]string{"x", `y"z`}, `{"a":["x","y\"z"]}`},
+		{[]interface{}{1, "two", 3.5, true, nil, []int{4}},
+			`{"a":[1,"two",3.5,true,null,[4]]}`},
+		{[2]float64{1, 1e21}, `{"a":[1,1000000000000000000000]}`},
+		{[]int(nil), `{"a":null}`},
+		{[]int{}, `{"a":[]}`},
+	} {
+		res, err := Set(`{}`, "a", tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	res, err := SetSlice(`{}`, "a", []float64{0.5, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":[0.5,2]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[0.5,2]}`, res)
+	}
+	if _, err := SetSlice(`{}`, "a", []float64{math.NaN()}); err == nil {
+		t.Fatal("expected error for NaN element")
+	}
+}
+
+func TestSetMap(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{map[int]string{2: "b", 1: "a", 10: "c"},
+			`{"a":{"1":"a","10":"c","2":"b"}}`},
+		{map[string]float64{"x": 1e21}, `{"a":{"x":1000000000000000000000}}`},
+		{map[string][]byte{"x": []byte(`[1]`)}, `{"a":{"x":[1]}}`},
+		{map[string]interface{}{"z": 1, "a": []int{1}, "m": map[uint8]bool{3: true}},
+			`{"a":{"a":[1],"m":{"3":true},"z":1}}`},
+		{map[string]int(nil), `{"a":null}`},
+		{map[string]int{}, `{"a":{}}`},
+	} {
+		res, err := Set(`{}`, "a", tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	// maps are encoded the same as encoding/json
+	value := map[int]interface{}{-1: 1.5, 20: "x", 3: nil}
+	res, err := Set(`{}`, "a", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := jsongo.Marshal(value)
+	if res != `{"a":`+string(b)+`}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":`+string(b)+`}`, res)
+	}
+	// values use the same options as a single value
+	res, err = SetOptions(`{}`, "a", map[string]float64{"x": math.NaN()},
+		&Options{InvalidFloat: NullOnInvalidFloat})
+	if err != nil || res != `{"a":{"x":null}}` {
+		t.Fatalf("unexpected result '%v', %v", res, err)
+	}
+	if _, err = Set(`{}`, "a", map[string]float64{"x": math.NaN()}); err == nil {
+		t.Fatal("expected error for NaN")
+	}
+	if _, err = Set(`{}`, "a", map[[2]int]int{{1, 2}: 3}); err == nil {
+		t.Fatal("expected error for unsupported key type")
+	}
+}
+
+func TestMustSet(t *testing.T) {
+	json := MustSet(`{}`, "a.b", 1)
+	json = MustSetRaw(json, "c", `[1,2]`)
+	json = MustDelete(json, "c.0")
+	if json != `{"a":{"b":1},"c":[2]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":{"b":1},"c":[2]}`, json)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	MustSet(`{}`, "a.#(b==1", 1)
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	for _, opts := range []*Options{nil, {Optimistic: true}} {
+		json, err := SetOptions(`{"a":1,"a":2}`, "a", 9, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if json != `{"a":1,"a":9}` {
+			t.Fatalf("expected '%v', got '%v'", `{"a":1,"a":9}`, json)
+		}
+		json, err = SetOptions(`{"x":{"a":1,"b":2,"a":{"c":3}}}`, "x.a.c", 9, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if json != `{"x":{"a":1,"b":2,"a":{"c":9}}}` {
+			t.Fatalf("expected '%v', got '%v'", `{"x":{"a":1,"b":2,"a":{"c":9}}}`, json)
+		}
+		// only keys of the same object are duplicates
+		json, err = SetOptions(`{"x":{"a":1,"y":{"a":2}},"a":3}`, "x.a", 9, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if json != `{"x":{"a":9,"y":{"a":2}},"a":3}` {
+			t.Fatalf("unexpected result '%v'", json)
+		}
+		json, err = SetOptions(`{"x":{"a":1},"x":{"a":2,"s":"\u0022a\""}}`, "x.a", 9, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if json != `{"x":{"a":1},"x":{"a":9,"s":"\u0022a\""}}` {
+			t.Fatalf("unexpected result '%v'", json)
+		}
+	}
+	json, err := SetOptions(`{"a":1,"a":2}`, "a", 9,
+		&Options{EditFirstDuplicate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":9,"a":2}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":9,"a":2}`, json)
+	}
+	json, err = SetOptions(`{"a":1,"a":2}`, "a", 9,
+		&Options{EditFirstDuplicate: true, Optimistic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":9,"a":2}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":9,"a":2}`, json)
+	}
+	json, err = Delete(`{"a":1,"b":0,"a":2}`, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":1,"b":0}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":1,"b":0}`, json)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	for _, tc := range []struct{ json, expected string }{
+		{`{ "b" : 1, "a" : [ 3 , 1 ] }`, `{"a":[3,1],"b":1}`},
+		{`{"z":{"y":1,"x":{"d":true,"c":null}},"a":"s"}`,
+			`{"a":"s","z":{"x":{"c":null,"d":true},"y":1}}`},
+		{`[1.0, 1e2, 1E2, -0, 0.0, 1.50, 1e21, 0.0000001, 123456789012]`,
+			`[1,100,100,0,0,1.5,1e+21,1e-7,123456789012]`},
+		{`{"s":"A\/é\n\u0001"}`, "{\"s\":\"A/é\\n\\u0001\"}"},
+		{`{"b":1,"a":2}`, `{"a":2,"b":1}`},
+		{`"x"`, `"x"`},
+		{`[]`, `[]`},
+	} {
+		res, err := Canonical(tc.json)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+		// canonical json is stable
+		res2, err := Canonical(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res2 != res {
+			t.Fatalf("expected '%v', got '%v'", res, res2)
+		}
+	}
+	if _, err := Canonical(`{"a":1`); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+}
+
+func TestPathBuilder(t *testing.T) {
+	var b PathBuilder
+	path, err := b.Key("fav.movie").Index(2).Key("12").Key("a*b?").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != `fav\.movie.2.:12.a\*b\?` {
+		t.Fatalf("unexpected path '%v'", path)
+	}
+	comps, err := splitComponents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := []SegmentKind{KeySegment, IndexSegment, KeySegment, KeySegment}
+	keys := []string{"fav.movie", "2", "12", "a*b?"}
+	for i, comp := range comps {
+		kind, key := classifyComponent(comp)
+		if kind != kinds[i] || key != keys[i] {
+			t.Fatalf("expected %v '%v', got %v '%v'", kinds[i], keys[i], kind, key)
+		}
+	}
+
+	b = PathBuilder{}
+	path = b.Key("items").Filter("id.x", "==", `say "hi"`).Key("v").String()
+	if path != `items.#(id\.x=="say \"hi\"").v` {
+		t.Fatalf("unexpected path '%v'", path)
+	}
+	json := `{"items":[{"id.x":"nope","v":1},{"id.x":"say \"hi\"","v":2}]}`
+	if res := gjson.Get(json, path); res.Raw != "2" {
+		t.Fatalf("expected '%v', got '%v'", 2, res.Raw)
+	}
+	json, err = Set(json, path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := gjson.Get(json, "items.1.v"); res.Raw != "3" {
+		t.Fatalf("expected '%v', got '%v'", 3, res.Raw)
+	}
+
+	b = PathBuilder{}
+	path = b.Key("a").Wildcard().Key("b").Append().String()
+	if path != "a.#.b.-1" {
+		t.Fatalf("unexpected path '%v'", path)
+	}
+	b = PathBuilder{}
+	path = b.Key("a").Filter("n", ">", "5").String()
+	if path != "a.#(n>5)" {
+		t.Fatalf("unexpected path '%v'", path)
+	}
+	b = PathBuilder{}
+	if _, err := b.Key("a").Filter("n", "<>", "5").Build(); err == nil {
+		t.Fatal("expected error for invalid operator")
+	}
+	b = PathBuilder{}
+	if _, err := b.Index(-2).Build(); err == nil {
+		t.Fatal("expected error for negative index")
+	}
+	b = PathBuilder{}
+	if _, err := b.Build(); err == nil {
+		t.Fatal("expected error for empty path")
+	}
+}
+
+func TestNumberEncoder(t *testing.T) {
+	opts := &Options{NumberEncoder: func(v interface{}) (string, error) {
+		switch v := v.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', 2, 64), nil
+		case jsongo.Number:
+			return string(v) + "0", nil
+		case int:
+			if v < 0 {
+				return "", fmt.Errorf("negative")
+			}
+			return strconv.Itoa(v), nil
+		}
+		return "1e", nil
+	}}
+	for _, tc := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{1.5, `{"a":1.50}`},
+		{[]interface{}{2.0, 3, "x"}, `{"a":[2.00,3,"x"]}`},
+		{jsongo.Number("12"), `{"a":120}`},
+		{"5", `{"a":"5"}`},
+	} {
+		res, err := SetOptions(`{}`, "a", tc.value, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	if _, err := SetOptions(`{}`, "a", -1, opts); err == nil {
+		t.Fatal("expected encoder error")
+	}
+	if _, err := SetOptions(`{}`, "a", uint8(1), opts); err == nil {
+		t.Fatal("expected error for invalid number")
+	}
+	res, err := SetRawOptions(`{}`, "a", `1.0`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":1.0}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":1.0}`, res)
+	}
+}
+
+func TestDeleteManyReport(t *testing.T) {
+	json := `{"user":{"name":"Tom","ssn":"123"},"cards":[{"num":"1","id":1},{"num":"2","id":2}],"x":1}`
+	out, removed, err := DeleteManyReport(json,
+		[]string{"user.ssn", "cards.#.num", "missing", "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"user":{"name":"Tom"},"cards":[{"id":1},{"id":2}]}`
+	if out != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, out)
+	}
+	expectedRemoved := map[string]string{
+		"user.ssn": `"123"`, "cards.0.num": `"1"`, "cards.1.num": `"2"`,
+		"x": "1",
+	}
+	if len(removed) != len(expectedRemoved) {
+		t.Fatalf("expected '%v', got '%v'", expectedRemoved, removed)
+	}
+	for k, v := range expectedRemoved {
+		if removed[k] != v {
+			t.Fatalf("expected '%v', got '%v'", expectedRemoved, removed)
+		}
+	}
+	bout, removed, err := DeleteManyReportBytes([]byte(`[1,2,3]`),
+		[]string{"#"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bout) != `[]` || len(removed) != 3 || removed["2"] != "3" {
+		t.Fatalf("unexpected result '%v' %v", string(bout), removed)
+	}
+	// queries and globs delete the same values as DeleteMany
+	json = `{"a":[{"n":1},{"n":2},{"n":3}],"b":{"k1":1,"k2":2,"x":3}}`
+	paths := []string{"a.#(n>1)#", "b.k*"}
+	out, removed, err = DeleteManyReport(json, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	many, err := DeleteMany(json, paths)
+	if err != nil || out != many || out != `{"a":[{"n":1}],"b":{"x":3}}` {
+		t.Fatalf("expected '%v', got '%v', %v", many, out, err)
+	}
+	if len(removed) != 4 || removed["a.1"] != `{"n":2}` ||
+		removed["a.2"] != `{"n":3}` || removed["b.k2"] != "2" {
+		t.Fatalf("unexpected removed %v", removed)
+	}
+	if _, _, err := DeleteManyReport(json, []string{"a.#(n>1"}); err == nil {
+		t.Fatal("expected error for invalid path")
+	}
+}
+
+func TestPushUnique(t *testing.T) {
+	json, added, err := PushUnique(`{}`, "tags", "a")
+	if err != nil || !added {
+		t.Fatalf("expected add, got %v %v", added, err)
+	}
+	json, added, err = PushUnique(json, "tags", "b")
+	if err != nil || !added {
+		t.Fatalf("expected add, got %v %v", added, err)
+	}
+	json, added, err = PushUnique(json, "tags", "a")
+	if err != nil || added {
+		t.Fatalf("expected no add, got %v %v", added, err)
+	}
+	if json != `{"tags":["a","b"]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"tags":["a","b"]}`, json)
+	}
+	json = `{"list":[{"a":1,"b":[1.0]}, 5]}`
+	res, added, err := PushUniqueRaw(json, "list", `{ "b":[1], "a":1e0 }`)
+	if err != nil || added || res != json {
+		t.Fatalf("expected no add, got %v %v '%v'", added, err, res)
+	}
+	res, added, err = PushUnique(json, "list", 5.0)
+	if err != nil || added || res != json {
+		t.Fatalf("expected no add, got %v %v '%v'", added, err, res)
+	}
+	res, added, err = PushUniqueRaw(json, "list", `{"a":2}`)
+	if err != nil || !added {
+		t.Fatalf("expected add, got %v %v", added, err)
+	}
+	if res != `{"list":[{"a":1,"b":[1.0]}, 5,{"a":2}]}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	if _, _, err := PushUnique(`{"a":1}`, "a", 1); err == nil {
+		t.Fatal("expected error for non-array")
+	}
+}
+
+func TestSetSorted(t *testing.T) {
+	json, err := SetSorted(`{}`, "top", `{"name":"b","score":20}`, "score")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{
+		`{"name":"c","score":5}`,
+		`{"name":"x"}`,
+		`{"name":"d","score":30}`,
+		`{"name":"e","score":20}`,
+		`{"name":"f","score":100}`,
+	} {
+		json, err = SetSorted(json, "top", raw, "score")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `["c","b","e","d","f","x"]`
+	if res := gjson.Get(json, "top.#.name").Raw; res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	json, err = SetSorted(`{"a":[ "b" , "d" ]}`, "a", `"c"`, "@this")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":[ "b" , "c","d" ]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[ "b" , "c","d" ]}`, json)
+	}
+	json, err = SetSorted(`{"a":[]}`, "a", `{"n":"x"}`, "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":[{"n":"x"}]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[{"n":"x"}]}`, json)
+	}
+	_, err = SetSortedOptions(`{"a":[]}`, "a", `{}`, "n",
+		&SortedOptions{MissingKeyError: true})
+	if err == nil {
+		t.Fatal("expected error for missing sort key")
+	}
+	if _, err := SetSorted(`{"a":{}}`, "a", `1`, "n"); err == nil {
+		t.Fatal("expected error for non-array")
+	}
+	// an empty path is the root array
+	for _, tc := range [][3]string{
+		{` [{"k":1},{"k":3}]`, `{"k":2}`, ` [{"k":1},{"k":2},{"k":3}]`},
+		{`[{"k":1}]`, `{"k":5}`, `[{"k":1},{"k":5}]`},
+		{``, `{"k":1}`, `[{"k":1}]`},
+	} {
+		json, err = SetSorted(tc[0], "", tc[1], "k")
+		if err != nil || json != tc[2] {
+			t.Fatalf("expected '%v', got '%v', %v", tc[2], json, err)
+		}
+	}
+	if _, err := SetSorted(`{"a":[]}`, "", `1`, "n"); err == nil {
+		t.Fatal("expected error for non-array root")
+	}
+}
+
+func TestSetBytesTyped(t *testing.T) {
+	for _, tc := range []struct {
+		json, path   string
+		value        interface{}
+		expected     string
+		oldTyp, nTyp string
+	}{
+		{`{"a":1}`, "a", "x", `{"a":"x"}`, "number", "string"},
+		{`{"a":1}`, "b", true, `{"a":1,"b":true}`, "absent", "boolean"},
+		{`{"a":[1,2]}`, "a", nil, `{"a":null}`, "array", "null"},
+		{`{"a":[{"v":1},{"v":"s"}]}`, "a.#.v", 2,
+			`{"a":[{"v":2},{"v":2}]}`, "mixed", "number"},
+		{`{"a":[{"v":1},{"v":3}]}`, "a.#.v", map[string]int{},
+			`{"a":[{"v":{}},{"v":{}}]}`, "number", "object"},
+	} {
+		res, oldTyp, nTyp, err := SetBytesTyped([]byte(tc.json), tc.path,
+			tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res) != tc.expected || oldTyp != tc.oldTyp ||
+			nTyp != tc.nTyp {
+			t.Fatalf("expected '%v' %v -> %v, got '%v' %v -> %v",
+				tc.expected, tc.oldTyp, tc.nTyp, string(res), oldTyp, nTyp)
+		}
+	}
+}
+
+func TestEscapedKeys(t *testing.T) {
+	for _, opts := range []*Options{nil, {Optimistic: true}} {
+		for _, tc := range []struct{ json, path, expected string }{
+			{`{"a\u002eb":1,"c":2}`, `a\.b`, `{"a\u002eb":9,"c":2}`},
+			{`{"x":{"\u0061":1},"c":2}`, `x.a`, `{"x":{"\u0061":9},"c":2}`},
+			{`{"\u00e9té":1}`, "été", `{"\u00e9té":9}`},
+			{`{"a\u0022b":1}`, `a"b`, `{"a\u0022b":9}`},
+			{`{"a":1,"\u0061":2}`, "a", `{"a":1,"\u0061":9}`},
+			{`{"ab\u0063":1,"a\u0062":2}`, "abc", `{"ab\u0063":9,"a\u0062":2}`},
+			{`{"x\u0061":1,"a":{"\n":2}}`, "a", `{"x\u0061":1,"a":9}`},
+			{`{"\\":1,"a":2}`, `\\`, `{"\\":9,"a":2}`},
+		} {
+			res, err := SetOptions(tc.json, tc.path, 9, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != tc.expected {
+				t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+			}
+		}
+	}
+	res, err := Delete(`{"a\u002eb":1,"c":2}`, `a\.b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"c":2}` {
+		t.Fatalf("expected '%v', got '%v'", `{"c":2}`, res)
+	}
+	res, err = SetOptions(`{"\u0041":1}`, "a", 9,
+		&Options{CaseInsensitiveKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"\u0041":9}` {
+		t.Fatalf("expected '%v', got '%v'", `{"\u0041":9}`, res)
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("write failed")
+}
+
+func TestSetTo(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("data: ")
+	err := SetTo(&buf, []byte(`{"a":1}`), "b", "x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `data: {"a":1,"b":"x"}` {
+		t.Fatalf("expected '%v', got '%v'", `data: {"a":1,"b":"x"}`, buf.String())
+	}
+	if err := SetTo(failWriter{}, []byte(`{}`), "a", 1, nil); err == nil {
+		t.Fatal("expected write error")
+	}
+	buf.Reset()
+	if err := SetTo(&buf, []byte(`{}`), "a.#(b==1", 1, nil); err == nil {
+		t.Fatal("expected error for invalid path")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing written, got '%v'", buf.String())
+	}
+	// replacing a value writes the json in pieces, like SetWriter
+	json := []byte(`{"a":{"b":"x"},"c":2}`)
+	for _, tc := range []struct {
+		opts   *Options
+		expect string
+		writes int
+	}{
+		{nil, `{"a":{"b":"y"},"c":2}`, 3},
+		{&Options{EscapeUnicode: true}, `{"a":{"b":"y"},"c":2}`, 3},
+		{&Options{NormalizeWhitespace: true}, `{"a":{"b":"y"},"c":2}`, 1},
+	} {
+		var w countWriter
+		if err := SetTo(&w, json, "a.b", "y", tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		if w.buf.String() != tc.expect || w.writes != tc.writes {
+			t.Fatalf("unexpected result '%v' with %d writes", w.buf.String(),
+				w.writes)
+		}
+	}
+	err = SetTo(&buf, json, "a.b", 1, &Options{PreserveType: true})
+	if err == nil || buf.Len() != 0 {
+		t.Fatalf("expected type error, got %v '%v'", err, buf.String())
+	}
+}
+
+func TestAdd(t *testing.T) {
+	for _, tc := range []struct {
+		json, path, key string
+		value           interface{}
+		expected        string
+	}{
+		{`{"a":[1,2]}`, "a", "", 3, `{"a":[1,2,3]}`},
+		{`{"a":[1,2]}`, "a", "-", 3, `{"a":[1,2,3]}`},
+		{`{"a":[1,2]}`, "a", "0", "x", `{"a":["x",1,2]}`},
+		{`{"a":[1,2]}`, "a", "1", 3, `{"a":[1,3,2]}`},
+		{`{"a":[1,2]}`, "a", "2", 3, `{"a":[1,2,3]}`},
+		{`{"a":{"b":1}}`, "a", "c", 2, `{"a":{"b":1,"c":2}}`},
+		{`{"a":{"b":1}}`, "a", "b", 2, `{"a":{"b":2}}`},
+		{`{"a":{}}`, "a", "x.y", 2, `{"a":{"x.y":2}}`},
+		{`{"a":{}}`, "a", "5", 2, `{"a":{"5":2}}`},
+		{`{}`, "a", "", 1, `{"a":[1]}`},
+		{`{}`, "a", "k", 1, `{"a":{"k":1}}`},
+	} {
+		res, err := Add(tc.json, tc.path, tc.key, tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	for _, tc := range []struct{ json, key string }{
+		{`{"a":[1]}`, "2"},
+		{`{"a":[1]}`, "x"},
+		{`{"a":[1]}`, "-1"},
+		{`{"a":{}}`, ""},
+		{`{"a":1}`, "b"},
+	} {
+		if _, err := Add(tc.json, "a", tc.key, 1); err == nil {
+			t.Fatalf("expected error for '%v' key '%v'", tc.json, tc.key)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString(`{"a":[`)
+	for i := 0; i < 500; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(`{"b":[`)
+		for j := 0; j < 20; j++ {
+			if j > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(`{"c":1}`)
+		}
+		sb.WriteString(`]}`)
+	}
+	sb.WriteString(`]}`)
+	json := sb.String()
+	_, err := SetOptions(json, "a.#.b.#.c", 2, &Options{Timeout: time.Nanosecond})
+	if err != ErrTimeout {
+		t.Fatalf("expected '%v', got '%v'", ErrTimeout, err)
+	}
+	res, err := SetOptions(json, "a.#.b.#.c", 2, &Options{Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.Get(res, "a.499.b.19.c").Int() != 2 {
+		t.Fatal("expected value to be set")
+	}
+}
+
+func TestMatchIndent(t *testing.T) {
+	opts := &Options{MatchIndent: true}
+	json := "{\n  \"a\": {\n    \"b\": 1\n  },\n  \"c\": 2\n}"
+	res, err := SetRawOptions(json, "a.b", `{"x":[1,2],"y":{"z":true}}`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\n  \"a\": {\n    \"b\": {\n      \"x\": [1, 2],\n" +
+		"      \"y\": {\n        \"z\": true\n      }\n    }\n  },\n  \"c\": 2\n}"
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	res, err = SetRawOptions(`{"a":1}`, "a", "{\n  \"b\": [\n    1\n  ]\n}", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":{"b":[1]}}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":{"b":[1]}}`, res)
+	}
+	res, err = SetOptions("{\n\t\"a\": 1\n}", "a", map[string]int{"b": 1}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "{\n\t\"a\": {\n\t\t\"b\": 1\n\t}\n}" {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	// raw values are left as is by default
+	res, err = SetRaw(`{"a":1}`, "a", "{ \"b\" : 1 }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":{ "b" : 1 }}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":{ "b" : 1 }}`, res)
+	}
+}
+
+func TestSetComputed(t *testing.T) {
+	json := `{"items":[{"price":1.5,"qty":2},{"price":4,"qty":1}]}`
+	res, err := SetComputed(json, "total", func(doc gjson.Result) (interface{}, error) {
+		var total float64
+		doc.Get("items").ForEach(func(_, item gjson.Result) bool {
+			total += item.Get("price").Float() * item.Get("qty").Float()
+			return true
+		})
+		return total, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"items":[{"price":1.5,"qty":2},{"price":4,"qty":1}],"total":7}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	_, err = SetComputed(json, "total", func(gjson.Result) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	if err == nil || err.Error() != "failed" {
+		t.Fatalf("expected '%v', got '%v'", "failed", err)
+	}
+}
+
+func TestDeleteArrayReplacement(t *testing.T) {
+	opts := &Options{DeleteArrayReplacement: `{"deleted":true}`}
+	for _, tc := range []struct{ json, path, expected string }{
+		{`{"a":[1,2,3]}`, "a.1", `{"a":[1,{"deleted":true},3]}`},
+		{`{"a":[1,2,3]}`, "a.-1", `{"a":[1,2,{"deleted":true}]}`},
+		{`[[1,2]]`, "0.0", `[[{"deleted":true},2]]`},
+		{`{"a":{"b":1,"c":2}}`, "a.b", `{"a":{"c":2}}`},
+		{`{"a":[1]}`, "a.5", `{"a":[1]}`},
+	} {
+		res, err := DeleteOptions(tc.json, tc.path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	res, err := DeleteBytesOptions([]byte(`[1,2]`), "0",
+		&Options{DeleteArrayReplacement: "null"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != `[null,2]` {
+		t.Fatalf("expected '%v', got '%v'", `[null,2]`, string(res))
+	}
+}
+
+func TestSetConcatenated(t *testing.T) {
+	for _, tc := range []struct{ input, expected string }{
+		{`{"a":1}{"a":2}`, `{"a":9}{"a":9}`},
+		{"{\"a\":1}\n\n {}\r\n\t{\"b\":[]}\n",
+			"{\"a\":9}\n\n {\"a\":9}\r\n\t{\"b\":[],\"a\":9}\n"},
+		{"", ""},
+		{"  ", "  "},
+	} {
+		res, err := SetConcatenated(tc.input, "a", 9, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	for _, input := range []string{`{"a":1},{"a":2}`, `{"a":1}{"a":`, "{}\x00{}"} {
+		if _, err := SetConcatenated(input, "a", 9, nil); err == nil {
+			t.Fatalf("expected error for '%v'", input)
+		}
+	}
+}
+
+func TestSetWhereIndex(t *testing.T) {
+	even := func(i int) bool { return i%2 == 0 }
+	json := `{"a":[{"v":0},{"v":1},{"v":2},{"v":3}]}`
+	res, err := SetWhereIndex(json, "a", even, "v", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"a":[{"v":"x"},{"v":1},{"v":"x"},{"v":3}]}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	res, err = SetWhereIndex(`[1, 2, 3, 4]`, "@this",
+		func(i int) bool { return i%3 == 0 }, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `[null, 2, 3, null]` {
+		t.Fatalf("expected '%v', got '%v'", `[null, 2, 3, null]`, res)
+	}
+	bres, err := SetWhereIndexBytes([]byte(json), "a", even, "w.z", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"a":[{"v":0,"w":{"z":true}},{"v":1},{"v":2,"w":{"z":true}},{"v":3}]}`
+	if string(bres) != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, string(bres))
+	}
+	res, err = DeleteWhereIndex(json, "a", even, "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":[{},{"v":1},{},{"v":3}]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[{},{"v":1},{},{"v":3}]}`, res)
+	}
+	res, err = DeleteWhereIndex(json, "a", even, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":[{"v":1},{"v":3}]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[{"v":1},{"v":3}]}`, res)
+	}
+	if _, err := SetWhereIndex(`{"a":1}`, "a", even, "", 1); err == nil {
+		t.Fatal("expected error for non-array")
+	}
+}
+
+func TestSetBytesChecksum(t *testing.T) {
+	res, sum, err := SetBytesChecksum([]byte(`{"a":1}`), "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != `{"a":2}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":2}`, string(res))
+	}
+	// FNV-1a 64 of {"a":2}
+	if sum != 0x9c3b82dd6fc8b2da {
+		t.Fatalf("unexpected checksum %x", sum)
+	}
+	_, sum2, err := SetBytesChecksum([]byte(`{"a":3}`), "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum2 != sum {
+		t.Fatalf("expected %x, got %x", sum, sum2)
+	}
+	// the result and checksum match SetBytes for every kind of edit
+	json := []byte(`{"a":[{"b":1},{"b":2}], "c":"x"}`)
+	for _, tc := range []struct {
+		path  string
+		value interface{}
+	}{
+		{"c", `y\`}, {"d", true}, {"a.#.b", 3}, {"a.0", dtype{}},
+		{"a.-1", map[string]int{"b": 4}}, {"x.y", nil}, {"zz", dtype{}},
+	} {
+		res, sum, err := SetBytesChecksum(json, tc.path, tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, _ := SetBytes(json, tc.path, tc.value)
+		h := fnv.New64a()
+		h.Write(exp)
+		if string(res) != string(exp) || sum != h.Sum64() {
+			t.Fatalf("%v: expected '%s' %x, got '%s' %x", tc.path, exp,
+				h.Sum64(), res, sum)
+		}
+	}
+	if _, _, err := SetBytesChecksum(json, "a.#(", 1); err == nil {
+		t.Fatal("expected error for invalid path")
+	}
+}
+
+func TestTruthyQueries(t *testing.T) {
+	json := `{"vals":[{"a":1,"b":"data"},{"a":2,"b":true},{"a":3,"b":false},` +
+		`{"a":4,"b":"0"},{"a":5,"b":0},{"a":6,"b":"1"},{"a":7,"b":1},` +
+		`{"a":8,"b":"true"},{"a":9,"b":false},{"a":10,"b":null},{"a":11}]}`
+	for _, tc := range []struct{ query, expected string }{
+		{`b==~true`, `[2,6,7,8]`},
+		{`b==~false`, `[3,4,5,9,10,11]`},
+		{`b==~null`, `[10,11]`},
+		{`b==~*`, `[1,2,3,4,5,6,7,8,9,10]`},
+		{`b!=~*`, `[11]`},
+	} {
+		// the selection must be the same as gjson
+		if res := gjson.Get(json, "vals.#("+tc.query+")#.a").Raw; res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+		res, err := Set(json, "vals.#("+tc.query+")#.x", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sel := gjson.Get(res, "vals.#(x==true)#.a").Raw; sel != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, sel)
+		}
+		res, err = Delete(json, "vals.#("+tc.query+")#")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := gjson.Get(res, "vals.#").Int() + gjson.Get(
+			tc.expected, "#").Int(); n != 11 {
+			t.Fatalf("expected 11 values, got %d in '%v'", n, res)
+		}
+		if sel := gjson.Get(res, "vals.#("+tc.query+")#.a").Raw; sel != `[]` {
+			t.Fatalf("expected '[]', got '%v'", sel)
+		}
+		// only the first match
+		first := gjson.Get(tc.expected, "0").Raw
+		res, err = Set(json, "vals.#("+tc.query+").y", "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sel := gjson.Get(res, `vals.#(y=="first")#.a`).Raw; sel != "["+first+"]" {
+			t.Fatalf("expected '%v', got '%v'", "["+first+"]", sel)
+		}
+		res, err = Delete(json, "vals.#("+tc.query+")")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gjson.Get(res, "vals.#(a=="+first+")").Exists() ||
+			gjson.Get(res, "vals.#").Int() != 10 {
+			t.Fatalf("unexpected result '%v'", res)
+		}
+	}
+}
+
+func TestSetAllSuffix(t *testing.T) {
+	json := `{"enabled":true,"a":{"enabled":1,"b":[{"enabled":"yes"},{"x":1}]},` +
+		`"c":["enabled"],"d":{"enabled":{"enabled":true}}}`
+	res, err := SetAllSuffix(json, "enabled", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"enabled":false,"a":{"enabled":false,"b":[{"enabled":false},{"x":1}]},` +
+		`"c":["enabled"],"d":{"enabled":false}}`
+	if res != expected {
+		t.Fatalf("expected '%v', got '%v'", expected, res)
+	}
+	bres, err := SetAllSuffixBytes([]byte(`[{"n":1},{"m":2}]`), "n", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bres) != `[{"n":"x"},{"m":2}]` {
+		t.Fatalf("expected '%v', got '%v'", `[{"n":"x"},{"m":2}]`, string(bres))
+	}
+}
+
+func TestBump(t *testing.T) {
+	json, n, err := Bump(`{}`, "stats.hits", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"stats":{"hits":1}}` || n != 1 {
+		t.Fatalf("unexpected result '%v' %v", json, n)
+	}
+	json, n, err = Bump(json, "stats.hits", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"stats":{"hits":3}}` || n != 3 {
+		t.Fatalf("unexpected result '%v' %v", json, n)
+	}
+	json, n, err = Bump(json, "stats.hits", -0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"stats":{"hits":2.5}}` || n != 2.5 {
+		t.Fatalf("unexpected result '%v' %v", json, n)
+	}
+	if _, _, err := Bump(`{"a":"1"}`, "a", 1); err == nil {
+		t.Fatal("expected error for non-number")
+	}
+	if _, _, err := Bump(`{"a":1e308}`, "a", 1e308); err == nil {
+		t.Fatal("expected error for infinite result")
+	}
+}
+
+func TestSetRawEmpty(t *testing.T) {
+	for _, value := range []string{"", "  ", "\n"} {
+		if _, err := SetRaw(`{"a":1}`, "a", value); err != ErrEmptyRaw {
+			t.Fatalf("expected '%v', got '%v'", ErrEmptyRaw, err)
+		}
+		if _, err := SetRawBytes([]byte(`{}`), "a", []byte(value)); err != ErrEmptyRaw {
+			t.Fatalf("expected '%v', got '%v'", ErrEmptyRaw, err)
+		}
+	}
+	res1, err := SetRaw(`{"a":1}`, "a", "null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2, err := Set(`{"a":1}`, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res1 != `{"a":null}` || res1 != res2 {
+		t.Fatalf("expected '%v', got '%v' and '%v'", `{"a":null}`, res1, res2)
+	}
+}
+
+func TestSetInEncoded(t *testing.T) {
+	reverse := func(data []byte) ([]byte, error) {
+		out := make([]byte, len(data))
+		for i, c := range data {
+			out[len(data)-1-i] = c
+		}
+		return out, nil
+	}
+	json := `{"doc":"}1:\"a\"{"}`
+	res, err := SetInEncoded(json, "doc", "b", "x", reverse, reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner, _ := reverse([]byte(gjson.Get(res, "doc").Str)); string(inner) != `{"a":1,"b":"x"}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":1,"b":"x"}`, string(inner))
+	}
+	fail := func([]byte) ([]byte, error) { return nil, fmt.Errorf("failed") }
+	if _, err := SetInEncoded(json, "doc", "b", 1, fail, reverse); err == nil {
+		t.Fatal("expected decode error")
+	}
+	if _, err := SetInEncoded(json, "doc", "b", 1, reverse, fail); err == nil {
+		t.Fatal("expected encode error")
+	}
+	if _, err := SetInEncoded(`{"doc":"{"}`, "doc", "b", 1, reverse, reverse); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+	if _, err := SetInEncoded(`{"doc":1}`, "doc", "b", 1, reverse, reverse); err == nil {
+		t.Fatal("expected error for non-string field")
+	}
+}
+
+func TestSetExpectingParent(t *testing.T) {
+	for _, tc := range []struct {
+		json, path string
+		kind       Kind
+		expected   string
+	}{
+		{`{"a":{"b":1}}`, "a.b", ObjectKind, `{"a":{"b":2}}`},
+		{`{"a":[1]}`, "a.0", ArrayKind, `{"a":[2]}`},
+		{`{"a":[1]}`, "a.-1", ArrayKind, `{"a":[1,2]}`},
+		{`{}`, "a.b", ObjectKind, `{"a":{"b":2}}`},
+		{`{}`, "a", ObjectKind, `{"a":2}`},
+		{`{"a":[{},{}]}`, "a.#.b", ObjectKind, `{"a":[{"b":2},{"b":2}]}`},
+	} {
+		res, err := SetExpectingParent(tc.json, tc.path, 2, tc.kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expected {
+			t.Fatalf("expected '%v', got '%v'", tc.expected, res)
+		}
+	}
+	for _, tc := range []struct {
+		json, path string
+		kind       Kind
+	}{
+		{`{"a":[1]}`, "a.0", ObjectKind},
+		{`{"a":{"0":1}}`, "a.0", ArrayKind},
+		{`{"a":"x"}`, "a.b", ObjectKind},
+		{`[1]`, "0", ObjectKind},
+		{`{"a":[{},[]]}`, "a.#.0", ObjectKind},
+	} {
+		if _, err := SetExpectingParent(tc.json, tc.path, 2, tc.kind); err == nil {
+			t.Fatalf("expected error for '%v' at '%v'", tc.json, tc.path)
+		}
+	}
+}
+
+func TestMaxResultDepth(t *testing.T) {
+	opts := &Options{MaxResultDepth: 3}
+	for _, tc := range []struct {
+		path, raw string
+		ok        bool
+	}{
+		{"a.b.c", `1`, true},
+		{"a.b.c.d", `1`, false},
+		{"a.b", `{"c":1}`, true},
+		{"a.b", `{"c":[1]}`, false},
+		{"a.b", `"{[{[{["`, true},
+		{"a.#.b", `1`, true},
+		{"a", `[{"x":"]]]]"}]`, true},
+		{"a", `[[[[1]]]]`, false},
+	} {
+		_, err := SetRawOptions(`{}`, tc.path, tc.raw, opts)
+		if (err == nil) != tc.ok {
+			t.Fatalf("unexpected error for '%v' '%v': %v", tc.path, tc.raw, err)
+		}
+	}
+	if _, err := SetOptions(`{}`, "a.b", map[string][]int{"c": {1}}, opts); err == nil {
+		t.Fatal("expected error for deep value")
+	}
+	if _, err := SetOptions(`{}`, "a.b", "{[{[", opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReparent(t *testing.T) {
+	json := `{"a":{"token":{"x" : 1.50},"n":1},"b":{"c":2}}`
+	res, err := Reparent(json, "a.token", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":{"n":1},"b":{"c":2,"token":{"x" : 1.50}}}` {
+		t.Fatalf("got '%v'", res)
+	}
+	res, err = Reparent(`{"a":{"k.1":1},"b":{}}`, `a.k\.1`, "b")
+	if err != nil || res != `{"a":{},"b":{"k.1":1}}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	for _, tc := range [][2]string{
+		{"a.missing", "b"},
+		{"a.token", "a.n"},
+		{"a.token", "missing"},
+		{"a", "a.token"},
+		{"b.c", "a"},
+	} {
+		if tc[0] == "b.c" {
+			json, _ = Set(json, "a.c", 3)
+		}
+		if _, err := Reparent(json, tc[0], tc[1]); err == nil {
+			t.Fatalf("expected error for '%v' to '%v'", tc[0], tc[1])
+		}
+	}
+	if _, err := Reparent(`{"a":[1],"b":{}}`, "a.0", "b"); err == nil {
+		t.Fatal("expected error for array element")
+	}
+	bres, err := ReparentBytes([]byte(`{"a":{"t":true},"b":{}}`), "a.t", "b")
+	if err != nil || string(bres) != `{"a":{},"b":{"t":true}}` {
+		t.Fatalf("got '%s', %v", bres, err)
+	}
+	// a glob or query must not delete values that are not moved
+	for _, path := range []string{"a.tok*", "a.#(x==1).t", "c.#.t"} {
+		json := `{"a":{"token":1,"tokens":2},"b":{},"c":[{"t":1}]}`
+		res, err := Reparent(json, path, "b")
+		if err == nil || res != json {
+			t.Fatalf("%v: expected error, got '%v'", path, res)
+		}
+	}
+	// numeric object keys with the ':' prefix
+	res, err = Reparent(`{"1":{"t":1},"2":{}}`, ":1.t", ":2")
+	if err != nil || res != `{"1":{},"2":{"t":1}}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	_, err = Reparent(`{"1":{"t":1},"2":{"t":2}}`, ":1.t", ":2")
+	if err == nil {
+		t.Fatal("expected error for existing key")
+	}
+}
+
+func TestPercentDecodePath(t *testing.T) {
+	opts := &Options{PercentDecodePath: true}
+	for _, tc := range []struct {
+		json, path, expect string
+	}{
+		{`{}`, "a%2Eb", `{"a.b":1}`},
+		{`{}`, "x.a%2eb.c", `{"x":{"a.b":{"c":1}}}`},
+		{`{}`, "a%3Ab", `{"a:b":1}`},
+		{`{}`, "%3A5", `{":5":1}`},
+		{`{}`, "%35", `{"5":1}`},
+		{`{}`, "my%20key", `{"my key":1}`},
+		{`{}`, "a%2A", `{"a*":1}`},
+		{`{}`, "a%5C.b", `{"a\\":{"b":1}}`},
+		{`{"a":[0,0]}`, "a.1", `{"a":[0,1]}`},
+		{`{"a":[{"n":"x"},{"n":"y"}]}`, `a.#(n%"y").v`,
+			`{"a":[{"n":"x"},{"n":"y","v":1}]}`},
+	} {
+		res, err := SetOptions(tc.json, tc.path, 1, opts)
+		if err != nil {
+			t.Fatalf("'%v': %v", tc.path, err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.path, tc.expect, res)
+		}
+	}
+	res, err := SetRawOptions(`{}`, "a%2Eb", `[1]`, opts)
+	if err != nil || res != `{"a.b":[1]}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	res, err = DeleteOptions(`{"a.b":1,"c":2}`, "a%2Eb", opts)
+	if err != nil || res != `{"c":2}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	if _, err := SetOptions(`{}`, "a%zz", 1, opts); err == nil {
+		t.Fatal("expected error for invalid encoding")
+	}
+	res, _ = Set(`{}`, "a%2Eb", 1)
+	if res != `{"a%2Eb":1}` {
+		t.Fatalf("got '%v'", res)
+	}
+}
+
+func TestSetBatch(t *testing.T) {
+	var docs [][]byte
+	for i := 0; i < 1000; i++ {
+		docs = append(docs, []byte(`{"id":`+strconv.Itoa(i)+`,"tags":["x"]}`))
+	}
+	docs[7] = []byte(`{"id":7,"tags":{}}`)
+	orig := make([][]byte, len(docs))
+	for i, doc := range docs {
+		orig[i] = append([]byte(nil), doc...)
+	}
+	res, errs := SetBatch(docs, "tags.1", "y", &Options{ReplaceInPlace: true})
+	if len(res) != len(docs) || len(errs) != len(docs) {
+		t.Fatal("length mismatch")
+	}
+	for i := range docs {
+		if string(docs[i]) != string(orig[i]) {
+			t.Fatalf("doc %d was modified", i)
+		}
+		expect := `{"id":` + strconv.Itoa(i) + `,"tags":["x","y"]}`
+		if i == 7 {
+			expect = `{"id":7,"tags":{"1":"y"}}`
+		}
+		if errs[i] != nil || string(res[i]) != expect {
+			t.Fatalf("doc %d: got '%s', %v", i, res[i], errs[i])
+		}
+	}
+	_, errs = SetBatch(docs[:3], "a", math.NaN(), nil)
+	for _, err := range errs {
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	res, errs = SetBatch(nil, "a", 1, nil)
+	if len(res) != 0 || len(errs) != 0 {
+		t.Fatal("expected empty results")
+	}
+	// escaped, forced, and query paths
+	docs = [][]byte{[]byte(`{"a.b":{"c":[]}}`), []byte(`{"a":[{"x":1}]}`)}
+	for _, tc := range []struct {
+		path   string
+		opts   *Options
+		expect []string
+	}{
+		{`a\.b.c.0`, nil, []string{`{"a.b":{"c":[1]}}`, `{"a":[{"x":1}],"a.b":{"c":[1]}}`}},
+		{`a\.b.c.0`, &Options{ForceObjectKeys: true},
+			[]string{`{"a.b":{"c":[]}}`, `{"a":[{"x":1}],"a.b":{"c":{"0":1}}}`}},
+		{`a.#(x==1).y`, nil, []string{`{"a.b":{"c":[]}}`, `{"a":[{"x":1,"y":1}]}`}},
+	} {
+		res, errs = SetBatch(docs, tc.path, 1, tc.opts)
+		for i := range docs {
+			if string(res[i]) != tc.expect[i] {
+				t.Fatalf("%s: expected '%s', got '%s' %v", tc.path,
+					tc.expect[i], res[i], errs[i])
+			}
+		}
+	}
+}
+
+func TestEnsureArrayPush(t *testing.T) {
+	for _, tc := range []struct {
+		json, path string
+		value      interface{}
+		expect     string
+	}{
+		{`{}`, "a", "x", `{"a":["x"]}`},
+		{`{"b":1}`, "a.b", 2, `{"b":1,"a":{"b":[2]}}`},
+		{`{"a":"x"}`, "a", "y", `{"a":["x","y"]}`},
+		{`{"a":1.50}`, "a", 2, `{"a":[1.50,2]}`},
+		{`{"a":{"k":1}}`, "a", true, `{"a":[{"k":1},true]}`},
+		{`{"a":null}`, "a", 1, `{"a":[null,1]}`},
+		{`{"a":[]}`, "a", 1, `{"a":[1]}`},
+		{`{"a":["x"]}`, "a", []int{1}, `{"a":["x",[1]]}`},
+	} {
+		res, err := EnsureArrayPush(tc.json, tc.path, tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("expected '%v', got '%v'", tc.expect, res)
+		}
+	}
+}
+
+func TestGlobWildcardPaths(t *testing.T) {
+	json := `{"services":{"web":{"replicas":[1,2],"ports":[{"p":80},{"p":443}]},` +
+		`"worker":{"replicas":[3],"ports":[]},"cfg":{}},"x.y":{"a":1}}`
+	for _, tc := range []struct {
+		path   string
+		value  interface{}
+		expect string
+	}{
+		{"services.*.replicas.#", 3, `{"services":{"web":{"replicas":[3,3],` +
+			`"ports":[{"p":80},{"p":443}]},"worker":{"replicas":[3],` +
+			`"ports":[]},"cfg":{}},"x.y":{"a":1}}`},
+		{"services.w*.ports.#.tls", true, `{"services":{"web":{"replicas":` +
+			`[1,2],"ports":[{"p":80,"tls":true},{"p":443,"tls":true}]},` +
+			`"worker":{"replicas":[3],"ports":[]},"cfg":{}},"x.y":{"a":1}}`},
+		{"services.?eb.ports.#(p>100).tls", true, `{"services":{"web":` +
+			`{"replicas":[1,2],"ports":[{"p":80},{"p":443,"tls":true}]},` +
+			`"worker":{"replicas":[3],"ports":[]},"cfg":{}},"x.y":{"a":1}}`},
+		{"*.*.n", 1, `{"services":{"web":{"replicas":[1,2],"ports":` +
+			`[{"p":80},{"p":443}],"n":1},"worker":{"replicas":[3],` +
+			`"ports":[],"n":1},"cfg":{"n":1}},"x.y":{"a":1}}`},
+		{"x*.a", 2, `{"services":{"web":{"replicas":[1,2],"ports":` +
+			`[{"p":80},{"p":443}]},"worker":{"replicas":[3],"ports":[]},` +
+			`"cfg":{}},"x.y":{"a":2}}`},
+		{"missing*.#.a", 1, json},
+		{"services.none*.replicas.#", 1, json},
+		{"services.cfg.*", 1, json},
+	} {
+		res, err := Set(json, tc.path, tc.value)
+		if err != nil {
+			t.Fatalf("'%v': %v", tc.path, err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.path, tc.expect, res)
+		}
+	}
+	for _, tc := range [][2]string{
+		{"services.*.replicas.#", `{"services":{"web":{"replicas":[],` +
+			`"ports":[{"p":80},{"p":443}]},"worker":{"replicas":[],` +
+			`"ports":[]},"cfg":{}},"x.y":{"a":1}}`},
+		{"services.*.ports.#.p", `{"services":{"web":{"replicas":[1,2],` +
+			`"ports":[{},{}]},"worker":{"replicas":[3],"ports":[]},"cfg":{}},` +
+			`"x.y":{"a":1}}`},
+		{"services.*", `{"services":{},"x.y":{"a":1}}`},
+		{"services.none*.replicas.#", json},
+	} {
+		res, err := Delete(json, tc[0])
+		if err != nil {
+			t.Fatalf("'%v': %v", tc[0], err)
+		}
+		if res != tc[1] {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc[0], tc[1], res)
+		}
+	}
+	res, _ := Set(`{"a*":1}`, `a\*`, 2)
+	if res != `{"a*":2}` {
+		t.Fatalf("got '%v'", res)
+	}
+}
+
+func TestPathError(t *testing.T) {
+	json := `{"a":[{"b":1}]}`
+	for _, tc := range []struct {
+		path string
+		pos  int
+		msg  string
+	}{
+		{"", 0, "path cannot be empty"},
+		{`a.#(b==1`, 3, "unterminated query"},
+		{`a.#(b==")"`, 3, "unterminated query"},
+		{`ü.a.#(b==1).#(c==(1)`, 13, "unterminated query"},
+	} {
+		for i, fn := range []func() error{
+			func() error { _, err := Set(json, tc.path, 1); return err },
+			func() error { _, err := Delete(json, tc.path); return err },
+			func() error { _, err := Plan(json, tc.path); return err },
+		} {
+			if i == 0 && tc.path == "" {
+				continue // an empty path sets the document root
+			}
+			err := fn()
+			perr, ok := err.(*PathError)
+			if !ok {
+				t.Fatalf("'%v': expected PathError, got %v", tc.path, err)
+			}
+			if perr.Path != tc.path || perr.Pos != tc.pos ||
+				perr.Msg != tc.msg {
+				t.Fatalf("'%v': unexpected error %+v", tc.path, perr)
+			}
+		}
+	}
+	// a stray ')' is a valid key character for Set, but not in a plan
+	_, err := Plan(json, `ü.b)`)
+	if perr, ok := err.(*PathError); !ok || perr.Pos != 3 ||
+		perr.Msg != "unexpected ')'" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = SplitPath(`a.b.#.c`)
+	if perr, ok := err.(*PathError); !ok || perr.Pos != 4 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err.Error() != "invalid path 'a.b.#.c' at position 4: "+
+		"component is not a literal key or index" {
+		t.Fatalf("unexpected message '%v'", err)
+	}
+	if _, err := new(PathBuilder).Build(); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*PathError); !ok {
+		t.Fatalf("expected PathError, got %v", err)
+	}
+}
+
+type countWriter struct {
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func TestSetWriter(t *testing.T) {
+	json := `{"name":{"first":"Tom","last":"Anderson"},"tags":[1,2,3]}`
+	for _, tc := range []struct {
+		path   string
+		value  interface{}
+		writes int
+	}{
+		{"name.last", "Smith", 3},
+		{"name.last", map[string]int{"a": 1}, 3},
+		{"tags.1", 5, 3},
+		{"name.middle", "J", 1},
+		{"tags.-1", 4, 1},
+		{"tags.#", 0, 1},
+		{"missing.#(a==1)", 0, 1},
+	} {
+		expect, err := Set(json, tc.path, tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w countWriter
+		if err := SetWriter(&w, json, tc.path, tc.value); err != nil {
+			t.Fatal(err)
+		}
+		if w.buf.String() != expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.path, expect,
+				w.buf.String())
+		}
+		if w.writes != tc.writes {
+			t.Fatalf("'%v': expected %d writes, got %d", tc.path, tc.writes,
+				w.writes)
+		}
+	}
+	var buf bytes.Buffer
+	if err := SetRawWriter(&buf, json, "tags", `[ 0 ]`); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"name":{"first":"Tom","last":"Anderson"},"tags":[ 0 ]}` {
+		t.Fatalf("got '%v'", buf.String())
+	}
+	buf.Reset()
+	if err := DeleteWriter(&buf, json, "name"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"tags":[1,2,3]}` {
+		t.Fatalf("got '%v'", buf.String())
+	}
+	buf.Reset()
+	if err := SetWriter(&buf, `{"a":1,"a":2}`, "a", 3); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"a":1,"a":3}` {
+		t.Fatalf("got '%v'", buf.String())
+	}
+	if err := SetRawWriter(&buf, json, "a", ""); err != ErrEmptyRaw {
+		t.Fatalf("expected ErrEmptyRaw, got %v", err)
+	}
+	if err := SetWriter(&buf, json, "a.#(b==1", 1); err == nil {
+		t.Fatal("expected path error")
+	}
+	if err := SetWriter(failWriter{}, json, "name.last", 1); err == nil {
+		t.Fatal("expected write error")
+	}
+	if err := DeleteWriter(failWriter{}, json, "missing"); err == nil {
+		t.Fatal("expected write error")
+	}
+}
+
+func TestPreserveOrder(t *testing.T) {
+	opts := &Options{PreserveOrder: true}
+	for _, tc := range []struct {
+		json, path, expect string
+	}{
+		{`{"a":1,"c":3}`, "b", `{"a":1,"b":2,"c":3}`},
+		{`{"b":1,"c":3}`, "a", `{"a":2,"b":1,"c":3}`},
+		{`{"a":1,"b":3}`, "c", `{"a":1,"b":3,"c":2}`},
+		{`{}`, "a", `{"a":2}`},
+		{`{ }`, "a", `{ "a":2}`},
+		{`{"a":1,"c":3}`, "c", `{"a":1,"c":2}`},
+		{`{"z":1,"a":3}`, "m", `{"m":2,"z":1,"a":3}`},
+		{`{"a":{"x":1,"z":1},"c":3}`, "a.y", `{"a":{"x":1,"y":2,"z":1},"c":3}`},
+		{`{"a":1,"c":3}`, "b.d.e", `{"a":1,"b":{"d":{"e":2}},"c":3}`},
+		{"{\n  \"a\": 1,\n  \"c\": 3\n}", "b",
+			"{\n  \"a\": 1,\n  \"b\":2,\n  \"c\": 3\n}"},
+		{"{\n  \"c\": 3\n}", "b", "{\n  \"b\":2,\n  \"c\": 3\n}"},
+	} {
+		res, err := SetOptions(tc.json, tc.path, 2, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v' in '%v': expected '%v', got '%v'", tc.path, tc.json,
+				tc.expect, res)
+		}
+	}
+}
+
+func TestInvalidPathOrJSON(t *testing.T) {
+	json := `{"friends":[{"last":"Murphy"}]}`
+	path := `friends.#(last=`
+	_, err := Set(json, path, 1)
+	if perr, ok := err.(*PathError); !ok || perr.Path != path || perr.Pos != 9 {
+		t.Fatalf("expected PathError, got %v", err)
+	}
+	if _, err := SetRaw(json, path, `1`); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*PathError); !ok {
+		t.Fatalf("expected PathError, got %v", err)
+	}
+	if _, err := Delete(json, path); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*PathError); !ok {
+		t.Fatalf("expected PathError, got %v", err)
+	}
+	opts := &Options{ValidateInput: true}
+	if _, err := SetOptions(`{"friends":[`, "friends.0", 1, opts); err != ErrInvalidJSON {
+		t.Fatalf("expected ErrInvalidJSON, got %v", err)
+	}
+}
+
+// countdownContext is a context that is canceled after n calls to Err.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.n--; ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestSetContext(t *testing.T) {
+	json := `{"a":{"b":1}}`
+	res, err := SetContext(context.Background(), json, "a.c", 2)
+	if err != nil || res != `{"a":{"b":1,"c":2}}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	res, err = SetRawContext(context.Background(), json, "a.b", `[1]`)
+	if err != nil || res != `{"a":{"b":[1]}}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	res, err = DeleteContext(context.Background(), json, "a.b")
+	if err != nil || res != `{"a":{}}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := SetContext(ctx, json, "a.c", 2); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := SetRawContext(ctx, json, "a.c", `2`); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := DeleteContext(ctx, json, "a.b"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// canceled while walking the path
+	if _, err := SetContext(&countdownContext{context.Background(), 2},
+		`{"a":{"b":{"c":{}}}}`, "a.b.c.d", 1); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// canceled while expanding wildcards and queries
+	var buf []byte
+	buf = append(buf, `{"a":[`...)
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"b":[1]}`...)
+	}
+	buf = append(buf, `]}`...)
+	for _, path := range []string{"a.#.b.#", "a.#(b.0==1)#.c"} {
+		ctx := &countdownContext{context.Background(), 100}
+		if _, err := SetContext(ctx, string(buf), path, 2); err != context.Canceled {
+			t.Fatalf("'%v': expected context.Canceled, got %v", path, err)
+		}
+	}
+}
+
+func TestPadValue(t *testing.T) {
+	for _, tc := range []struct {
+		json, path, pad, expect string
+	}{
+		{`{"b":[1]}`, "b.3", `0`, `{"b":[1,0,0,2]}`},
+		{`{"b":[]}`, "b.2", `""`, `{"b":["","",2]}`},
+		{`{}`, "b.2.c", `{}`, `{"b":[{},{},{"c":2}]}`},
+		{`{}`, "b.1.2", `[]`, `{"b":[[],[[],[],2]]}`},
+		{`{"b":[1,5]}`, "b.1", `0`, `{"b":[1,2]}`},
+		{`{"b":[1]}`, "b.-1", `0`, `{"b":[1,2]}`},
+		{`{"b":[1]}`, "b.2", ``, `{"b":[1,null,2]}`},
+		{`{"b":[1]}`, "b.2", ` 0 `, `{"b":[1, 0 ,2]}`},
+	} {
+		opts := &Options{PadValue: jsongo.RawMessage(tc.pad)}
+		res, err := SetOptions(tc.json, tc.path, 2, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.path, tc.expect, res)
+		}
+		rres, err := SetRawOptions(tc.json, tc.path, `2`, opts)
+		if err != nil || rres != res {
+			t.Fatalf("'%v': expected '%v', got '%v', %v", tc.path, res, rres,
+				err)
+		}
+	}
+	opts := &Options{PadValue: jsongo.RawMessage(`{`)}
+	if _, err := SetOptions(`[]`, "3", 1, opts); err == nil {
+		t.Fatal("expected error for invalid pad value")
+	}
+	if _, err := SetRawOptions(`[]`, "3", `1`, opts); err == nil {
+		t.Fatal("expected error for invalid pad value")
+	}
+	if _, err := DeleteOptions(`[1]`, "0", opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	for _, tc := range []struct {
+		json   string
+		paths  []string
+		expect string
+	}{
+		{`{"a":[0,1,2,3]}`, []string{"a.1", "a.3"}, `{"a":[0,2]}`},
+		{`{"a":[0,1,2,3]}`, []string{"a.3", "a.1"}, `{"a":[0,2]}`},
+		{`{"a":1,"b":2,"c":3}`, []string{"c", "a", "missing"}, `{"b":2}`},
+		{`{"a":{"b":1,"c":2},"d":3}`, []string{"a.b", "a"}, `{"d":3}`},
+		{`{"a":{"b":1,"c":2},"d":3}`, []string{"a", "a.b", "a"}, `{"d":3}`},
+		{`{"a":[{"x":1,"y":2},{"x":3}]}`, []string{"a.#.x", "a.0"},
+			`{"a":[{}]}`},
+		{`{"a":[{"n":1},{"n":2},{"n":1}]}`, []string{`a.#(n==1)#`},
+			`{"a":[{"n":2}]}`},
+		{`{"s":{"a":{"k":1},"b":{"k":2}}}`, []string{"s.*.k"},
+			`{"s":{"a":{},"b":{}}}`},
+		{`{"a":[[1,2],[3]]}`, []string{"a.0.1", "a.0", "a.1.0"},
+			`{"a":[[]]}`},
+		{`{"a":1}`, nil, `{"a":1}`},
+	} {
+		res, err := DeleteMany(tc.json, tc.paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("%v: expected '%v', got '%v'", tc.paths, tc.expect, res)
+		}
+	}
+	if _, err := DeleteMany(`{"a":1}`, []string{"a", ""}); err == nil {
+		t.Fatal("expected error")
+	}
+	res, err := DeleteManyBytes([]byte(`{"a":[1,2,3]}`), []string{"a.0", "a.2"})
+	if err != nil || string(res) != `{"a":[2]}` {
+		t.Fatalf("got '%s', %v", res, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	json := `{"cfg":{"name":"a","db":{"host":"x","port":1},"tags":["t1","t2"],"n":null}}`
+	for _, tc := range []struct {
+		path, patch string
+		opts        *MergeOptions
+		expect      string
+	}{
+		{"cfg", `{"db":{"port":2,"user":"u"},"name":"b"}`, nil,
+			`{"cfg":{"name":"b","db":{"host":"x","port":2,"user":"u"},` +
+				`"tags":["t1","t2"],"n":null}}`},
+		{"cfg", `{"tags":["t2","t3"]}`, nil,
+			`{"cfg":{"name":"a","db":{"host":"x","port":1},"tags":["t2","t3"],` +
+				`"n":null}}`},
+		{"cfg", `{"tags":["t2","t3"]}`, &MergeOptions{Arrays: AppendArrays},
+			`{"cfg":{"name":"a","db":{"host":"x","port":1},` +
+				`"tags":["t1","t2","t2","t3"],"n":null}}`},
+		{"cfg", `{"tags":["t2","t3"]}`, &MergeOptions{Arrays: UnionArrays},
+			`{"cfg":{"name":"a","db":{"host":"x","port":1},` +
+				`"tags":["t1","t2","t3"],"n":null}}`},
+		{"cfg", `{"name":null,"db":{"host":null},"n":1}`, nil,
+			`{"cfg":{"name":null,"db":{"host":null,"port":1},` +
+				`"tags":["t1","t2"],"n":1}}`},
+		{"cfg", `{"name":null,"db":{"host":null},"x":{"y":null,"z":1}}`,
+			&MergeOptions{DeleteNulls: true},
+			`{"cfg":{"db":{"port":1},"tags":["t1","t2"],"n":null,` +
+				`"x":{"z":1}}}`},
+		{"cfg.name", `{"first":"a"}`, nil, ""},
+		{"new.obj", `{"a":{"b":1}}`, nil,
+			`{"cfg":{"name":"a","db":{"host":"x","port":1},"tags":["t1","t2"],` +
+				`"n":null},"new":{"obj":{"a":{"b":1}}}}`},
+		{"", `{"top":true}`, nil,
+			`{"cfg":{"name":"a","db":{"host":"x","port":1},"tags":["t1","t2"],` +
+				`"n":null},"top":true}`},
+		{"cfg", `[1]`, nil, ""},
+	} {
+		res, err := MergeWithOptions(json, tc.path, tc.patch, tc.opts)
+		if tc.expect == "" {
+			if err == nil {
+				t.Fatalf("'%v': expected error", tc.patch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.patch, tc.expect, res)
+		}
+	}
+	res, err := Merge(`{"a":{"b":[]}}`, "a.b", `{}`)
+	if err == nil {
+		t.Fatalf("expected error, got '%v'", res)
+	}
+	res, err = MergeWithOptions(`{"a":{"t":[ ]}}`, "a",
+		`{"t":[1,{"b":1}]}`, &MergeOptions{Arrays: UnionArrays})
+	if err != nil || res != `{"a":{"t":[ 1,{"b":1}]}}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	res, err = MergeWithOptions(`{"t":[[1],[2]]}`, "", `{"t":[[2],[3]]}`,
+		&MergeOptions{Arrays: UnionArrays})
+	if err != nil || res != `{"t":[[1],[2],[3]]}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	// the formatting of the target is kept
+	opts := &MergeOptions{DeleteNulls: true}
+	for _, tc := range []struct{ json, patch, expect string }{
+		{"{\n  \"a\": 1,\n  \"b\": [1]\n}", `{"a":2,"c":{"d":null,"e":1}}`,
+			"{\n  \"a\": 2,\n  \"b\": [1],\"c\":{\"e\":1}\n}"},
+		{`{"a":1, "b":2, "c":3}`, `{"a":null}`, `{"b":2, "c":3}`},
+		{`{"a":1, "b":2, "c":3}`, `{"c":null}`, `{"a":1, "b":2}`},
+		{`{"a":1, "b":2, "c":3}`, `{"b":null}`, `{"a":1, "c":3}`},
+		{`{ "a":1 }`, `{"a":null}`, `{  }`},
+		{`{ }`, `{"a":null,"b":1}`, `{ "b":1}`},
+		{`{"a":1,"a":2}`, `{"a":{"x":1}}`, `{"a":1,"a":{"x":1}}`},
+	} {
+		res, err := MergeWithOptions(tc.json, "", tc.patch, opts)
+		if err != nil || res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v', %v", tc.patch,
+				tc.expect, res, err)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	for _, tc := range []struct {
+		json, patch, expect string
+	}{
+		// examples from RFC 6902, Appendix A
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`,
+			`{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			`{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`,
+			`{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`,
+			`{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`,
+			`[{"op":"replace","path":"/baz","value":"boo"}]`,
+			`{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`,
+			`[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},` +
+				`{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			`{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			`{"foo":["bar",["abc","def"]]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},` +
+			`{"op":"replace","path":"/~1","value":8}]`, `{"/":8,"~1":10}`},
+		// other cases
+		{`{"a":{"0":1}}`, `[{"op":"replace","path":"/a/0","value":2}]`,
+			`{"a":{"0":2}}`},
+		{`{"a":[1]}`, `[{"op":"copy","from":"/a","path":"/b"},` +
+			`{"op":"add","path":"/b/0","value":0}]`, `{"a":[1],"b":[0,1]}`},
+		{`{"a":1}`, `[{"op":"add","path":"","value":[1]}]`, `[1]`},
+		{`[1,2]`, `[{"op":"add","path":"/0","value":0},` +
+			`{"op":"remove","path":"/2"}]`, `[0,1]`},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a"}]`,
+			`{"a":{"b":1}}`},
+		{`{"a":{"b":1}}`, `[{"op":"test","path":"/a","value":{ "b" : 1.0 }}]`,
+			`{"a":{"b":1}}`},
+		{`{"a":1}`, `[]`, `{"a":1}`},
+	} {
+		res, err := ApplyPatch(tc.json, tc.patch)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.patch, err)
+		}
+		if res != tc.expect {
+			t.Fatalf("%v: expected '%v', got '%v'", tc.patch, tc.expect, res)
+		}
+	}
+	for _, tc := range [][2]string{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":1}]`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/01","value":1}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"copy","path":"/baz"}]`},
+		{`{"foo":"bar"}`, `[{"op":"move","from":"/x","path":"/baz"}]`},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`},
+		{`{"foo":"bar"}`, `[{"op":"frob","path":"/foo"}]`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`},
+		{`{"foo":"bar"}`, `{"op":"remove","path":"/foo"}`},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/foo"},` +
+			`{"op":"test","path":"/foo","value":"bar"}]`},
+	} {
+		res, err := ApplyPatch(tc[0], tc[1])
+		if err == nil {
+			t.Fatalf("%v: expected error, got '%v'", tc[1], res)
+		}
+		if res != tc[0] {
+			t.Fatalf("%v: expected unchanged json, got '%v'", tc[1], res)
+		}
+	}
+	_, err := ApplyPatch(`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`)
+	if err.Error() != `patch operation 0: test failed: value at '/baz' is `+
+		`"qux", expected "bar"` {
+		t.Fatalf("unexpected error '%v'", err)
+	}
+}
+
+func TestSetRawBytesBuffer(t *testing.T) {
+	json := []byte(`{"a":[{"b":1},{"b":2}],"c":"x"}`)
+	orig := string(json)
+	dst := make([]byte, 0, 256)
+	for _, tc := range []struct {
+		path, value string
+	}{
+		{"c", `"y"`},
+		{"d.e", `[1]`},
+		{"a.#.b", `3`},
+		{"a.#(b==2).b", `4`},
+		{"missing.#.b", `1`},
+	} {
+		expect, err := SetRawBytesOptions(json, tc.path, []byte(tc.value), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := SetRawBytesBuffer(dst, json, tc.path, []byte(tc.value), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res) != string(expect) {
+			t.Fatalf("'%v': expected '%s', got '%s'", tc.path, expect, res)
+		}
+		if &res[0] != &dst[:1][0] {
+			t.Fatalf("'%v': result was not written to dst", tc.path)
+		}
+		if string(json) != orig {
+			t.Fatalf("'%v': json was modified", tc.path)
+		}
+		dst = res
+	}
+
+	// grows a small buffer
+	res, err := SetRawBytesBuffer(make([]byte, 0, 2), json, "c", []byte(`1`), nil)
+	if err != nil || string(res) != `{"a":[{"b":1},{"b":2}],"c":1}` {
+		t.Fatalf("got '%s', %v", res, err)
+	}
+	res, err = SetRawBytesBuffer(nil, json, "missing.#.b", []byte(`1`), nil)
+	if err != nil || string(res) != orig || &res[0] == &json[0] {
+		t.Fatalf("got '%s', %v", res, err)
+	}
+
+	// dst may be the json itself when replacing in place
+	inplace := []byte(`{"a":"hello","b":1}`)
+	opts := &Options{ReplaceInPlace: true, Optimistic: true}
+	res, err = SetRawBytesBuffer(inplace, inplace, "a", []byte(`"hi"`), opts)
+	if err != nil || string(res) != `{"a":"hi","b":1}` || &res[0] != &inplace[0] {
+		t.Fatalf("got '%s', %v", res, err)
+	}
+	res, err = SetRawBytesBuffer(res, res, "c", []byte(`"grow"`), opts)
+	if err != nil || string(res) != `{"a":"hi","b":1,"c":"grow"}` {
+		t.Fatalf("got '%s', %v", res, err)
+	}
+	if _, err := SetRawBytesBuffer(dst, json, "c", nil, nil); err != ErrEmptyRaw {
+		t.Fatalf("expected ErrEmptyRaw, got %v", err)
+	}
+}
+
+func TestIntegerFloats(t *testing.T) {
+	for _, tc := range [][2]string{
+		{"37.0", "37"},
+		{"-37.00", "-37"},
+		{"3.7e1", "37"},
+		{"1e6", "1000000"},
+		{"1E+06", "1000000"},
+		{"1.5e1", "15"},
+		{"0.0", "0"},
+		{"-0.0e5", "0"},
+		{"0.5e1", "5"},
+		{"0.05e2", "5"},
+		{"100e-2", "1"},
+		{"12345678901234567890.0", "12345678901234567890"},
+		{"1.5", ""},
+		{"15e-1", ""},
+		{"0.5", ""},
+		{"37", ""},
+		{"1e401", ""},
+		{"1e-500", ""},
+	} {
+		res, ok := integerForm(tc[0])
+		if ok != (tc[1] != "") || res != tc[1] {
+			t.Fatalf("'%v': expected '%v', got '%v' %v", tc[0], tc[1], res, ok)
+		}
+	}
+	opts := &Options{IntegerFloats: true}
+	for _, tc := range []struct {
+		value  interface{}
+		expect string
+	}{
+		{jsongo.Number("37.0"), `{"a":37}`},
+		{jsongo.Number("3.75"), `{"a":3.75}`},
+		{map[string]float64{"b": 1e21, "c": 1.5}, `{"a":{"b":1000000000000000000000,"c":1.5}}`},
+		{map[string]string{"b": "1.0"}, `{"a":{"b":"1.0"}}`},
+		{[]jsongo.Number{"2.0", "2.5"}, `{"a":[2,2.5]}`},
+		{37.0, `{"a":37}`},
+		{1e21, `{"a":1000000000000000000000}`},
+	} {
+		res, err := SetOptions(`{}`, "a", tc.value, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("%v: expected '%v', got '%v'", tc.value, tc.expect, res)
+		}
+	}
+	res, _ := SetOptions(`{}`, "a", jsongo.Number("37.0"), nil)
+	if res != `{"a":37.0}` {
+		t.Fatalf("got '%v'", res)
+	}
+}
+
+func TestSetTime(t *testing.T) {
+	tm := time.Date(2024, 3, 5, 10, 20, 30, 500, time.UTC)
+	res, err := SetTime(`{}`, "t", tm)
+	if err != nil || res != `{"t":"2024-03-05T10:20:30.0000005Z"}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	bres, err := SetTimeBytes([]byte(`{}`), "t", tm.Truncate(time.Second))
+	if err != nil || string(bres) != `{"t":"2024-03-05T10:20:30Z"}` {
+		t.Fatalf("got '%s', %v", bres, err)
+	}
+	// the same as encoding/json
+	b, _ := jsongo.Marshal(tm.In(time.FixedZone("", 3600)))
+	res, _ = Set(`{}`, "t", tm.In(time.FixedZone("", 3600)))
+	if res != `{"t":`+string(b)+`}` {
+		t.Fatalf("got '%v', expected %s", res, b)
+	}
+	for _, tc := range []struct {
+		layout, expect string
+	}{
+		{time.RFC3339, `{"t":"2024-03-05T10:20:30Z"}`},
+		{time.DateOnly, `{"t":"2024-03-05"}`},
+		{UnixTimeLayout, `{"t":1709634030}`},
+	} {
+		res, err := SetOptions(`{}`, "t", tm, &Options{TimeLayout: tc.layout})
+		if err != nil || res != tc.expect {
+			t.Fatalf("'%v': got '%v', %v", tc.layout, res, err)
+		}
+	}
+	res, err = SetOptions(`{}`, "t", []time.Time{tm, tm},
+		&Options{TimeLayout: UnixTimeLayout})
+	if err != nil || res != `{"t":[1709634030,1709634030]}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	for _, tc := range []struct {
+		value  jsongo.RawMessage
+		expect string
+	}{
+		{jsongo.RawMessage(`{"b": [1, 2]}`), `{"a":{"b": [1, 2]}}`},
+		{jsongo.RawMessage(`"str"`), `{"a":"str"}`},
+		{jsongo.RawMessage(`1.50`), `{"a":1.50}`},
+		{jsongo.RawMessage(nil), `{"a":null}`},
+	} {
+		res, err := Set(`{"a":0}`, "a", tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("expected '%v', got '%v'", tc.expect, res)
+		}
+		if len(tc.value) > 0 {
+			raw, _ := SetRaw(`{"a":0}`, "a", string(tc.value))
+			if raw != res {
+				t.Fatalf("expected '%v' to match SetRaw '%v'", res, raw)
+			}
+		}
+	}
+	res, err := Set(`{}`, "a", []jsongo.RawMessage{
+		jsongo.RawMessage(`{"x":1}`), jsongo.RawMessage(`[ ]`)})
+	if err != nil || res != `{"a":[{"x":1},[ ]]}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	res, err = Set(`{}`, "a.#.b", jsongo.RawMessage(`{}`))
+	if err != nil || res != `{}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+	if _, err := Set(`{}`, "a", jsongo.RawMessage(`{`)); err == nil {
+		t.Fatal("expected error for invalid raw message")
+	}
+}
+
+func TestObjectWildcard(t *testing.T) {
+	json := `{"config":{"a":{"enabled":false},"b":{},"c":1,"d":"x",` +
+		`"e":{"items":[{"x":0},{}]},"f":null}}`
+	for _, tc := range []struct {
+		path, expect string
+	}{
+		{"config.*.enabled", `{"config":{"a":{"enabled":true},"b":{"enabled":true},` +
+			`"c":1,"d":"x","e":{"items":[{"x":0},{}],"enabled":true},"f":null}}`},
+		{"config.*.items.#.x", `{"config":{"a":{"enabled":false},"b":{},"c":1,` +
+			`"d":"x","e":{"items":[{"x":true},{"x":true}]},"f":null}}`},
+		{"config.b.*", json},
+		{"config.b.*.x", json},
+		{"config.c.*", json},
+		{"config.*", `{"config":{"a":true,"b":true,"c":true,"d":true,` +
+			`"e":true,"f":true}}`},
+	} {
+		res, err := Set(json, tc.path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.path, tc.expect, res)
+		}
+	}
+	res, err := Delete(json, "config.*.enabled")
+	if err != nil || res != `{"config":{"a":{},"b":{},"c":1,"d":"x",`+
+		`"e":{"items":[{"x":0},{}]},"f":null}}` {
+		t.Fatalf("got '%v', %v", res, err)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	for _, tc := range []struct {
+		json, path, expect string
+	}{
+		{`{}`, "a.b", `{"a":{"b":1}}`},
+		{`{"a":{"b":0}}`, "a.b", `{"a":{"b":0}}`},
+		{`{"a":{"b":null}}`, "a.b", `{"a":{"b":null}}`},
+		{`{"a":[{"b":2},{}]}`, "a.#.b", `{"a":[{"b":2},{"b":1}]}`},
+		{`{"s":{"x":{},"y":{"b":5}}}`, "s.*.b", `{"s":{"x":{"b":1},"y":{"b":5}}}`},
+	} {
+		res, err := SetDefault(tc.json, tc.path, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.path, tc.expect, res)
+		}
+	}
+	if _, err := SetDefault(`{}`, "", 1); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSetIfEquals(t *testing.T) {
+	json := `{"v":{"n":1.0,"s":"a"},"o":{"x":1,"y":[1]}}`
+	for _, tc := range []struct {
+		path     string
+		expected interface{}
+		expect   string
+	}{
+		{"v.n", 1, `{"v":{"n":2,"s":"a"},"o":{"x":1,"y":[1]}}`},
+		{"v.s", "a", `{"v":{"n":1.0,"s":2},"o":{"x":1,"y":[1]}}`},
+		{"o", map[string]interface{}{"y": []int{1}, "x": 1},
+			`{"v":{"n":1.0,"s":"a"},"o":2}`},
+		{"v.n", 2, ""},
+		{"v.s", "b", ""},
+		{"v.n", "1", ""},
+		{"v.missing", nil, ""},
+	} {
+		res, err := SetIfEquals(json, tc.path, tc.expected, 2)
+		if tc.expect == "" {
+			if err != ErrNotEqual || res != json {
+				t.Fatalf("'%v': expected ErrNotEqual, got '%v', %v", tc.path,
+					res, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.expect {
+			t.Fatalf("'%v': expected '%v', got '%v'", tc.path, tc.expect, res)
+		}
+	}
+}
+
+func TestEscapeUnicode(t *testing.T) {
+	opts := &Options{EscapeUnicode: true}
+	json, err := SetOptions(`{"a":"é"}`, "b.😇", "héllo 😇", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"a":"é","b":{"\ud83d\ude07":"h\u00e9llo \ud83d\ude07"}}`
+	if json != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, json)
+	}
+	if gjson.Get(json, `b.😇`).String() != "héllo 😇" {
+		t.Fatalf("unexpected value for '%v'", json)
+	}
+	json, err = SetOptions(`{"a":1}`, "a", map[string]string{"ü": "ß"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = `{"a":{"\u00fc":"\u00df"}}`
+	if json != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, json)
+	}
+	json, err = SetRawOptions(`{}`, "a", `"é"`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != `{"a":"é"}` {
+		t.Fatalf("expected raw value to be untouched, got '%v'", json)
+	}
+	json, _ = Set(`{}`, "a", "é")
+	if json != `{"a":"é"}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":"é"}`, json)
+	}
+}
+
+func TestKeepFormatting(t *testing.T) {
+	json := "{\n  \"a\": 1,\n  \"b\": {\n    \"c\": [\n      1\n    ]\n  }\n}\n"
+	opts := &Options{KeepFormatting: true}
+	tests := []struct {
+		path  string
+		value interface{}
+		exp   string
+	}{
+		{"d", "x", "{\n  \"a\": 1,\n  \"b\": {\n    \"c\": [\n      1\n    ]\n  }," +
+			"\n  \"d\": \"x\"\n}\n"},
+		{"b.d.e", 2, "{\n  \"a\": 1,\n  \"b\": {\n    \"c\": [\n      1\n    ]," +
+			"\n    \"d\": {\n      \"e\": 2\n    }\n  }\n}\n"},
+		{"b.c.-1", map[string]int{"q": 1}, "{\n  \"a\": 1,\n  \"b\": {\n" +
+			"    \"c\": [\n      1,\n      {\n        \"q\": 1\n      }\n    ]\n" +
+			"  }\n}\n"},
+		{"b.c.2", 3, "{\n  \"a\": 1,\n  \"b\": {\n    \"c\": [\n      1,\n" +
+			"      null,\n      3\n    ]\n  }\n}\n"},
+		{"a", 2, "{\n  \"a\": 2,\n  \"b\": {\n    \"c\": [\n      1\n    ]\n" +
+			"  }\n}\n"},
+	}
+	for _, tt := range tests {
+		res, err := SetOptions(json, tt.path, tt.value, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tt.exp {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.path, tt.exp, res)
+		}
+	}
+	res, _ := SetOptions("{\n\t\"a\": {}\n}", "a.b", "x", opts)
+	if exp := "{\n\t\"a\": {\n\t\t\"b\": \"x\"\n\t}\n}"; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	res, _ = SetOptions(`{"a":{}}`, "a.b", "x", opts)
+	if exp := `{"a":{"b":"x"}}`; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	res, _ = SetOptions(json, "aa", "x",
+		&Options{KeepFormatting: true, PreserveOrder: true})
+	if exp := "{\n  \"a\": 1,\n  \"aa\": \"x\",\n  \"b\": {\n" +
+		"    \"c\": [\n      1\n    ]\n  }\n}\n"; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestDeleteQueryMatches(t *testing.T) {
+	json := `{"friends":[{"age":70},{"age":20},{"age":80},{"age":30}]}`
+	tests := []struct{ path, exp string }{
+		{"friends.#(age>60)#", `{"friends":[{"age":20},{"age":30}]}`},
+		{"friends.#(age<60)#", `{"friends":[{"age":70},{"age":80}]}`},
+		{"friends.#(age>0)#", `{"friends":[]}`},
+		{"friends.#(age>90)#", json},
+	}
+	for _, tt := range tests {
+		res, err := Delete(json, tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tt.exp {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.path, tt.exp, res)
+		}
+	}
+	json = "[\n  {\"age\": 70},\n  {\"age\": 20},\n  {\"age\": 80}\n]"
+	res, err := Delete(json, "#(age>60)#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "[\n  {\"age\": 20}\n]"; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	var b Builder
+	b.Set("name.first", "Tom").Set("name.last", "Anderson").Set("age", 37)
+	b.SetRaw("children", `["Sara","Alex"]`).Set("children.-1", "Jack")
+	b.Delete("name.last")
+	json, err := b.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"name":{"first":"Tom"},"age":37,"children":["Sara","Alex","Jack"]}`
+	if json != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, json)
+	}
+	// applying again gives the same document
+	if json, _ = b.String(); json != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, json)
+	}
+	b.Reset()
+	if json, err = b.String(); err != nil || json != "" {
+		t.Fatalf("expected empty document, got '%v', %v", json, err)
+	}
+	b.SetRaw("a", " ").Set("b", 1)
+	if _, err = b.Bytes(); err != ErrEmptyRaw {
+		t.Fatalf("expected '%v', got '%v'", ErrEmptyRaw, err)
+	}
+	nb := NewBuilder(&Options{ForceObjectKeys: true})
+	nb.Set("2021.revenue", 10).Set("2021.cost", 5)
+	if json, _ = nb.String(); json != `{"2021":{"revenue":10,"cost":5}}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+}
+
+func TestSetRoot(t *testing.T) {
+	json, err := SetRaw("", "", "{}")
+	if err != nil || json != "{}" {
+		t.Fatalf("expected '{}', got '%v', %v", json, err)
+	}
+	json, err = SetRaw(`{"a":1}`, "", ` [1,2] `)
+	if err != nil || json != ` [1,2] ` {
+		t.Fatalf("expected ' [1,2] ', got '%v', %v", json, err)
+	}
+	if _, err = SetRaw(`{"a":1}`, "", `{"a":`); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+	json, err = Set(`{"a":1}`, "", "hello")
+	if err != nil || json != `"hello"` {
+		t.Fatalf("expected '\"hello\"', got '%v', %v", json, err)
+	}
+	json, err = Set(`{"a":1}`, "", map[string]int{"b": 2})
+	if err != nil || json != `{"b":2}` {
+		t.Fatalf("expected '{\"b\":2}', got '%v', %v", json, err)
+	}
+	json, err = SetOptions("#!x\n{\"a\":1}", "", 5,
+		&Options{SkipPrefixBytes: -1})
+	if err != nil || json != "#!x\n5" {
+		t.Fatalf("expected '#!x\\n5', got '%v', %v", json, err)
+	}
+	if _, err = SetOptions(`{"a":1}`, "", 5,
+		&Options{PreserveType: true}); err == nil {
+		t.Fatal("expected type error")
+	}
+	var buf bytes.Buffer
+	if err = SetWriter(&buf, `{"a":1}`, "", true); err != nil ||
+		buf.String() != "true" {
+		t.Fatalf("expected 'true', got '%v', %v", buf.String(), err)
+	}
+	if _, err = Delete(`{"a":1}`, ""); err == nil {
+		t.Fatal("expected error deleting the root")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	opts := &Options{Validate: true}
+	for _, raw := range []string{`{"a":`, `1 2`, `tru`, `"x`, `[1,]`} {
+		json, err := SetRawOptions(`{"a":1}`, "b", raw, opts)
+		if err != ErrInvalidOutput {
+			t.Fatalf("'%v': expected ErrInvalidOutput, got '%v', %v",
+				raw, json, err)
+		}
+		if json != `{"a":1}` {
+			t.Fatalf("expected the input json, got '%v'", json)
+		}
+	}
+	json, err := SetRawOptions(`{"a":1}`, "b", ` {"c":[1,2]} `, opts)
+	if err != nil || json != `{"a":1,"b": {"c":[1,2]} }` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	// without the option the raw value is trusted
+	json, err = SetRaw(`{"a":1}`, "b", `{"a":`)
+	if err != nil || json != `{"a":1,"b":{"a":}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	// a value that runs into the next token
+	if separated([]byte(`{"a":1"b":2}`), 0, 5, 6) {
+		t.Fatal("expected value to not be separated")
+	}
+	if !separated([]byte(`#!x {"a":1}`), 4, 4, 11) {
+		t.Fatal("expected value to be separated")
+	}
+}
+
+func TestSetRawBytesInPlaceSameSize(t *testing.T) {
+	json := []byte(`{"a":{"b":{"c":{"d":[1,{"e":12345}]}}},"f":true}`)
+	opts := &Options{Optimistic: true, ReplaceInPlace: true}
+	res, err := SetRawBytesOptions(json, "a.b.c.d.1.e", []byte("54321"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"a":{"b":{"c":{"d":[1,{"e":54321}]}}},"f":true}`
+	if string(res) != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	if &res[0] != &json[0] || len(res) != len(json) {
+		t.Fatal("expected the same backing array")
+	}
+}
+
+func BenchmarkSetRawBytesInPlaceSameSize(b *testing.B) {
+	json := []byte(`{"a":{"b":{"c":{"d":[1,{"e":12345}]}}},"f":true}`)
+	opts := &Options{Optimistic: true, ReplaceInPlace: true}
+	values := [][]byte{[]byte("54321"), []byte("12345")}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		json, err = SetRawBytesOptions(json, "a.b.c.d.1.e", values[i&1], opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	opts := &Options{SortKeys: true}
+	tests := []struct {
+		json, path string
+		value      interface{}
+		exp        string
+	}{
+		{`{"b":1,"d":2}`, "c", 3, `{"b":1,"c":3,"d":2}`},
+		{`{"b":1,"d":2}`, "a.z", 3, `{"a":{"z":3},"b":1,"d":2}`},
+		{`{"d":2,"b":1}`, "c", 3, `{"b":1,"c":3,"d":2}`},
+		{`{"x":{"d":2,"b":1},"a":0}`, "x.c", 3, `{"x":{"b":1,"c":3,"d":2},"a":0}`},
+		{`{"b":1,"d":2}`, "d", 3, `{"b":1,"d":3}`},
+		{`{"d":2,"b":1}`, "d", 3, `{"d":3,"b":1}`},
+		{"{\n  \"b\": 1,\n  \"d\": 2\n}", "a", 3,
+			"{\n  \"a\":3,\n  \"b\": 1,\n  \"d\": 2\n}"},
+		{"{\n  \"b\": 1,\n  \"d\": 2\n}", "c", "x",
+			"{\n  \"b\": 1,\n  \"c\":\"x\",\n  \"d\": 2\n}"},
+		{"{ \"d\": 2 , \"b\": 1 }", "c", 3, "{ \"b\": 1, \"c\":3, \"d\": 2 }"},
+	}
+	for _, tt := range tests {
+		res, err := SetOptions(tt.json, tt.path, tt.value, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tt.exp {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.path, tt.exp, res)
+		}
+	}
+	json := "{\n  \"b\": 1,\n  \"d\": 2\n}\n"
+	res, err := SetOptions(json, "a", 3,
+		&Options{SortKeys: true, KeepFormatting: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "{\n  \"a\": 3,\n  \"b\": 1,\n  \"d\": 2\n}\n"; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	st := newSetState(opts)
+	out, err := set(`{"d":2,"b":1}`, "c.x", "hi", true, false, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out[st.index:st.end]) != `"hi"` {
+		t.Fatalf("unexpected value location in '%s'", out)
+	}
+}
+
+func TestSetStream(t *testing.T) {
+	json := `{"name":{"first":"Tom","last":"Anderson"},"age":37,` +
+		`"children":["Sara","Alex","Jack"],"fav.movie":"Deer Hunter",` +
+		"\n" + `"friends":[{"first":"James","last":"Murphy"},` +
+		`{"first":"Roger","last":"Craig"}]}` + "\n"
+	for _, tc := range []struct {
+		path  string
+		value interface{}
+	}{
+		{"name.last", "Smith"},
+		{"name.middle", "J"},
+		{"age", map[string]int{"years": 38}},
+		{"children.1", nil},
+		{"children.-1", "Ann"},
+		{"children.5", 5},
+		{`fav\.movie`, []int{1, 2}},
+		{"friends.1.last", "Ford"},
+		{"friends.1.nets.0", "fb"},
+		{"friends.3.a.b", true},
+		{"x.y.z", 1},
+		{"x.:0", 1},
+		{"age.x", 1},
+	} {
+		var buf bytes.Buffer
+		err := SetStream(&buf, strings.NewReader(json), tc.path, tc.value)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.path, err)
+		}
+		exp, err := Set(json, tc.path, tc.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Canonical(buf.String())
+		if want, _ := Canonical(exp); err != nil || got != want {
+			t.Fatalf("%v: expected '%v', got '%v'", tc.path, exp, buf.String())
+		}
+	}
+	var buf bytes.Buffer
+	if err := SetStream(&buf, strings.NewReader(""), "a.0", 1); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `{"a":[1]}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":[1]}`, buf.String())
+	}
+	buf.Reset()
+	SetStream(&buf, strings.NewReader(` {"a" : 1 , "b":2} `), "a", "x")
+	if buf.String() != ` {"a" : "x" , "b":2} ` {
+		t.Fatalf("unexpected result '%v'", buf.String())
+	}
+	for _, path := range []string{"", "friends.#.last", "children.x"} {
+		if SetStream(io.Discard, strings.NewReader(json), path, 1) == nil {
+			t.Fatalf("%v: expected error", path)
+		}
+	}
+	err := SetStream(io.Discard, strings.NewReader(`{"a":[1,`), "b", 1)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected '%v', got '%v'", io.ErrUnexpectedEOF, err)
+	}
+	if SetStream(failWriter{}, strings.NewReader(json), "age", 1) == nil {
+		t.Fatal("expected write error")
+	}
+}
+
+func TestFloatPrecision(t *testing.T) {
+	json, err := SetOptions(`{}`, "price", 1.0/3.0,
+		&Options{FloatPrecision: 2})
+	if err != nil || json != `{"price":0.33}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"price":0.33}`, json, err)
+	}
+	json, _ = SetOptions(`{}`, "a", []float64{1, 2.005, 10.5},
+		&Options{FloatPrecision: 2})
+	if json != `{"a":[1.00,2.00,10.50]}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	json, _ = SetOptions(`{}`, "a", float32(0.1), &Options{FloatBitSize: 32})
+	if json != `{"a":0.1}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":0.1}`, json)
+	}
+	json, _ = Set(`{}`, "a", 1.0/3.0)
+	if json != `{"a":0.3333333333333333}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	json, _ = SetOptions(`{}`, "a", 1, &Options{FloatPrecision: 2})
+	if json != `{"a":1}` {
+		t.Fatalf("expected integers to be unaffected, got '%v'", json)
+	}
+	json, err = SetFloatPrecision(`{}`, "a", 2.5, 0)
+	if err != nil || json != `{"a":2}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"a":2}`, json, err)
+	}
+	json, _ = SetFloatPrecision(`{}`, "a", 12.3456, 3)
+	if json != `{"a":12.346}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":12.346}`, json)
+	}
+	if _, err = SetFloatPrecision(`{}`, "a", math.NaN(), 2); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = SetFloatPrecision(`{}`, "a", 1, -1); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = SetOptions(`{}`, "a", 1e300,
+		&Options{FloatBitSize: 32}); err == nil {
+		t.Fatal("expected error for a float32 overflow")
+	}
+	json, err = SetOptions(`{}`, "a", []float64{1e300, -1e300, 1.5},
+		&Options{FloatBitSize: 32, InvalidFloat: NullOnInvalidFloat})
+	if err != nil || json != `{"a":[null,null,1.5]}` {
+		t.Fatalf("expected '%v', got '%v', %v", `{"a":[null,null,1.5]}`, json, err)
+	}
+	json, _ = SetOptions(`{}`, "a", math.MaxFloat32, &Options{FloatBitSize: 32})
+	if json != `{"a":340282350000000000000000000000000000000}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+}
+
+func TestEmbeddedJSON(t *testing.T) {
+	json := `{"id":1,"payload":"{\"a\":1,\"b\":[\"x\"]}","tail":true}`
+	tests := []struct {
+		path  string
+		value interface{}
+		exp   string
+	}{
+		{"payload.@json.a", 2,
+			`{"id":1,"payload":"{\"a\":2,\"b\":[\"x\"]}","tail":true}`},
+		{"payload.@json.c.d", "q\"t",
+			`{"id":1,"payload":"{\"a\":1,\"b\":[\"x\"],\"c\":{\"d\":\"q\\\"t\"}}","tail":true}`},
+		{"payload.@json.b.-1", "y",
+			`{"id":1,"payload":"{\"a\":1,\"b\":[\"x\",\"y\"]}","tail":true}`},
+		{"payload.@json", map[string]int{"z": 1},
+			`{"id":1,"payload":"{\"z\":1}","tail":true}`},
+	}
+	for _, tt := range tests {
+		res, err := Set(json, tt.path, tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tt.exp {
+			t.Fatalf("%v: expected '%v', got '%v'", tt.path, tt.exp, res)
+		}
+	}
+	res, err := Delete(json, "payload.@json.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"id":1,"payload":"{\"a\":1}","tail":true}`; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	// nested documents
+	json = `{"p":"{\"q\":\"{\\\"r\\\":1}\"}"}`
+	res, err = Set(json, "p.@json.q.@json.r", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := gjson.Get(gjson.Get(gjson.Get(res, "p").String(), "q").String(),
+		"r").Int(); v != 2 {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	for _, path := range []string{"id.@json.a", "tail.@json.a", "x.@json.a",
+		"@json.a"} {
+		if _, err := Set(json, path, 1); err == nil {
+			t.Fatalf("%v: expected error", path)
+		}
+	}
+	if _, err := Set(`{"s":"not json"}`, "s.@json.a", 1); err == nil {
+		t.Fatal("expected error")
+	}
+	// an escaped '@' is a literal key
+	res, _ = Set(`{}`, `a.\@json`, 1)
+	if res != `{"a":{"@json":1}}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+}
+
+func TestAppendUnique(t *testing.T) {
+	opts := &Options{AppendUnique: true}
+	json := `{"tags":["a",1,{"x":1,"y":[2]},null]}`
+	for _, tc := range []struct {
+		value  interface{}
+		exists bool
+	}{
+		{"a", true}, {"b", false}, {1.0, true}, {"1", false},
+		{map[string]interface{}{"y": []int{2}, "x": 1}, true},
+		{map[string]int{"x": 1}, false}, {nil, true}, {false, false},
+	} {
+		res, err := SetOptions(json, "tags.-1", tc.value, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (res == json) != tc.exists {
+			t.Fatalf("%v: unexpected result '%v'", tc.value, res)
+		}
+	}
+	res, err := SetRawOptions(json, "tags.-1", ` { "y" : [ 2 ], "x" : 1.0 } `,
+		opts)
+	if err != nil || res != json {
+		t.Fatalf("expected no change, got '%v', %v", res, err)
+	}
+	res, _ = SetOptions(`{}`, "tags.-1", "a", opts)
+	if res != `{"tags":["a"]}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, _ = SetOptions(`{"a":[{"t":["x"]},{"t":["y"]}]}`, "a.#.t.-1", "x",
+		opts)
+	if res != `{"a":[{"t":["x"]},{"t":["y","x"]}]}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	// only the append key is affected
+	res, _ = SetOptions(json, "tags.4", "a", opts)
+	if res != `{"tags":["a",1,{"x":1,"y":[2]},null,"a"]}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+}
+
+func TestSetBase64(t *testing.T) {
+	data := []byte("a\"b\\c\x00\xff")
+	json, err := SetBase64(`{}`, "data", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"data":"` + base64.StdEncoding.EncodeToString(data) + `"}`
+	if json != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, json)
+	}
+	var v struct{ Data []byte }
+	if err := jsongo.Unmarshal([]byte(json), &v); err != nil ||
+		!bytes.Equal(v.Data, data) {
+		t.Fatalf("unexpected round trip %q, %v", v.Data, err)
+	}
+	res, err := SetBase64Bytes([]byte(`{}`), "data", data)
+	if err != nil || string(res) != exp {
+		t.Fatalf("expected '%v', got '%v', %v", exp, res, err)
+	}
+	// a []byte is raw json
+	json, err = Set(`{}`, "a", []byte(`{"b":"\"\\"}`))
+	if err != nil || json != `{"a":{"b":"\"\\"}}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	json, _ = Set(`{}`, "a", []byte{})
+	if json != `{"a":null}` {
+		t.Fatalf("expected '%v', got '%v'", `{"a":null}`, json)
+	}
+	if _, err = Set(`{}`, "a", data); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+	// named byte slices, elements and map values are raw json as well
+	type rawBytes []byte
+	json, err = Set(`{}`, "a", rawBytes(`[1]`))
+	if err != nil || json != `{"a":[1]}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	if _, err = Set(`{}`, "a", rawBytes(data)); err == nil {
+		t.Fatal("expected error for invalid json")
+	}
+	json, _ = Set(`{}`, "a", [][]byte{[]byte(`1`), []byte(`"x"`)})
+	if json != `{"a":[1,"x"]}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	json, _ = Set(`{}`, "a", map[string]rawBytes{"b": rawBytes(`true`)})
+	if json != `{"a":{"b":true}}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	// struct fields and byte arrays are encoded by encoding/json
+	json, _ = Set(`{}`, "a", struct{ B []byte }{[]byte("hi")})
+	if json != `{"a":{"B":"aGk="}}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+	json, _ = Set(`{}`, "a", [2]byte{1, 2})
+	if json != `{"a":[1,2]}` {
+		t.Fatalf("unexpected result '%v'", json)
+	}
+}
+
+func TestPathExists(t *testing.T) {
+	json := `{"a":{"1":"x"},"b":[1,{"c":2},null],"d.e":true,"f":[{"g":1},{}]}`
+	for _, tc := range []struct {
+		path             string
+		exists, resolves bool
+	}{
+		{"a.:1", true, true},
+		{"a.1", true, true},
+		{"a.2", false, true},
+		{"b.1.c", true, true},
+		{"b.2", true, true},
+		{"b.5", false, true},
+		{"b.-1", false, true},
+		{"b.x", false, false},
+		{`d\.e`, true, true},
+		{"d.e", false, true},
+		{"f.#.g", true, true},
+		{"f.#(g==1).g", true, true},
+		{"f.#(g==2).g", false, false},
+		{"x.y.z", false, true},
+		{"a.*", true, true},
+		{"z*", false, false},
+		{"", true, true},
+	} {
+		if exists := PathExists(json, tc.path); exists != tc.exists {
+			t.Fatalf("%v: expected exists %v", tc.path, tc.exists)
+		}
+		resolves, err := PathResolvable(json, tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolves != tc.resolves {
+			t.Fatalf("%v: expected resolvable %v", tc.path, tc.resolves)
+		}
+	}
+	if PathExists(json, "f.#(g==1") {
+		t.Fatal("expected invalid path to not exist")
+	}
+	if _, err := PathResolvable(json, "f.#(g==1"); err == nil {
+		t.Fatal("expected error")
+	}
+	if PathExists("", "") || PathExists("", "a") {
+		t.Fatal("expected nothing to exist in an empty document")
+	}
+	// keys are matched like Set, including escaped keys
+	if !PathExists(`{"a\u002eb":1}`, `a\.b`) {
+		t.Fatal("expected escaped key to exist")
+	}
+	if !PathExists(`{"a":{"b":1},"a":{"c":2}}`, "a.c") ||
+		PathExists(`{"a":{"b":1},"a":{"c":2}}`, "a.b") {
+		t.Fatal("expected the last duplicate key to be used")
+	}
+}
+
+func TestDeleteWithStatus(t *testing.T) {
+	for _, tc := range []struct {
+		json, path, exp string
+		removed         bool
+	}{
+		{`{"1":"2"}`, "3", `{"1":"2"}`, false},
+		{`{"1":"2"}`, "1", `{}`, true},
+		{`{"a":[1,2]}`, "a.-1", `{"a":[1]}`, true},
+		{`{"a":[]}`, "a.-1", `{"a":[]}`, false},
+		{`{"a":[{"b":1},{}]}`, "a.#.b", `{"a":[{},{}]}`, true},
+		{`{"a":[{},{}]}`, "a.#.b", `{"a":[{},{}]}`, false},
+		{`{"a":null}`, "a", `{}`, true},
+	} {
+		res, removed, err := DeleteWithStatus(tc.json, tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.exp || removed != tc.removed {
+			t.Fatalf("%v: expected '%v' %v, got '%v' %v", tc.path, tc.exp,
+				tc.removed, res, removed)
+		}
+	}
+	if _, _, err := DeleteWithStatus(`{}`, "a.#(b==1"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNoArrayGrowth(t *testing.T) {
+	opts := &Options{NoArrayGrowth: true}
+	json := `{"b":{"this":[1]}}`
+	for _, path := range []string{"b.this.4", "b.this.1", "b.that.0",
+		"c.0.d", "b.this.-1.0"} {
+		res, err := SetOptions(json, path, 2, opts)
+		if err == nil {
+			t.Fatalf("%v: expected error, got '%v'", path, res)
+		}
+		if res != json {
+			t.Fatalf("expected the input json, got '%v'", res)
+		}
+	}
+	for _, tc := range []struct{ path, exp string }{
+		{"b.this.0", `{"b":{"this":[2]}}`},
+		{"b.this.-1", `{"b":{"this":[1,2]}}`},
+		{"b.that.-1", `{"b":{"this":[1],"that":[2]}}`},
+		{"b.x", `{"b":{"this":[1],"x":2}}`},
+	} {
+		res, err := SetOptions(json, tc.path, 2, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != tc.exp {
+			t.Fatalf("%v: expected '%v', got '%v'", tc.path, tc.exp, res)
+		}
+	}
+	// without the option the array is padded
+	res, _ := Set(json, "b.this.4", 2)
+	if res != `{"b":{"this":[1,null,null,null,2]}}` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+}
+
+func TestLastQueryMatch(t *testing.T) {
+	json := `{"friends":[{"first":"Dale","last":"Murphy"},` +
+		`{"first":"Roger","last":"Craig"},{"first":"Jane","last":"Murphy"}]}`
+	res, err := Set(json, `friends.#(last="Murphy")-.age`, 47)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel := gjson.Get(res, "friends.#.age").Raw; sel != `[47]` ||
+		gjson.Get(res, "friends.2.age").Int() != 47 {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, err = Delete(json, `friends.#(last="Murphy")-`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"friends":[{"first":"Dale","last":"Murphy"},` +
+		`{"first":"Roger","last":"Craig"}]}`; res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	res, err = Set(json, `friends.#(last="Craig")-.first`, "Rog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gjson.Get(res, "friends.1.first").String() != "Rog" {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+	res, err = Set(json, `friends.#(last="Smith")-.first`, "X")
+	if err != nil || res != json {
+		t.Fatalf("expected no change, got '%v', %v", res, err)
+	}
+	res, _ = Set(`[[1,2],[3,1]]`, `#.#(==1)-`, 0)
+	if res != `[[0,2],[3,0]]` {
+		t.Fatalf("unexpected result '%v'", res)
+	}
+}
+
+func TestSetRawReader(t *testing.T) {
+	big := `[` + strings.Repeat(`{"a":"b"},`, 1000) + `1]`
+	json, err := SetRawReader(`{"x":1,"y":2}`, "x", strings.NewReader(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := `{"x":` + big + `,"y":2}`; json != exp {
+		t.Fatalf("unexpected result '%.40v...'", json)
+	}
+	json, err = SetRawReader(`{"x":1}`, "a.b.-1", strings.NewReader(`"s"`))
+	if err != nil || json != `{"x":1,"a":{"b":["s"]}}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	json, err = SetRawReader(`{"a":[{},{}]}`, "a.#.b", strings.NewReader(`2`))
+	if err != nil || json != `{"a":[{"b":2},{"b":2}]}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	if _, err = SetRawReader(`{}`, "a", strings.NewReader(" ")); err != ErrEmptyRaw {
+		t.Fatalf("expected '%v', got '%v'", ErrEmptyRaw, err)
+	}
+	opts := &Options{Validate: true}
+	if _, err = SetRawReaderOptions(`{}`, "a", strings.NewReader(`{"a":`),
+		opts); err != ErrInvalidOutput {
+		t.Fatalf("expected '%v', got '%v'", ErrInvalidOutput, err)
+	}
+	json, err = SetRawReaderOptions(`{"a":"x"}`, "a", strings.NewReader(`1`),
+		&Options{PreserveType: true})
+	if err == nil {
+		t.Fatalf("expected type error, got '%v'", json)
+	}
+	json, err = SetRawReaderOptions("{\n  \"a\": 1\n}", "b",
+		strings.NewReader("[ 1, 2 ]"), &Options{NormalizeWhitespace: true})
+	if err != nil || json != `{"a":1,"b":[1,2]}` {
+		t.Fatalf("unexpected result '%v', %v", json, err)
+	}
+	rerr := errors.New("read error")
+	if _, err = SetRawReader(`{}`, "a", iotest.ErrReader(rerr)); err != rerr {
+		t.Fatalf("expected '%v', got '%v'", rerr, err)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	segs, err := ParsePath(`friends.#(last=="a.b").nick\.name.:2.-1.#.3.#(x>1)-`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Segment{
+		{KeySegment, "friends", "friends"},
+		{QuerySegment, `#(last=="a.b")`, `#(last=="a.b")`},
+		{KeySegment, "nick.name", `nick\.name`},
+		{KeySegment, "2", ":2"},
+		{AppendSegment, "-1", "-1"},
+		{WildcardSegment, "#", "#"},
+		{IndexSegment, "3", "3"},
+		{QuerySegment, "#(x>1)-", "#(x>1)-"},
+	}
+	if len(segs) != len(exp) {
+		t.Fatalf("expected %d segments, got %d", len(exp), len(segs))
+	}
+	for i := range exp {
+		if segs[i] != exp[i] {
+			t.Fatalf("segment %d: expected %+v, got %+v", i, exp[i], segs[i])
+		}
+	}
+	if segs, err = ParsePath(""); err != nil || len(segs) != 0 {
+		t.Fatalf("unexpected result %v, %v", segs, err)
+	}
+	segs, err = ParsePath(`config.*.enabled.us?r.doc.@json.a#b.\:x\*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = []Segment{
+		{KeySegment, "config", "config"},
+		{GlobSegment, "*", "*"},
+		{KeySegment, "enabled", "enabled"},
+		{GlobSegment, "us?r", "us?r"},
+		{KeySegment, "doc", "doc"},
+		{EmbeddedSegment, "@json", "@json"},
+		{KeySegment, "a#b", "a#b"},
+		{KeySegment, ":x*", `\:x\*`},
+	}
+	if fmt.Sprint(segs) != fmt.Sprint(exp) {
+		t.Fatalf("expected %v, got %v", exp, segs)
+	}
+	for _, path := range []string{"a.@reverse", "a.#(b==1", "a.b)"} {
+		_, err := ParsePath(path)
+		if _, ok := err.(*PathError); !ok {
+			t.Fatalf("%q: expected *PathError, got '%v'", path, err)
+		}
+	}
+	_, err = ParsePath("a.b|c.d")
+	if perr, ok := err.(*PathError); !ok || perr.Pos != 2 {
+		t.Fatalf("expected *PathError at 2, got '%v'", err)
+	}
+}